@@ -0,0 +1,311 @@
+// Package audit writes the proxy's audit trail: one JSON object per line for
+// every query and authentication event, delivered to one or more sinks.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/sqlparse"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EventQuery            = "query"
+	EventAuthSuccess      = "auth_success"
+	EventAuthFailure      = "auth_failure"
+	EventConnectionDenied = "connection_denied"
+)
+
+// Policies for a full sink queue.
+const (
+	PolicyBlock  = "block"
+	PolicyDrop   = "drop"
+	PolicyRefuse = "refuse"
+)
+
+// ErrUnavailable is returned for records refused because a sink is full.
+var ErrUnavailable = errors.New("audit log unavailable")
+
+type Record struct {
+	Time  time.Time `json:"ts"`
+	Event string    `json:"event"`
+	// user as authenticated by the proxy, or as sent by the client when
+	// authentication failed
+	ProxyUser   string `json:"proxy_user,omitempty"`
+	BackendUser string `json:"backend_user,omitempty"`
+	Client      string `json:"client"`
+	ConnId      uint64 `json:"conn_id"`
+	Database    string `json:"db,omitempty"`
+	Command     string `json:"command,omitempty"`
+	SQL         string `json:"sql,omitempty"`
+	DurationUs  int64  `json:"duration_us,omitempty"`
+	// rows returned by a result set, or affected otherwise
+	Rows      uint64 `json:"rows,omitempty"`
+	ErrorCode uint16 `json:"error_code,omitempty"`
+	// why authentication failed, see proxy.authFailureReason
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// set when records are chained, see AuditChainConfig
+	Seq      uint64 `json:"seq,omitempty"`
+	PrevHash string `json:"prev_hash,omitempty"`
+	// on checkpoints only
+	KeyId     string `json:"key_id,omitempty"`
+	Signature string `json:"sig,omitempty"`
+}
+
+// Sink delivers encoded records, one line at a time.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Logger encodes records and queues them for each of its sinks. A nil
+// *Logger discards them.
+type Logger struct {
+	mu      sync.Mutex
+	workers []*worker
+	redact  bool
+	policy  string
+	closed  bool
+	dropped uint64
+	chain   *chain
+	stop    chan struct{}
+}
+
+// New builds the sinks described by cfg.
+func New(cfg *config.AuditConfig) (*Logger, error) {
+	// A record dropped after it was chained would look like tampering.
+	if cfg.Chain != nil && cfg.FullPolicy != "" && cfg.FullPolicy != PolicyBlock {
+		return nil, fmt.Errorf("audit chain needs the %q full policy, not %q", PolicyBlock, cfg.FullPolicy)
+	}
+	// The chain goes on from the file after a restart, it would start over
+	// without one.
+	if cfg.Chain != nil && cfg.File == "" {
+		return nil, errors.New("audit chain needs the audit file")
+	}
+	sinks := []Sink{}
+	if cfg.File != "" {
+		sinks = append(sinks, NewFileSink(cfg.File, cfg.Rotation))
+	}
+	if cfg.Syslog != nil {
+		sink, err := NewSyslogSink(cfg.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.Webhook != nil {
+		sink, err := NewWebhookSink(cfg.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("audit log has no sinks configured")
+	}
+	logger, err := NewLogger(sinks, cfg.QueueSize, cfg.FullPolicy, cfg.RedactLiterals)
+	if err != nil || cfg.Chain == nil {
+		return logger, err
+	}
+	err = logger.startChain(cfg.Chain, cfg.File)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+	return logger, nil
+}
+
+// NewLogger sends records to sinks, with up to queue_size records waiting
+// for each. With redact set, the literals of SQL texts are replaced with ?.
+func NewLogger(sinks []Sink, queue_size int, policy string, redact bool) (*Logger, error) {
+	switch policy {
+	case "":
+		policy = PolicyBlock
+	case PolicyBlock, PolicyDrop, PolicyRefuse:
+	default:
+		return nil, fmt.Errorf("unknown audit full policy %q", policy)
+	}
+	if queue_size <= 0 {
+		queue_size = 10000
+	}
+	logger := &Logger{
+		redact: redact,
+		policy: policy,
+	}
+	for _, sink := range sinks {
+		logger.workers = append(logger.workers, startWorker(sink, queue_size))
+	}
+	return logger, nil
+}
+
+// Log queues record for every sink. What happens when a queue is full
+// depends on the policy: Log waits, drops the record or returns
+// ErrUnavailable.
+func (r *Logger) Log(record *Record) error {
+	if r == nil {
+		return nil
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+	if r.redact && record.SQL != "" {
+		record.SQL = sqlparse.Redact(record.SQL)
+	}
+
+	// Records are queued in the order they were logged, which is also the
+	// order of the chain.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrUnavailable
+	}
+	if r.chain == nil {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return r.enqueue(line)
+	}
+	line, err := r.chain.link(record)
+	if err != nil {
+		return err
+	}
+	err = r.enqueue(line)
+	if r.chain.due() {
+		err = firstError(err, r.checkpoint())
+	}
+	return err
+}
+
+// enqueue queues line for every sink according to the policy. The caller
+// holds r.mu.
+func (r *Logger) enqueue(line []byte) error {
+	line = append(line, '\n')
+	var err error
+	for _, worker := range r.workers {
+		if r.policy == PolicyBlock {
+			worker.queue <- line
+			continue
+		}
+		select {
+		case worker.queue <- line:
+		default:
+			atomic.AddUint64(&r.dropped, 1)
+			if r.policy == PolicyRefuse {
+				err = ErrUnavailable
+			}
+		}
+	}
+	return err
+}
+
+// Accepting reports whether new queries should be let through: with the
+// refuse policy, not while a sink is full or failing.
+func (r *Logger) Accepting() bool {
+	if r == nil || r.policy != PolicyRefuse {
+		return true
+	}
+	for _, worker := range r.workers {
+		if worker.full() || worker.failing() {
+			return false
+		}
+	}
+	return true
+}
+
+// Dropped returns the number of records discarded because a sink was full.
+func (r *Logger) Dropped() uint64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Close delivers the records still queued, as far as the sinks allow, and
+// closes the sinks.
+func (r *Logger) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	var ret error
+	if r.chain != nil && !r.closed {
+		close(r.stop)
+		// The tail of the log is covered by a last checkpoint.
+		if r.chain.since > 0 {
+			ret = r.checkpoint()
+		}
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	for _, worker := range r.workers {
+		err := worker.close()
+		ret = firstError(ret, err)
+	}
+	return ret
+}
+
+// startChain chains the records from now on, continuing the chain in file.
+func (r *Logger) startChain(cfg *config.AuditChainConfig, file string) error {
+	c, err := newChain(cfg, file)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(cfg.CheckpointSeconds) * time.Second
+	if interval <= 0 {
+		interval = 300 * time.Second
+	}
+	r.mu.Lock()
+	r.chain = c
+	r.stop = make(chan struct{})
+	r.mu.Unlock()
+	go r.checkpointEvery(interval)
+	return nil
+}
+
+// checkpointEvery adds a checkpoint every interval when records were logged
+// since the last one, so that a quiet log is not left unsigned for long.
+func (r *Logger) checkpointEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		if !r.closed && r.chain.since > 0 {
+			err := r.checkpoint()
+			if err != nil {
+				log.Printf("Failed to write audit checkpoint: %s", err.Error())
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// checkpoint queues a signed checkpoint. The caller holds r.mu.
+func (r *Logger) checkpoint() error {
+	line, err := r.chain.checkpoint()
+	if err != nil {
+		return err
+	}
+	return r.enqueue(line)
+}
+
+func firstError(err, other error) error {
+	if err != nil {
+		return err
+	}
+	return other
+}
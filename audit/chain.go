@@ -0,0 +1,237 @@
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"strings"
+	"time"
+)
+
+const EventCheckpoint = "checkpoint"
+
+// chain links records by hash and signs checkpoints over the chain.
+type chain struct {
+	key    ed25519.PrivateKey
+	key_id string
+	every  int
+	seq    uint64
+	// hex SHA-256 of the last line
+	prev string
+	// records since the last checkpoint
+	since int
+}
+
+// newChain starts a chain, continuing the one in file when there is one.
+func newChain(cfg *config.AuditChainConfig, file string) (*chain, error) {
+	key, err := LoadSigningKey(cfg.SigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &chain{
+		key:    key,
+		key_id: KeyId(key.Public().(ed25519.PublicKey)),
+		every:  cfg.CheckpointRecords,
+	}
+	if c.every <= 0 {
+		c.every = 1000
+	}
+
+	line, err := lastLogLine(file)
+	if err != nil || line == nil {
+		return c, err
+	}
+	last := &Record{}
+	err = json.Unmarshal(line, last)
+	if err != nil {
+		return nil, fmt.Errorf("cannot continue audit chain from %s: %w", file, err)
+	}
+	c.seq = last.Seq
+	c.prev = lineHash(line)
+	return c, nil
+}
+
+// link numbers record and points it at the record before it, returning its
+// encoded line.
+func (c *chain) link(record *Record) ([]byte, error) {
+	c.seq++
+	record.Seq = c.seq
+	record.PrevHash = c.prev
+	line, err := json.Marshal(record)
+	if err != nil {
+		c.seq--
+		return nil, err
+	}
+	c.prev = lineHash(line)
+	c.since++
+	return line, nil
+}
+
+func (c *chain) due() bool {
+	return c.since >= c.every
+}
+
+// checkpoint returns a signed checkpoint covering every record so far, as
+// the next line of the chain.
+func (c *chain) checkpoint() ([]byte, error) {
+	record := &Record{
+		Time:  time.Now().UTC(),
+		Event: EventCheckpoint,
+		KeyId: c.key_id,
+	}
+	record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, checkpointMessage(c.seq+1, c.prev)))
+	line, err := c.link(record)
+	if err != nil {
+		return nil, err
+	}
+	c.since = 0
+	return line, nil
+}
+
+// checkpointMessage is what a checkpoint signs: its own position in the
+// chain and the hash of the record before it, which in turn covers all the
+// records before that.
+func checkpointMessage(seq uint64, prev_hash string) []byte {
+	return []byte(fmt.Sprintf("sqlproxy-audit-checkpoint:%d:%s", seq, prev_hash))
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(bytes.TrimRight(line, "\n"))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyId names a public key in checkpoints, so that a verifier can tell
+// which key a checkpoint was signed with.
+func KeyId(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// LoadSigningKey reads an Ed25519 private key in PKCS#8 PEM, as written by
+// openssl genpkey -algorithm ed25519.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed_key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return ed_key, nil
+}
+
+// LoadPublicKey reads an Ed25519 public key in PKIX PEM, or derives it from a
+// private key.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "PRIVATE KEY" {
+		key, err := LoadSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public().(ed25519.PublicKey), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed_key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return ed_key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return block, nil
+}
+
+// lastLogLine returns the last line written to the audit file at path, or to
+// the newest file rotated out of it.
+func lastLogLine(path string) ([]byte, error) {
+	line, err := lastLine(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if line != nil {
+		return line, nil
+	}
+	rotated, err := RotatedFiles(path)
+	if err != nil || len(rotated) == 0 {
+		return nil, err
+	}
+	return lastLine(rotated[len(rotated)-1])
+}
+
+// lastLine returns the last non-empty line of a file, gzipped or not.
+func lastLine(path string) ([]byte, error) {
+	reader, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data[bytes.LastIndexByte(data, '\n')+1:], nil
+}
+
+// openLog opens an audit file, decompressing it if it was gzipped on
+// rotation.
+func openLog(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipFileReader{zr, file}, nil
+}
+
+type gzipFileReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipFileReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
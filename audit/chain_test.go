@@ -0,0 +1,185 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signingKey writes a new Ed25519 key to a file and returns its path and
+// public key.
+func signingKey(t *testing.T) (string, ed25519.PublicKey) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, public
+}
+
+// writeChain logs queries chained to the file sink at path, rotating it
+// after max_size bytes when set, and returns the files oldest first.
+func writeChain(t *testing.T, path, key_file string, max_size int64, queries ...string) []string {
+	sink := NewFileSink(path, &config.AuditRotationConfig{})
+	sink.max_size = max_size
+	logger, err := NewLogger([]Sink{sink}, 0, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = logger.startChain(&config.AuditChainConfig{SigningKeyFile: key_file, CheckpointRecords: 3}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range queries {
+		err = logger.Log(&Record{Event: EventQuery, SQL: sql})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = logger.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := RotatedFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(files, path)
+}
+
+func readLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+func writeLines(t *testing.T, path string, lines []string) {
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChainVerifies(t *testing.T) {
+	key_file, public := signingKey(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	files := writeChain(t, path, key_file, 0, "SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4")
+
+	result, err := Verify(files, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a checkpoint after the third record, and one on close
+	if !result.Intact() || result.Records != 6 || result.Checkpoints != 2 || result.SignedSeq != 6 {
+		t.Fatalf("verification: %+v", result)
+	}
+}
+
+func TestChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name string
+		// changes the lines of the log
+		tamper  func(lines []string) []string
+		line    int
+		problem string
+	}{
+		{
+			name: "edited record",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], "SELECT 2", "SELECT 9", 1)
+				return lines
+			},
+			line:    3,
+			problem: "record 3 does not hold the hash of record 2",
+		},
+		{
+			name: "deleted record",
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			line:    2,
+			problem: "sequence jumps from 1 to 3",
+		},
+		{
+			name: "bad checkpoint signature",
+			tamper: func(lines []string) []string {
+				record := &Record{}
+				json.Unmarshal([]byte(lines[3]), record)
+				record.Signature = strings.Repeat("A", len(record.Signature))
+				line, _ := json.Marshal(record)
+				lines[3] = string(line)
+				return lines
+			},
+			line:    4,
+			problem: "checkpoint 4 has a bad signature",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key_file, public := signingKey(t)
+			path := filepath.Join(t.TempDir(), "audit.log")
+			files := writeChain(t, path, key_file, 0, "SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4")
+			writeLines(t, path, test.tamper(readLines(t, path)))
+
+			result, err := Verify(files, public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Intact() || result.Line != test.line || result.Problem != test.problem {
+				t.Fatalf("verification: %+v", result)
+			}
+		})
+	}
+}
+
+func TestChainContinuesAcrossFiles(t *testing.T) {
+	key_file, public := signingKey(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	files := writeChain(t, path, key_file, 400, "SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4")
+	if len(files) < 2 {
+		t.Fatalf("not rotated: %v", files)
+	}
+	// A restart goes on from the newest rotated file when there is no
+	// current one.
+	err := os.Rename(path, path+"."+time.Now().Format(rotatedSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = writeChain(t, path, key_file, 0, "SELECT 5")
+
+	result, err := Verify(files, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 || !result.Intact() || result.Records != 8 || result.LastSeq != 8 || result.SignedSeq != 8 {
+		t.Fatalf("verification: %+v", result)
+	}
+}
+
+func TestChainNeedsTheFile(t *testing.T) {
+	key_file, _ := signingKey(t)
+	_, err := New(&config.AuditConfig{
+		Syslog: &config.AuditSyslogConfig{Network: "udp", Address: "127.0.0.1:514"},
+		Chain:  &config.AuditChainConfig{SigningKeyFile: key_file},
+	})
+	if err == nil {
+		t.Fatal("chain without the audit file accepted")
+	}
+}
@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotatedSuffix is appended to the file name, after a dot, on rotation. It
+// sorts in time order.
+const rotatedSuffix = "20060102T150405.000000000"
+
+// FileSink appends lines to a file, rotating it by size or age. Rotated
+// files are renamed to path.<time>, and gzipped to path.<time>.gz when
+// compression is on.
+type FileSink struct {
+	path      string
+	max_size  int64
+	max_age   time.Duration
+	max_files int
+	compress  bool
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewFileSink(path string, rotation *config.AuditRotationConfig) *FileSink {
+	sink := &FileSink{path: path}
+	if rotation != nil {
+		sink.max_size = int64(rotation.MaxSizeMB) * 1024 * 1024
+		sink.max_age = time.Duration(rotation.MaxHours) * time.Hour
+		sink.max_files = rotation.MaxFiles
+		sink.compress = rotation.Compress
+	}
+	return sink
+}
+
+func (r *FileSink) Write(line []byte) error {
+	if r.file != nil && r.due(len(line)) {
+		err := r.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		err := r.open()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+func (r *FileSink) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *FileSink) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+// due reports whether the file has to be rotated before adding length bytes.
+func (r *FileSink) due(length int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.max_size > 0 && r.size+int64(length) > r.max_size {
+		return true
+	}
+	return r.max_age > 0 && time.Since(r.opened) >= r.max_age
+}
+
+func (r *FileSink) rotate() error {
+	err := r.Close()
+	if err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().UTC().Format(rotatedSuffix)
+	err = os.Rename(r.path, rotated)
+	if err != nil {
+		return err
+	}
+	if r.compress {
+		err = gzipFile(rotated)
+		if err != nil {
+			// The rotated file is still there, uncompressed.
+			log.Printf("Failed to compress rotated audit log %s: %s", rotated, err.Error())
+		}
+	}
+	return r.prune()
+}
+
+// prune removes the oldest rotated files beyond max_files.
+func (r *FileSink) prune() error {
+	if r.max_files <= 0 {
+		return nil
+	}
+	rotated, err := RotatedFiles(r.path)
+	if err != nil {
+		return err
+	}
+	for len(rotated) > r.max_files {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// RotatedFiles lists the files rotated out of path, oldest first.
+func RotatedFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := []string{}
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+		if _, err := time.Parse(rotatedSuffix, suffix); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return strings.TrimSuffix(rotated[i], ".gz") < strings.TrimSuffix(rotated[j], ".gz")
+	})
+	return rotated, nil
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"compress/gzip"
+	"io"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSinkRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink := NewFileSink(path, &config.AuditRotationConfig{})
+	sink.max_size = 10
+	defer sink.Close()
+
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n"} {
+		err := sink.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, err := RotatedFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("rotated files: %v", rotated)
+	}
+	old, _ := os.ReadFile(rotated[0])
+	current, _ := os.ReadFile(path)
+	if string(old) != "aaaa\nbbbb\n" || string(current) != "cccc\n" {
+		t.Fatalf("rotated %q, current %q", old, current)
+	}
+}
+
+func TestFileSinkCompressesAndPrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink := NewFileSink(path, &config.AuditRotationConfig{MaxFiles: 2, Compress: true})
+	sink.max_size = 5
+	defer sink.Close()
+
+	for _, line := range []string{"1111\n", "2222\n", "3333\n", "4444\n"} {
+		err := sink.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, err := RotatedFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("kept %v", rotated)
+	}
+	contents := []string{}
+	for _, name := range rotated {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Fatalf("not compressed: %s", name)
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(zr)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	if contents[0] != "2222\n" || contents[1] != "3333\n" {
+		t.Fatalf("rotated contents, oldest first: %q", contents)
+	}
+}
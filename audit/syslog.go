@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"authpriv": 10, "local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const syslogSeverityInfo = 6
+
+// SyslogSink sends each line as an RFC 5424 message over a unix datagram
+// socket or UDP. The connection is made again after a failed write.
+type SyslogSink struct {
+	network  string
+	address  string
+	priority int
+	app_name string
+	hostname string
+	conn     net.Conn
+}
+
+func NewSyslogSink(cfg *config.AuditSyslogConfig) (*SyslogSink, error) {
+	sink := &SyslogSink{
+		network:  cfg.Network,
+		address:  cfg.Address,
+		app_name: cfg.AppName,
+	}
+	switch sink.network {
+	case "", "unix", "unixgram":
+		sink.network = "unixgram"
+		if sink.address == "" {
+			sink.address = "/dev/log"
+		}
+	case "udp":
+		if sink.address == "" {
+			sink.address = "127.0.0.1:514"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", cfg.Network)
+	}
+	facility := "local0"
+	if cfg.Facility != "" {
+		facility = cfg.Facility
+	}
+	code, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", cfg.Facility)
+	}
+	sink.priority = code*8 + syslogSeverityInfo
+	if sink.app_name == "" {
+		sink.app_name = "sqlproxy"
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	sink.hostname = hostname
+	return sink, nil
+}
+
+func (r *SyslogSink) Write(line []byte) error {
+	if r.conn == nil {
+		conn, err := net.Dial(r.network, r.address)
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+	}
+	_, err := r.conn.Write(r.message(line, time.Now()))
+	if err != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return err
+}
+
+// message formats line as
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG.
+func (r *SyslogSink) message(line []byte, now time.Time) []byte {
+	header := fmt.Sprintf("<%d>1 %s %s %s %d audit - ",
+		r.priority, now.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), r.hostname, r.app_name, os.Getpid())
+	return append([]byte(header), bytes.TrimRight(line, "\n")...)
+}
+
+func (r *SyslogSink) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"fmt"
+	"net"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogSink(t *testing.T) {
+	tests := []struct {
+		network string
+		listen  func(t *testing.T) (net.PacketConn, error)
+	}{
+		{"udp", func(t *testing.T) (net.PacketConn, error) {
+			return net.ListenPacket("udp", "127.0.0.1:0")
+		}},
+		{"unixgram", func(t *testing.T) (net.PacketConn, error) {
+			return net.ListenPacket("unixgram", filepath.Join(t.TempDir(), "log"))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.network, func(t *testing.T) {
+			listener, err := test.listen(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			sink, err := NewSyslogSink(&config.AuditSyslogConfig{
+				Network:  test.network,
+				Address:  listener.LocalAddr().String(),
+				Facility: "local3",
+				AppName:  "proxy-audit",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			lines := []string{`{"event":"query","sql":"SELECT 1"}` + "\n", `{"event":"login"}` + "\n"}
+			for _, line := range lines {
+				err = sink.Write([]byte(line))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			hostname, _ := os.Hostname()
+			// local3 is facility 19, informational severity 6
+			prefix := fmt.Sprintf("<158>1 %%s %s proxy-audit %d audit - ", hostname, os.Getpid())
+			listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 4096)
+			for _, line := range lines {
+				n, _, err := listener.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// One message per datagram, without the trailing newline.
+				fields := strings.SplitN(string(buf[:n]), " ", 8)
+				if len(fields) != 8 {
+					t.Fatalf("message %q", buf[:n])
+				}
+				timestamp, err := time.Parse(time.RFC3339Nano, fields[1])
+				if err != nil || !strings.HasSuffix(fields[1], "Z") || time.Since(timestamp) > time.Minute {
+					t.Fatalf("timestamp %q", fields[1])
+				}
+				want := fmt.Sprintf(prefix, fields[1]) + strings.TrimSuffix(line, "\n")
+				if string(buf[:n]) != want {
+					t.Fatalf("message %q\nwant    %q", buf[:n], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSyslogSinkConfig(t *testing.T) {
+	for _, cfg := range []config.AuditSyslogConfig{
+		{Network: "tcp"},
+		{Facility: "local8"},
+	} {
+		if _, err := NewSyslogSink(&cfg); err == nil {
+			t.Errorf("accepted %+v", cfg)
+		}
+	}
+	sink, err := NewSyslogSink(&config.AuditSyslogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local0 and informational by default, to the local syslog daemon
+	if sink.network != "unixgram" || sink.address != "/dev/log" || sink.priority != 134 || sink.app_name != "sqlproxy" {
+		t.Fatalf("defaults %+v", sink)
+	}
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Verification is the outcome of checking an audit chain.
+type Verification struct {
+	Records     int
+	Checkpoints int
+	// last record covered by a valid checkpoint
+	SignedSeq uint64
+	LastSeq   uint64
+	// where the chain is first broken, and how; Problem is empty when the
+	// chain is intact
+	File    string
+	Line    int
+	Problem string
+}
+
+// Intact reports whether no broken link was found.
+func (r *Verification) Intact() bool {
+	return r.Problem == ""
+}
+
+// Verify checks the chain running through files, oldest first: that the
+// sequence numbers follow each other, that every record holds the hash of
+// the one before it, and that checkpoints are signed by key. It stops at the
+// first broken link. Errors are only returned for files that cannot be read.
+func Verify(files []string, key ed25519.PublicKey) (*Verification, error) {
+	result := &Verification{}
+	key_id := KeyId(key)
+	prev := ""
+	first := true
+
+	for _, path := range files {
+		reader, err := openLog(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		number := 0
+		for scanner.Scan() {
+			number++
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			problem := result.check(line, prev, first, key, key_id)
+			if problem != "" {
+				reader.Close()
+				result.File = path
+				result.Line = number
+				result.Problem = problem
+				return result, nil
+			}
+			prev = lineHash(line)
+			first = false
+		}
+		err = scanner.Err()
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return result, nil
+}
+
+// check verifies one line against the chain so far, returning what is wrong
+// with it.
+func (r *Verification) check(line []byte, prev string, first bool, key ed25519.PublicKey, key_id string) string {
+	record := &Record{}
+	err := json.Unmarshal(line, record)
+	if err != nil {
+		return "not a JSON record: " + err.Error()
+	}
+	if record.Seq == 0 {
+		return "record is not chained"
+	}
+	// The oldest files may have been pruned, the chain is checked from
+	// wherever it starts.
+	if !first {
+		if record.Seq != r.LastSeq+1 {
+			return fmt.Sprintf("sequence jumps from %d to %d", r.LastSeq, record.Seq)
+		}
+		if record.PrevHash != prev {
+			return fmt.Sprintf("record %d does not hold the hash of record %d", record.Seq, r.LastSeq)
+		}
+	}
+	r.Records++
+	r.LastSeq = record.Seq
+
+	if record.Event != EventCheckpoint {
+		return ""
+	}
+	if record.KeyId != key_id {
+		return fmt.Sprintf("checkpoint %d was signed with key %s, not %s", record.Seq, record.KeyId, key_id)
+	}
+	signature, err := base64.StdEncoding.DecodeString(record.Signature)
+	if err != nil || !ed25519.Verify(key, checkpointMessage(record.Seq, record.PrevHash), signature) {
+		return fmt.Sprintf("checkpoint %d has a bad signature", record.Seq)
+	}
+	r.Checkpoints++
+	r.SignedSeq = record.Seq
+	return ""
+}
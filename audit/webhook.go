@@ -0,0 +1,213 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errWebhookFull = errors.New("audit webhook backlog full")
+
+// WebhookSink posts lines in batches. A batch is sent once it is full or
+// flush_ms after its first line. Batches that fail max_retries times are
+// written to the spool directory, when there is one, and sent again after
+// the next successful post; without one they stay in memory, up to ten
+// batches, after which the sink stops taking lines.
+type WebhookSink struct {
+	url         string
+	headers     map[string]string
+	batch_size  int
+	max_retries int
+	spool_dir   string
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending [][]byte
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewWebhookSink(cfg *config.AuditWebhookConfig) (*WebhookSink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("audit webhook needs a url")
+	}
+	sink := &WebhookSink{
+		url:         cfg.URL,
+		headers:     cfg.Headers,
+		batch_size:  cfg.BatchSize,
+		max_retries: cfg.MaxRetries,
+		spool_dir:   cfg.SpoolDir,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if sink.batch_size <= 0 {
+		sink.batch_size = 100
+	}
+	if sink.max_retries <= 0 {
+		sink.max_retries = 3
+	}
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	sink.client = &http.Client{Timeout: timeout}
+	if sink.spool_dir != "" {
+		err := os.MkdirAll(sink.spool_dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	interval := time.Duration(cfg.FlushMillis) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go sink.flushEvery(interval)
+	return sink, nil
+}
+
+func (r *WebhookSink) Write(line []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) >= 10*r.batch_size {
+		r.flush()
+		if len(r.pending) >= 10*r.batch_size {
+			return errWebhookFull
+		}
+	}
+	r.pending = append(r.pending, line)
+	if len(r.pending) >= r.batch_size {
+		r.flush()
+	}
+	return nil
+}
+
+func (r *WebhookSink) Close() error {
+	close(r.stop)
+	<-r.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flush()
+	if len(r.pending) > 0 {
+		return fmt.Errorf("%d audit records could not be delivered to the webhook", len(r.pending))
+	}
+	return nil
+}
+
+func (r *WebhookSink) flushEvery(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			r.flush()
+			r.mu.Unlock()
+		}
+	}
+}
+
+// flush posts the pending lines, batch by batch, spooling what cannot be
+// delivered. The caller holds r.mu.
+func (r *WebhookSink) flush() {
+	for len(r.pending) > 0 {
+		n := len(r.pending)
+		if n > r.batch_size {
+			n = r.batch_size
+		}
+		body := bytes.Join(r.pending[:n], nil)
+		err := r.postWithRetries(body)
+		posted := err == nil
+		if !posted {
+			log.Printf("Audit webhook failed: %s", err.Error())
+			if r.spool_dir == "" {
+				return
+			}
+			err = r.spool(body)
+			if err != nil {
+				log.Printf("Failed to spool audit batch: %s", err.Error())
+				return
+			}
+		}
+		r.pending = r.pending[n:]
+		if posted {
+			r.resend()
+		}
+	}
+}
+
+func (r *WebhookSink) postWithRetries(body []byte) error {
+	var err error
+	delay := 200 * time.Millisecond
+	for attempt := 0; attempt < r.max_retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = r.post(body)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *WebhookSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for name, value := range r.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *WebhookSink) spool(body []byte) error {
+	name := filepath.Join(r.spool_dir, fmt.Sprintf("%020d.ndjson", time.Now().UnixNano()))
+	return os.WriteFile(name, body, 0600)
+}
+
+// resend posts spooled batches, oldest first, until one fails.
+func (r *WebhookSink) resend() {
+	if r.spool_dir == "" {
+		return
+	}
+	spooled, err := filepath.Glob(filepath.Join(r.spool_dir, "*.ndjson"))
+	if err != nil {
+		return
+	}
+	sort.Strings(spooled)
+	for _, name := range spooled {
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return
+		}
+		if r.post(body) != nil {
+			return
+		}
+		os.Remove(name)
+	}
+}
@@ -0,0 +1,161 @@
+package audit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the bodies posted to it, answering with the status
+// codes in fail first and 200 after.
+type webhookServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	bodies  []string
+	headers []http.Header
+	fail    []int
+	posted  chan struct{}
+}
+
+func newWebhookServer(t *testing.T, fail ...int) *webhookServer {
+	server := &webhookServer{fail: fail, posted: make(chan struct{}, 1)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if len(server.fail) > 0 {
+			w.WriteHeader(server.fail[0])
+			server.fail = server.fail[1:]
+			return
+		}
+		server.bodies = append(server.bodies, string(body))
+		server.headers = append(server.headers, req.Header.Clone())
+		select {
+		case server.posted <- struct{}{}:
+		default:
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (r *webhookServer) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies...)
+}
+
+// wait returns the bodies once at least n have been received.
+func (r *webhookServer) wait(t *testing.T, n int) []string {
+	timeout := time.After(5 * time.Second)
+	for {
+		bodies := r.received()
+		if len(bodies) >= n {
+			return bodies
+		}
+		select {
+		case <-r.posted:
+		case <-timeout:
+			t.Fatalf("received %q, waiting for %d", bodies, n)
+		}
+	}
+}
+
+func (r *webhookServer) failWith(status ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail = status
+}
+
+func TestWebhookBatches(t *testing.T) {
+	server := newWebhookServer(t)
+	sink, err := NewWebhookSink(&config.AuditWebhookConfig{
+		URL:         server.URL,
+		Headers:     map[string]string{"Authorization": "Bearer t"},
+		BatchSize:   3,
+		FlushMillis: 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n", "e\n", "f\n", "g\n"} {
+		err = sink.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Full batches go out at once.
+	bodies := server.received()
+	if len(bodies) != 2 || bodies[0] != "a\nb\nc\n" || bodies[1] != "d\ne\nf\n" {
+		t.Fatalf("full batches: %q", bodies)
+	}
+	// The rest after flush_ms.
+	bodies = server.wait(t, 3)
+	if len(bodies) != 3 || bodies[2] != "g\n" {
+		t.Fatalf("after flush_ms: %q", bodies)
+	}
+
+	server.mu.Lock()
+	header := server.headers[0]
+	server.mu.Unlock()
+	if header.Get("Content-Type") != "application/x-ndjson" || header.Get("Authorization") != "Bearer t" {
+		t.Fatalf("headers: %v", header)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	server := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	sink, err := NewWebhookSink(&config.AuditWebhookConfig{URL: server.URL, BatchSize: 2, FlushMillis: 60000, MaxRetries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Write([]byte("a\n"))
+	sink.Write([]byte("b\n"))
+	bodies := server.received()
+	if len(bodies) != 1 || bodies[0] != "a\nb\n" {
+		t.Fatalf("delivered after retries: %q", bodies)
+	}
+}
+
+func TestWebhookSpoolReplay(t *testing.T) {
+	server := newWebhookServer(t)
+	spool := t.TempDir()
+	sink, err := NewWebhookSink(&config.AuditWebhookConfig{URL: server.URL, BatchSize: 1, FlushMillis: 60000, MaxRetries: 1, SpoolDir: spool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	server.failWith(http.StatusBadGateway, http.StatusBadGateway)
+	sink.Write([]byte("first\n"))
+	sink.Write([]byte("second\n"))
+	spooled, _ := filepath.Glob(filepath.Join(spool, "*.ndjson"))
+	if len(spooled) != 2 || len(server.received()) != 0 {
+		t.Fatalf("spooled %v, delivered %q", spooled, server.received())
+	}
+	body, _ := os.ReadFile(spooled[0])
+	if string(body) != "first\n" {
+		t.Fatalf("spooled batch: %q", body)
+	}
+
+	// The next successful post sends the spool, oldest first.
+	sink.Write([]byte("third\n"))
+	bodies := server.received()
+	if len(bodies) != 3 || bodies[0] != "third\n" || bodies[1] != "first\n" || bodies[2] != "second\n" {
+		t.Fatalf("replayed: %q", bodies)
+	}
+	spooled, _ = filepath.Glob(filepath.Join(spool, "*.ndjson"))
+	if len(spooled) != 0 {
+		t.Fatalf("left in the spool: %v", spooled)
+	}
+}
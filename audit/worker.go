@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const maxRetryDelay = 30 * time.Second
+
+// worker feeds the queued lines to one sink, retrying a line until the sink
+// takes it so that nothing is lost while the sink is down.
+type worker struct {
+	sink   Sink
+	queue  chan []byte
+	done   chan struct{}
+	closed int32
+	// set while the last write failed
+	failed int32
+}
+
+func startWorker(sink Sink, queue_size int) *worker {
+	w := &worker{
+		sink:  sink,
+		queue: make(chan []byte, queue_size),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	for line := range w.queue {
+		delay := 100 * time.Millisecond
+		for {
+			err := w.sink.Write(line)
+			if err == nil {
+				atomic.StoreInt32(&w.failed, 0)
+				break
+			}
+			if atomic.SwapInt32(&w.failed, 1) == 0 {
+				log.Printf("Audit sink failing, retrying: %s", err.Error())
+			}
+			// Once closing, a failing sink only gets one try per line.
+			if atomic.LoadInt32(&w.closed) == 1 {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+	}
+}
+
+func (w *worker) full() bool {
+	return len(w.queue) == cap(w.queue)
+}
+
+func (w *worker) failing() bool {
+	return atomic.LoadInt32(&w.failed) == 1
+}
+
+func (w *worker) close() error {
+	atomic.StoreInt32(&w.closed, 1)
+	close(w.queue)
+	<-w.done
+	return w.sink.Close()
+}
@@ -0,0 +1,151 @@
+package authn
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrUnknownUser     = errors.New("unknown user")
+	ErrBadPassword     = errors.New("wrong password")
+	ErrBadSecondFactor = errors.New("wrong second factor")
+	ErrReusedCode      = errors.New("one time code already used")
+)
+
+// ProxyAccount is a user entry of the proxy password store. An entry can be
+// written as a bare password string or as an object with extra settings.
+type ProxyAccount struct {
+	Password   string `json:"password"`
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// CIDR blocks or addresses the user may connect from, like the host
+	// part of a MySQL account. Empty means anywhere.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+
+	Disabled bool `json:"disabled,omitempty"`
+	// Dates ("2026-12-31", valid through that day) or RFC 3339 timestamps.
+	ExpiresAt         string         `json:"expires_at,omitempty"`
+	PasswordExpiresAt string         `json:"password_expires_at,omitempty"`
+	AccessWindows     []AccessWindow `json:"access_windows,omitempty"`
+
+	// false keeps the user's reads on the primary, which otherwise go to
+	// the replicas outside transactions, when there are.
+	ReadReplicas *bool `json:"read_replicas,omitempty"`
+}
+
+type proxyAccountFields ProxyAccount
+
+func (r *ProxyAccount) UnmarshalJSON(data []byte) error {
+	password := ""
+	if json.Unmarshal(data, &password) == nil {
+		*r = ProxyAccount{Password: password}
+		return nil
+	}
+	fields := proxyAccountFields{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	*r = ProxyAccount(fields)
+	return nil
+}
+
+// MarshalJSON keeps password-only entries in the short string form.
+func (r ProxyAccount) MarshalJSON() ([]byte, error) {
+	full, err := json.Marshal(proxyAccountFields(r))
+	if err != nil {
+		return nil, err
+	}
+	short, err := json.Marshal(proxyAccountFields{Password: r.Password})
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(full, short) {
+		return json.Marshal(r.Password)
+	}
+	return full, nil
+}
+
+type proxyAccounts struct {
+	Accounts map[string]*ProxyAccount `json:"accounts"`
+}
+
+func readProxyAccounts(configfile string) (*proxyAccounts, error) {
+	file, err := os.ReadFile(configfile)
+	if err != nil {
+		return nil, err
+	}
+	buf := &proxyAccounts{}
+	err = json.Unmarshal(file, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf.Accounts == nil {
+		buf.Accounts = map[string]*ProxyAccount{}
+	}
+	return buf, nil
+}
+
+// ReadProxyAccount returns the entry for username, or nil if there is none.
+func ReadProxyAccount(configfile, username string) (*ProxyAccount, error) {
+	buf, err := readProxyAccounts(configfile)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Accounts[username], nil
+}
+
+// ReadProxyAccounts returns every entry of the store by user name.
+func ReadProxyAccounts(configfile string) (map[string]*ProxyAccount, error) {
+	buf, err := readProxyAccounts(configfile)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Accounts, nil
+}
+
+func ReadProxyPassword(configfile, username string) (string, error) {
+	account, err := ReadProxyAccount(configfile, username)
+	if err != nil || account == nil {
+		return "", err
+	}
+	return account.Password, nil
+}
+
+// storeMutex serializes the changes the process makes to the store.
+var storeMutex sync.Mutex
+
+// WriteProxyAccount adds or replaces the entry for username, keeping the
+// rest of the store as it is. The new store replaces the old one at once,
+// so that logins never read a partly written file.
+func WriteProxyAccount(configfile, username string, account *ProxyAccount) error {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	buf, err := readProxyAccounts(configfile)
+	if err != nil {
+		return err
+	}
+	buf.Accounts[username] = account
+	dat, err := json.MarshalIndent(buf, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configfile), filepath.Base(configfile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(dat, '\n'))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configfile)
+}
@@ -0,0 +1,32 @@
+package authn
+
+import "crypto/x509"
+
+// CertIdentity maps a verified client certificate to a proxy user. URI SANs
+// (SPIFFE ids) are checked first, then DNS and email SANs, then the subject CN.
+func CertIdentity(cert *x509.Certificate, identities map[string]string) (string, bool) {
+	if cert == nil {
+		return "", false
+	}
+	for _, uri := range cert.URIs {
+		if user, ok := identities["uri:"+uri.String()]; ok {
+			return user, true
+		}
+	}
+	for _, name := range cert.DNSNames {
+		if user, ok := identities["dns:"+name]; ok {
+			return user, true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if user, ok := identities["email:"+email]; ok {
+			return user, true
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		if user, ok := identities["cn:"+cert.Subject.CommonName]; ok {
+			return user, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,58 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// ParseHosts parses a list of CIDR blocks or single IP addresses.
+func ParseHosts(hosts []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, host := range hosts {
+		if !strings.Contains(host, "/") {
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid host %q", host)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func MatchHosts(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostAllowed reports whether the account may connect from ip. Accounts
+// without allowed_hosts may connect from anywhere.
+func (r *ProxyAccount) HostAllowed(ip net.IP) (bool, error) {
+	if len(r.AllowedHosts) == 0 {
+		return true, nil
+	}
+	nets, err := ParseHosts(r.AllowedHosts)
+	if err != nil {
+		return false, err
+	}
+	return MatchHosts(nets, ip), nil
+}
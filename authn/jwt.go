@@ -0,0 +1,326 @@
+package authn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"strings"
+	"time"
+)
+
+// TokenIdentity is the proxy identity carried by a verified bearer token.
+type TokenIdentity struct {
+	User   string
+	Groups []string
+}
+
+// JWTVerifier checks bearer tokens against a local JWKS file and/or a shared
+// HMAC secret. Remote key discovery is deliberately not supported.
+type JWTVerifier struct {
+	keys         map[string]crypto.PublicKey
+	hmac_secret  []byte
+	issuer       string
+	audience     string
+	user_claim   string
+	groups_claim string
+	leeway       time.Duration
+}
+
+func NewJWTVerifier(cfg *config.JWTConfig) (*JWTVerifier, error) {
+	r := &JWTVerifier{
+		keys:         map[string]crypto.PublicKey{},
+		hmac_secret:  []byte(cfg.HMACSecret),
+		issuer:       cfg.Issuer,
+		audience:     cfg.Audience,
+		user_claim:   cfg.UserClaim,
+		groups_claim: cfg.GroupsClaim,
+		leeway:       time.Duration(cfg.LeewaySeconds) * time.Second,
+	}
+	// Tokens the same issuer made for other services must not log in.
+	if r.issuer == "" || r.audience == "" {
+		return nil, errors.New("jwt: issuer and audience must be configured")
+	}
+	if r.user_claim == "" {
+		r.user_claim = "sub"
+	}
+	if r.groups_claim == "" {
+		r.groups_claim = "groups"
+	}
+	if cfg.JWKSFile != "" {
+		dat, err := os.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		err = r.loadJWKS(dat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(r.keys) == 0 && len(r.hmac_secret) == 0 {
+		return nil, errors.New("jwt: neither jwks_file nor hmac_secret is configured")
+	}
+	return r, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (r *JWTVerifier) loadJWKS(dat []byte) error {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	err := json.Unmarshal(dat, &jwks)
+	if err != nil {
+		return err
+	}
+	for i, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return fmt.Errorf("jwks key %d (%s): %s", i, jwk.Kid, err.Error())
+		}
+		r.keys[jwk.Kid] = key
+	}
+	return nil
+}
+
+func (r jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch r.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(r.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(r.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch r.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", r.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(r.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(r.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if r.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", r.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(r.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key length")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", r.Kty)
+	}
+}
+
+// Verify checks the token signature, issuer, audience and validity period
+// and extracts the proxy identity from its claims.
+func (r *JWTVerifier) Verify(token string, now time.Time) (*TokenIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("jwt: malformed signature")
+	}
+	err = r.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+	return r.checkClaims(claims, now)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	dat, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("jwt: malformed segment")
+	}
+	return json.Unmarshal(dat, v)
+}
+
+func (r *JWTVerifier) verifySignature(alg, kid string, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "HS256", "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "HS384", "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "HS512", "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("jwt: unsupported alg %q", alg)
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		if len(r.hmac_secret) == 0 {
+			return errors.New("jwt: HMAC tokens are not accepted")
+		}
+		mac := hmac.New(hash.New, r.hmac_secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("jwt: bad signature")
+		}
+		return nil
+	}
+
+	candidates := []crypto.PublicKey{}
+	if key, ok := r.keys[kid]; ok {
+		candidates = append(candidates, key)
+	} else if kid == "" {
+		for _, key := range r.keys {
+			candidates = append(candidates, key)
+		}
+	}
+	for _, key := range candidates {
+		if verifyWithKey(alg, hash, key, signed, signature) {
+			return nil
+		}
+	}
+	return errors.New("jwt: bad signature")
+}
+
+func verifyWithKey(alg string, hash crypto.Hash, key crypto.PublicKey, signed, signature []byte) bool {
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(pub, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		sig_r := new(big.Int).SetBytes(signature[:size])
+		sig_s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, sig_r, sig_s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(pub, signed, signature)
+	}
+	return false
+}
+
+func (r *JWTVerifier) checkClaims(claims map[string]interface{}, now time.Time) (*TokenIdentity, error) {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("jwt: missing exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(r.leeway)) {
+		return nil, errors.New("jwt: token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(r.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt: token not valid yet")
+	}
+	if claims["iss"] != r.issuer {
+		return nil, fmt.Errorf("jwt: unexpected issuer %v", claims["iss"])
+	}
+	if !hasAudience(claims["aud"], r.audience) {
+		return nil, fmt.Errorf("jwt: token not issued for audience %s", r.audience)
+	}
+
+	user, ok := claims[r.user_claim].(string)
+	if !ok || user == "" {
+		return nil, fmt.Errorf("jwt: missing %s claim", r.user_claim)
+	}
+	identity := &TokenIdentity{User: user}
+	switch groups := claims[r.groups_claim].(type) {
+	case string:
+		identity.Groups = strings.Fields(groups)
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	return identity, nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package authn
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var jwtNow = time.Unix(1700000000, 0)
+
+// testJWTKey returns an RSA key and a JWKS file holding its public half as
+// kid "test".
+func testJWTKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []jsonWebKey{{
+		Kty: "RSA",
+		Kid: "test",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(path, jwks, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, path
+}
+
+func testClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    "https://idp.example.com",
+		"aud":    "sqlproxy",
+		"sub":    "alice",
+		"exp":    jwtNow.Add(time.Hour).Unix(),
+		"groups": []string{"dba", "ops"},
+	}
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+// signJWT builds a token of header and claims, signed by sign.
+func signJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+func signHS256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	key, jwks_file := testJWTKey(t)
+	verifier, err := NewJWTVerifier(&config.JWTConfig{
+		JWKSFile:      jwks_file,
+		HMACSecret:    "shared secret",
+		Issuer:        "https://idp.example.com",
+		Audience:      "sqlproxy",
+		LeewaySeconds: 60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "test"}
+	hs256 := map[string]interface{}{"alg": "HS256"}
+	claims := func(change func(claims map[string]interface{})) map[string]interface{} {
+		claims := testClaims()
+		change(claims)
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		// start of the error, empty if the token is good
+		err string
+	}{
+		{
+			name:  "RS256",
+			token: signJWT(t, rs256, testClaims(), signRS256(t, key)),
+		},
+		{
+			name:  "HS256",
+			token: signJWT(t, hs256, testClaims(), signHS256([]byte("shared secret"))),
+		},
+		{
+			name:  "RS256 without kid",
+			token: signJWT(t, map[string]interface{}{"alg": "RS256"}, testClaims(), signRS256(t, key)),
+		},
+		{
+			name: "audience in a list",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"other", "sqlproxy"}
+			}), signRS256(t, key)),
+		},
+		{
+			name: "expired within the leeway",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				c["exp"] = jwtNow.Add(-30 * time.Second).Unix()
+			}), signRS256(t, key)),
+		},
+		{
+			name: "bad signature",
+			token: signJWT(t, rs256, testClaims(), func(signed []byte) []byte {
+				signature := signRS256(t, key)(signed)
+				signature[0] ^= 1
+				return signature
+			}),
+			err: "jwt: bad signature",
+		},
+		{
+			name: "claims changed after signing",
+			token: func() string {
+				parts := strings.Split(signJWT(t, rs256, testClaims(), signRS256(t, key)), ".")
+				parts[1] = encodeSegment(t, claims(func(c map[string]interface{}) { c["sub"] = "root" }))
+				return strings.Join(parts, ".")
+			}(),
+			err: "jwt: bad signature",
+		},
+		{
+			name:  "HS256 with another secret",
+			token: signJWT(t, hs256, testClaims(), signHS256([]byte("guessed"))),
+			err:   "jwt: bad signature",
+		},
+		{
+			name:  "HS256 keyed with the RSA public key",
+			token: signJWT(t, hs256, testClaims(), signHS256(key.N.Bytes())),
+			err:   "jwt: bad signature",
+		},
+		{
+			name:  "RS256 with an unknown kid",
+			token: signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "other"}, testClaims(), signRS256(t, key)),
+			err:   "jwt: bad signature",
+		},
+		{
+			name:  "alg none",
+			token: signJWT(t, map[string]interface{}{"alg": "none"}, testClaims(), func([]byte) []byte { return nil }),
+			err:   `jwt: unsupported alg "none"`,
+		},
+		{
+			name: "expired",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				c["exp"] = jwtNow.Add(-2 * time.Minute).Unix()
+			}), signRS256(t, key)),
+			err: "jwt: token expired",
+		},
+		{
+			name: "no exp",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				delete(c, "exp")
+			}), signRS256(t, key)),
+			err: "jwt: missing exp claim",
+		},
+		{
+			name: "not valid yet",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				c["nbf"] = jwtNow.Add(2 * time.Minute).Unix()
+			}), signRS256(t, key)),
+			err: "jwt: token not valid yet",
+		},
+		{
+			name: "wrong issuer",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				c["iss"] = "https://evil.example.com"
+			}), signRS256(t, key)),
+			err: "jwt: unexpected issuer",
+		},
+		{
+			name: "wrong audience",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"other"}
+			}), signRS256(t, key)),
+			err: "jwt: token not issued for audience",
+		},
+		{
+			name: "no user",
+			token: signJWT(t, rs256, claims(func(c map[string]interface{}) {
+				delete(c, "sub")
+			}), signRS256(t, key)),
+			err: "jwt: missing sub claim",
+		},
+		{
+			name:  "malformed",
+			token: "a.b",
+			err:   "jwt: malformed token",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := verifier.Verify(test.token, jwtNow)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.User != "alice" || strings.Join(identity.Groups, ",") != "dba,ops" {
+				t.Fatalf("identity: %+v", identity)
+			}
+		})
+	}
+}
+
+func TestJWTWithoutHMACSecret(t *testing.T) {
+	key, jwks_file := testJWTKey(t)
+	verifier, err := NewJWTVerifier(&config.JWTConfig{
+		JWKSFile: jwks_file,
+		Issuer:   "https://idp.example.com",
+		Audience: "sqlproxy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The public key is no HMAC secret, whatever the header says.
+	token := signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "test"}, testClaims(), signHS256(key.N.Bytes()))
+	_, err = verifier.Verify(token, jwtNow)
+	if err == nil || err.Error() != "jwt: HMAC tokens are not accepted" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestJWTNeedsIssuerAndAudience(t *testing.T) {
+	for _, cfg := range []*config.JWTConfig{
+		{HMACSecret: "secret", Audience: "sqlproxy"},
+		{HMACSecret: "secret", Issuer: "https://idp.example.com"},
+		{Issuer: "https://idp.example.com", Audience: "sqlproxy"},
+	} {
+		if _, err := NewJWTVerifier(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
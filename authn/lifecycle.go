@@ -0,0 +1,183 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAccountDisabled     = errors.New("account disabled")
+	ErrAccountExpired      = errors.New("account expired")
+	ErrPasswordExpired     = errors.New("password expired")
+	ErrOutsideAccessWindow = errors.New("outside access window")
+)
+
+// AccessWindow is a daily span of local time during which a user may be
+// connected. End may be earlier than Start for windows across midnight.
+type AccessWindow struct {
+	Days  []string `json:"days,omitempty"` // "mon".."sun", empty means every day
+	Start string   `json:"start"`          // "08:00"
+	End   string   `json:"end"`            // "18:00", "24:00" for end of day
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseAccountTime accepts a plain date ("2026-12-31", meaning the end of
+// that day) or an RFC 3339 timestamp.
+func parseAccountTime(value string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func parseClock(value string) (time.Duration, error) {
+	var hours, minutes int
+	_, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes)
+	if err != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || hours == 24 && minutes != 0 {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// span returns the occurrence of the window that contains t, if any.
+func (r AccessWindow) span(t time.Time) (time.Time, time.Time, bool, error) {
+	start, err := parseClock(r.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	end, err := parseClock(r.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	length := end - start
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+
+	// An occurrence that contains t started today or, across midnight,
+	// yesterday.
+	for offset := 0; offset >= -1; offset-- {
+		day := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, t.Location())
+		if !r.onDay(day.Weekday()) {
+			continue
+		}
+		from := day.Add(start)
+		to := from.Add(length)
+		if !t.Before(from) && t.Before(to) {
+			return from, to, true, nil
+		}
+	}
+	return time.Time{}, time.Time{}, false, nil
+}
+
+func (r AccessWindow) onDay(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, name := range r.Days {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// windowEnd returns when the access windows containing t close, following
+// windows that open right as the previous one closes; the zero time if they
+// never do. It returns false if t is outside every window.
+func (r *ProxyAccount) windowEnd(t time.Time) (time.Time, bool, error) {
+	end := t
+	inside := false
+	for i := 0; i < 8*len(r.AccessWindows); i++ {
+		extended := false
+		for _, window := range r.AccessWindows {
+			_, to, ok, err := window.span(end)
+			if err != nil {
+				return time.Time{}, false, err
+			}
+			if ok && to.After(end) {
+				end = to
+				inside = true
+				extended = true
+			}
+		}
+		if !extended {
+			return end, inside, nil
+		}
+	}
+	// Still extending after more than a week: the windows cover all time.
+	return time.Time{}, inside, nil
+}
+
+// CheckActive reports why the account may not log in at now, if it may not.
+func (r *ProxyAccount) CheckActive(now time.Time) error {
+	if r.Disabled {
+		return ErrAccountDisabled
+	}
+	if r.ExpiresAt != "" {
+		expires, err := parseAccountTime(r.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if !now.Before(expires) {
+			return ErrAccountExpired
+		}
+	}
+	if len(r.AccessWindows) > 0 {
+		_, inside, err := r.windowEnd(now)
+		if err != nil {
+			return err
+		}
+		if !inside {
+			return ErrOutsideAccessWindow
+		}
+	}
+	return nil
+}
+
+func (r *ProxyAccount) PasswordExpired(now time.Time) (bool, error) {
+	if r.PasswordExpiresAt == "" {
+		return false, nil
+	}
+	expires, err := parseAccountTime(r.PasswordExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	return !now.Before(expires), nil
+}
+
+// SessionDeadline returns when a session that is active at now has to end,
+// because its access window closes or the account expires. It returns the
+// zero time if the session may last indefinitely.
+func (r *ProxyAccount) SessionDeadline(now time.Time) (time.Time, error) {
+	deadline := time.Time{}
+	if r.ExpiresAt != "" {
+		expires, err := parseAccountTime(r.ExpiresAt)
+		if err != nil {
+			return time.Time{}, err
+		}
+		deadline = expires
+	}
+	if len(r.AccessWindows) > 0 {
+		end, inside, err := r.windowEnd(now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if inside && !end.IsZero() && (deadline.IsZero() || end.Before(deadline)) {
+			deadline = end
+		}
+	}
+	return deadline, nil
+}
@@ -2,8 +2,6 @@ package authn
 
 import (
 	"crypto/sha1"
-	"encoding/json"
-	"os"
 )
 
 func xor(a, b []byte) []byte {
@@ -17,7 +15,7 @@ func xor(a, b []byte) []byte {
 	return c
 }
 
-//SHA1( password ) XOR SHA1( "20-bytes random data from server" <concat> SHA1( SHA1( password ) ) )
+// SHA1( password ) XOR SHA1( "20-bytes random data from server" <concat> SHA1( SHA1( password ) ) )
 func HashNativePassword(password string, random []byte) []byte {
 	hashed_password := sha1.Sum([]byte(password))
 	// fmt.Printf("hashed_password: %x\n", hashed_password)
@@ -33,13 +31,3 @@ func HashNativePassword(password string, random []byte) []byte {
 
 	return xored
 }
-
-func ReadProxyPassword(configfile, username string) (string, error) {
-	file, err := os.ReadFile(configfile)
-	if err != nil {
-		return "", err
-	}
-	buf := map[string]map[string]string{}
-	json.Unmarshal(file, &buf)
-	return string(buf["accounts"][username]), nil
-}
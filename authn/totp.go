@@ -0,0 +1,115 @@
+package authn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP parameters (RFC 6238): HMAC-SHA1, 30 second steps, 6 digits.
+const (
+	TOTPDigits = 6
+	totpStep   = 30 * time.Second
+	// accepted clock drift, in steps, either way
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps enroll from.
+func TOTPURI(issuer, username, secret string) string {
+	label := url.PathEscape(issuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpKey(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, totpCounter(t)), nil
+}
+
+func totpKey(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(totpStep/time.Second)
+}
+
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, code%1000000)
+}
+
+// VerifyTOTP checks code against the secret, allowing for a little clock
+// drift, and returns the time step it belongs to.
+func VerifyTOTP(secret, code string, now time.Time) (uint64, bool) {
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	key, err := totpKey(secret)
+	if err != nil {
+		return 0, false
+	}
+	counter := totpCounter(now)
+	for step := -totpSkew; step <= totpSkew; step++ {
+		expected := hotp(key, counter+uint64(step))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + uint64(step), true
+		}
+	}
+	return 0, false
+}
+
+// TOTPSteps remembers the last time step accepted for each user, so that a
+// code is used once.
+type TOTPSteps struct {
+	mutex sync.Mutex
+	last  map[string]uint64
+}
+
+func NewTOTPSteps() *TOTPSteps {
+	return &TOTPSteps{last: map[string]uint64{}}
+}
+
+// Accept records step for user, unless a code of the same or a later time
+// step has been accepted already.
+func (r *TOTPSteps) Accept(user string, step uint64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	last, ok := r.last[user]
+	if ok && step <= last {
+		return false
+	}
+	r.last[user] = step
+	return true
+}
@@ -0,0 +1,104 @@
+package authn
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 4226 and RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	codes := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	key, err := totpKey(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for counter, code := range codes {
+		if got := hotp(key, uint64(counter)); got != code {
+			t.Errorf("counter %d: got %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut to six digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		now := time.Unix(test.unix, 0)
+		code, err := TOTPCode(rfcSecret, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.code {
+			t.Errorf("%d: got %s, want %s", test.unix, code, test.code)
+		}
+		step, ok := VerifyTOTP(rfcSecret, test.code, now)
+		if !ok || step != uint64(test.unix/30) {
+			t.Errorf("%d: %s not verified, step %d", test.unix, test.code, step)
+		}
+	}
+}
+
+func TestVerifyTOTPDrift(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	for _, test := range []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		{-60 * time.Second, false},
+		{-30 * time.Second, true},
+		{30 * time.Second, true},
+		{60 * time.Second, false},
+	} {
+		code, err := TOTPCode(rfcSecret, now.Add(test.offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := VerifyTOTP(rfcSecret, code, now); ok != test.ok {
+			t.Errorf("code from %v away: verified %v", test.offset, ok)
+		}
+	}
+	for _, code := range []string{"", "05047", "0504711", "abcdef"} {
+		if _, ok := VerifyTOTP(rfcSecret, code, now); ok {
+			t.Errorf("%q verified", code)
+		}
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	steps := NewTOTPSteps()
+	now := time.Unix(1111111111, 0)
+	step, ok := VerifyTOTP(rfcSecret, "050471", now)
+	if !ok {
+		t.Fatal("code not verified")
+	}
+	if !steps.Accept("alice", step) {
+		t.Fatal("first use refused")
+	}
+	if steps.Accept("alice", step) {
+		t.Fatal("second use of the code accepted")
+	}
+	// An earlier code still within the drift is spent too.
+	if steps.Accept("alice", step-1) {
+		t.Fatal("code of an earlier step accepted")
+	}
+	if !steps.Accept("alice", step+1) {
+		t.Fatal("code of the next step refused")
+	}
+	if !steps.Accept("bob", step) {
+		t.Fatal("code refused for another user")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"o2buzzle/sqlproxy/audit"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/config"
+	"os"
+)
+
+const usage = `usage:
+  sqlproxy                           run the proxy
+  sqlproxy user enroll-totp NAME     enroll NAME in TOTP and print its secret
+  sqlproxy user remove-totp NAME     turn TOTP off for NAME
+  sqlproxy verify-audit [-key PEM] [FILE...]
+                                     check the hash chain and checkpoint
+                                     signatures of the audit log
+`
+
+func runCommand(cfg *config.Config, args []string) int {
+	switch args[0] {
+	case "user":
+		return userCommand(cfg, args[1:])
+	case "verify-audit":
+		return verifyAuditCommand(cfg, args[1:])
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return 2
+}
+
+func userCommand(cfg *config.Config, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	name := args[1]
+	account, err := authn.ReadProxyAccount(cfg.AccountsFile, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if account == nil {
+		fmt.Fprintf(os.Stderr, "no such user: %s\n", name)
+		return 1
+	}
+
+	switch args[0] {
+	case "enroll-totp":
+		secret, err := authn.GenerateTOTPSecret()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		account.TOTPSecret = secret
+		err = authn.WriteProxyAccount(cfg.AccountsFile, name, account)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("secret: %s\n", secret)
+		fmt.Printf("uri:    %s\n", authn.TOTPURI("sqlproxy", name, secret))
+		fmt.Println("Log in over TLS with mysql_clear_password, sending the password followed by the current code.")
+	case "remove-totp":
+		account.TOTPSecret = ""
+		err = authn.WriteProxyAccount(cfg.AccountsFile, name, account)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	return 0
+}
+
+// verifyAuditCommand checks the audit files given, or the configured one,
+// along with the files rotated out of them. It exits 1 when the chain is
+// broken.
+func verifyAuditCommand(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("verify-audit", flag.ContinueOnError)
+	key_file := flags.String("key", "", "Ed25519 public or private key, PEM")
+	if flags.Parse(args) != nil {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 && cfg.Audit != nil && cfg.Audit.File != "" {
+		paths = []string{cfg.Audit.File}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "no audit file configured or given")
+		return 2
+	}
+	if *key_file == "" && cfg.Audit != nil && cfg.Audit.Chain != nil {
+		*key_file = cfg.Audit.Chain.PublicKeyFile
+		if *key_file == "" {
+			*key_file = cfg.Audit.Chain.SigningKeyFile
+		}
+	}
+	if *key_file == "" {
+		fmt.Fprintln(os.Stderr, "no key configured or given")
+		return 2
+	}
+	key, err := audit.LoadPublicKey(*key_file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	files, err := auditFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	result, err := audit.Verify(files, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%d records, %d checkpoints\n", result.Records, result.Checkpoints)
+	if !result.Intact() {
+		fmt.Printf("BROKEN at %s:%d: %s\n", result.File, result.Line, result.Problem)
+		return 1
+	}
+	if result.SignedSeq < result.LastSeq {
+		fmt.Printf("warning: records %d to %d are not covered by a checkpoint yet\n", result.SignedSeq+1, result.LastSeq)
+	}
+	fmt.Println("chain intact")
+	return 0
+}
+
+// auditFiles expands each audit file into the files rotated out of it,
+// oldest first, followed by the file itself when it exists.
+func auditFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		rotated, err := audit.RotatedFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rotated...)
+		if _, err := os.Stat(path); err == nil || len(rotated) == 0 {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,262 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+)
+
+type Config struct {
+	ProxyUser    string         `json:"proxy_user"`
+	ProxyPass    string         `json:"proxy_pass"`
+	AccountsFile string         `json:"accounts_file"`
+	TLS          *TLSConfig     `json:"tls,omitempty"`
+	JWT          *JWTConfig     `json:"jwt,omitempty"`
+	Lockout      *LockoutConfig `json:"lockout,omitempty"`
+	// Client CIDR blocks or addresses refused as soon as they connect.
+	DenyHosts []string       `json:"deny_hosts,omitempty"`
+	Tagging   *TaggingConfig `json:"tagging,omitempty"`
+	Audit     *AuditConfig   `json:"audit,omitempty"`
+	SlowLog   *SlowLogConfig `json:"slow_log,omitempty"`
+	Metrics   *MetricsConfig `json:"metrics,omitempty"`
+	StatsD    *StatsDConfig  `json:"statsd,omitempty"`
+	Admin     *AdminConfig   `json:"admin,omitempty"`
+	Pool      *PoolConfig    `json:"pool,omitempty"`
+	// MySQL servers to use in place of the one the proxy was started with
+	Backends *BackendsConfig `json:"backends,omitempty"`
+}
+
+// TLSConfig enables TLS towards clients. When ClientCAFile is set, client
+// certificates signed by that CA are verified and can be used as an identity
+// in place of a password through CertIdentities.
+type TLSConfig struct {
+	CertFile          string `json:"cert_file"`
+	KeyFile           string `json:"key_file"`
+	ClientCAFile      string `json:"client_ca_file"`
+	RequireClientCert bool   `json:"require_client_cert"`
+	// Keys are "cn:<common name>", "dns:<name>", "email:<address>" or
+	// "uri:<uri>" (e.g. a SPIFFE id), values are proxy user names.
+	CertIdentities map[string]string `json:"cert_identities"`
+	// When set, a non-empty user name sent by a certificate authenticated
+	// client must match the identity mapped from its certificate.
+	CheckUsername bool `json:"check_username"`
+}
+
+// JWTConfig lets clients log in with a bearer token sent through the
+// mysql_clear_password plugin. Tokens are only accepted over TLS, and
+// must carry the issuer, the audience and an expiry.
+type JWTConfig struct {
+	JWKSFile      string `json:"jwks_file"`
+	HMACSecret    string `json:"hmac_secret"`
+	Issuer        string `json:"issuer"`       // required
+	Audience      string `json:"audience"`     // required
+	UserClaim     string `json:"user_claim"`   // defaults to "sub"
+	GroupsClaim   string `json:"groups_claim"` // defaults to "groups"
+	LeewaySeconds int    `json:"leeway_seconds"`
+}
+
+// LockoutConfig throttles failed logins per user name and per client IP.
+// Zero values fall back to the defaults noted below.
+type LockoutConfig struct {
+	Disabled       bool `json:"disabled"`
+	MaxFailures    int  `json:"max_failures"`    // 5
+	LockoutSeconds int  `json:"lockout_seconds"` // 900
+	BackoffMillis  int  `json:"backoff_ms"`      // 500, doubled per failure
+	MaxBackoffMs   int  `json:"max_backoff_ms"`  // 8000
+}
+
+// TaggingConfig controls the comment that marks each query with the client
+// behind it. Template may use {user}, {conn_id}, {client_ip}, {trace_id} and
+// {app_name}; trace_id comes from a trace_id or traceparent key in the
+// query's own comments, or else the trace_id connection attribute, and
+// app_name from the program_name connection attribute.
+type TaggingConfig struct {
+	// "comment" (default) tags the SQL text. "query_attributes" sends the
+	// same fields as query attributes named proxy_user, proxy_conn_id, ...
+	// instead, to clients that negotiated CLIENT_QUERY_ATTRIBUTES, dropping
+	// proxy_ attributes of the client's own; others still get the comment.
+	// "session_variables" leaves queries alone and sets @proxy_user and
+	// @proxy_client once per backend session. The client can set them to
+	// anything afterwards, so they are not to be trusted for auditing.
+	Mode     string `json:"mode"`
+	Template string `json:"template"` // "user: {user}"
+	// "leading" (default) or "trailing"
+	Position string `json:"position"`
+	// What to do with values that cannot safely go into a comment:
+	// "sanitize" (default) replaces the characters at fault, "reject" fails
+	// the query.
+	Unsafe string `json:"unsafe"`
+}
+
+// AuditConfig enables the audit log: a JSON line per query and per
+// authentication event, sent to each of the configured sinks.
+type AuditConfig struct {
+	File     string               `json:"file"`
+	Rotation *AuditRotationConfig `json:"rotation,omitempty"` // for File
+	Syslog   *AuditSyslogConfig   `json:"syslog,omitempty"`
+	Webhook  *AuditWebhookConfig  `json:"webhook,omitempty"`
+	Chain    *AuditChainConfig    `json:"chain,omitempty"`
+	// Replace string and number literals in logged SQL with ?.
+	RedactLiterals bool `json:"redact_literals"`
+	// Records waiting for each sink; 10000 by default.
+	QueueSize int `json:"queue_size"`
+	// What to do when a sink's queue is full because it is slow or down:
+	// "block" (default) waits, "drop" discards the record and counts it,
+	// "refuse" discards it and refuses new queries until the sink recovers.
+	FullPolicy string `json:"full_policy"`
+}
+
+// AuditChainConfig makes the audit log tamper evident. Each record carries
+// its sequence number and the hash of the record before it, and checkpoints
+// signed with an Ed25519 key are added every CheckpointRecords records or
+// CheckpointSeconds seconds. It needs the "block" full policy, as a dropped
+// record would show up as a break in the chain, and the audit file, which
+// the chain goes on from after a restart.
+type AuditChainConfig struct {
+	SigningKeyFile string `json:"signing_key_file"` // PKCS#8 PEM
+	// Public key for verify-audit where the signing key is not available,
+	// PKIX PEM.
+	PublicKeyFile     string `json:"public_key_file"`
+	CheckpointRecords int    `json:"checkpoint_records"` // 1000
+	CheckpointSeconds int    `json:"checkpoint_seconds"` // 300
+}
+
+// SlowLogConfig enables the slow query log: commands that take longer than
+// the threshold, from the client's command to the end of MySQL's response,
+// are written to File in the MySQL slow log format.
+type SlowLogConfig struct {
+	File string `json:"file"`
+	// 1000 when unset, 0 logs every command
+	ThresholdMs *int `json:"threshold_ms"`
+	// Thresholds of individual proxy users, overriding ThresholdMs. 0 logs
+	// every command of that user.
+	UserThresholdMs map[string]int       `json:"user_threshold_ms,omitempty"`
+	Rotation        *AuditRotationConfig `json:"rotation,omitempty"`
+}
+
+// MetricsConfig serves Prometheus metrics over HTTP at /metrics.
+type MetricsConfig struct {
+	Listen string `json:"listen"` // e.g. "127.0.0.1:9104"
+}
+
+// StatsDConfig sends the same metrics to a DogStatsD agent over UDP, with
+// their labels and a backend tag as tags.
+type StatsDConfig struct {
+	Address       string   `json:"address"` // "127.0.0.1:8125"
+	Prefix        string   `json:"prefix"`
+	Tags          []string `json:"tags,omitempty"`  // e.g. "env:prod"
+	FlushMillis   int      `json:"flush_ms"`        // 10000
+	MaxPacketSize int      `json:"max_packet_size"` // 1432
+}
+
+// AdminConfig enables the admin HTTP API, the MySQL protocol admin
+// listener or both. Every HTTP request must carry
+// "Authorization: Bearer <token>".
+type AdminConfig struct {
+	Listen string `json:"listen"` // e.g. "127.0.0.1:9105", empty for no HTTP API
+	Token  string `json:"token"`
+	// serve over TLS when set
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	MySQL *AdminMySQLConfig `json:"mysql,omitempty"`
+}
+
+// AdminMySQLConfig enables a listener that speaks the MySQL protocol and
+// answers SHOW PROXY SESSIONS and the other admin statements, for use
+// with the mysql client.
+type AdminMySQLConfig struct {
+	Listen   string `json:"listen"` // e.g. "127.0.0.1:6032"
+	User     string `json:"user"`   // default "admin"
+	Password string `json:"password"`
+}
+
+// PoolConfig keeps authenticated connections to MySQL open and hands them
+// from one client session to the next, reset with COM_RESET_CONNECTION.
+// Clients then get the proxy's own greeting, and pooled connections carry
+// the proxy's connection attributes rather than the client's.
+type PoolConfig struct {
+	MinIdle int `json:"min_idle"`
+	MaxOpen int `json:"max_open"` // 100, counting idle and in use
+	// 0 keeps connections as long as they work
+	MaxLifetimeSeconds int `json:"max_lifetime_s"`
+	IdleTimeoutSeconds int `json:"idle_timeout_s"` // 300
+	// how long a client waits for a connection when MaxOpen are in use
+	WaitMillis int `json:"wait_ms"` // 5000
+	// Hand connections back between transactions rather than at the end of
+	// the session. Sessions that leave state behind in MySQL, such as user
+	// variables, temporary tables or prepared statements, keep theirs.
+	Multiplex bool `json:"multiplex"`
+}
+
+// BackendsConfig names the primary MySQL server and its replicas, as
+// "host:port". Reads outside transactions go to the replicas, in turn;
+// everything else goes to the primary. Replicas need the pool to
+// multiplex. Users with read_replicas false in the accounts file keep
+// their reads on the primary. A "/* route=primary */" comment keeps a read
+// on the primary, and "/* route=replica */" sends one to a replica for any
+// user.
+type BackendsConfig struct {
+	Primary  string   `json:"primary"`
+	Replicas []string `json:"replicas,omitempty"`
+	// Takes over when the primary fails, once it reports read_only off.
+	Standby     string             `json:"standby,omitempty"`
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+}
+
+// HealthCheckConfig tunes the checks run on every backend: connecting and
+// authenticating, SELECT 1, @@read_only and, on replicas, SHOW REPLICA
+// STATUS.
+type HealthCheckConfig struct {
+	IntervalMillis int `json:"interval_ms"` // 2000
+	TimeoutMillis  int `json:"timeout_ms"`  // 1000
+	// failed checks in a row before a backend is down
+	Failures int `json:"failures"` // 3
+	// replicas further behind are taken out of rotation, 0 allows any lag
+	MaxLagSeconds int `json:"max_lag_s"`
+}
+
+// AuditRotationConfig rotates the audit file once it reaches a size or an
+// age, whichever comes first. Zero values disable that trigger.
+type AuditRotationConfig struct {
+	MaxSizeMB int `json:"max_size_mb"`
+	MaxHours  int `json:"max_hours"`
+	// Rotated files kept, 0 keeps all of them.
+	MaxFiles int  `json:"max_files"`
+	Compress bool `json:"compress"` // gzip rotated files
+}
+
+// AuditSyslogConfig sends records as RFC 5424 syslog messages.
+type AuditSyslogConfig struct {
+	Network  string `json:"network"`  // "unixgram" (default) or "udp"
+	Address  string `json:"address"`  // defaults to /dev/log
+	Facility string `json:"facility"` // defaults to "local0"
+	AppName  string `json:"app_name"` // defaults to "sqlproxy"
+}
+
+// AuditWebhookConfig posts records in batches, as JSON lines, to URL.
+// Batches that cannot be delivered after MaxRetries are spooled to SpoolDir
+// and sent again once the webhook is back.
+type AuditWebhookConfig struct {
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers"`
+	BatchSize   int               `json:"batch_size"`  // 100
+	FlushMillis int               `json:"flush_ms"`    // 1000
+	MaxRetries  int               `json:"max_retries"` // 3
+	TimeoutMs   int               `json:"timeout_ms"`  // 10000
+	SpoolDir    string            `json:"spool_dir"`
+}
+
+func ReadConfig(configfile string) (*Config, error) {
+	dat, err := os.ReadFile(configfile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{
+		AccountsFile: "proxyauthn.json",
+	}
+	err = json.Unmarshal(dat, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -2,16 +2,21 @@ package main
 
 import (
 	"log"
-	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/config"
 	"o2buzzle/sqlproxy/proxy"
+	"os"
 )
 
 func main() {
-	authn_data, err := authn.ReadAuthnData("config.json")
+	cfg, err := config.ReadConfig("config.json")
 	if err != nil {
 		log.Fatal(err)
 	}
-	this_proxy := proxy.NewProxy("127.0.0.1", ":3306", authn_data["proxy_user"], authn_data["proxy_pass"])
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+	this_proxy := proxy.NewProxy("127.0.0.1", ":3306", cfg)
+	this_proxy.SetConfigFile("config.json")
 	err = this_proxy.Start("3307")
 	if err != nil {
 		log.Fatal(err)
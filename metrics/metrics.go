@@ -0,0 +1,417 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds metric families in the order they were registered.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	// []Observer called for every histogram observation
+	observers atomic.Value
+}
+
+type family interface {
+	write(w *bufio.Writer)
+	// each calls fn for every counter and gauge value
+	each(fn func(s Sample))
+}
+
+// Observer is told about each value a histogram observes.
+type Observer func(name string, labels, values []string, v float64)
+
+// OnObserve adds fn to the functions called on histogram observations.
+func (r *Registry) OnObserve(fn Observer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	observers, _ := r.observers.Load().([]Observer)
+	r.observers.Store(append(append([]Observer{}, observers...), fn))
+}
+
+func (r *Registry) observe(name string, labels, values []string, v float64) {
+	observers, _ := r.observers.Load().([]Observer)
+	for _, fn := range observers {
+		fn(name, labels, values, v)
+	}
+}
+
+// Each calls fn for the current value of every counter and gauge.
+// Histograms are left out.
+func (r *Registry) Each(fn func(s Sample)) {
+	r.mu.Lock()
+	families := append([]family{}, r.families...)
+	r.mu.Unlock()
+	for _, f := range families {
+		f.each(fn)
+	}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes every family in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family{}, r.families...)
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	b := bufio.NewWriter(counter)
+	for _, f := range families {
+		f.write(b)
+	}
+	err := b.Flush()
+	return counter.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (r *countingWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type Counter struct {
+	value uint64
+}
+
+func (r *Counter) Inc() {
+	atomic.AddUint64(&r.value, 1)
+}
+
+func (r *Counter) Add(n uint64) {
+	atomic.AddUint64(&r.value, n)
+}
+
+func (r *Counter) Value() uint64 {
+	return atomic.LoadUint64(&r.value)
+}
+
+type Gauge struct {
+	value int64
+}
+
+func (r *Gauge) Inc() {
+	atomic.AddInt64(&r.value, 1)
+}
+
+func (r *Gauge) Dec() {
+	atomic.AddInt64(&r.value, -1)
+}
+
+func (r *Gauge) Set(n int64) {
+	atomic.StoreInt64(&r.value, n)
+}
+
+func (r *Gauge) Value() int64 {
+	return atomic.LoadInt64(&r.value)
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+	// tells the registry's observers, when set
+	observed func(v float64)
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (r *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(r.bounds, v)
+	r.mu.Lock()
+	if i < len(r.buckets) {
+		r.buckets[i]++
+	}
+	r.count++
+	r.sum += v
+	r.mu.Unlock()
+	if r.observed != nil {
+		r.observed(v)
+	}
+}
+
+// ExponentialBuckets returns count bucket bounds starting at start, each
+// factor times the one before.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// vec is a family of metrics of one type told apart by label values.
+type vec struct {
+	name     string
+	help     string
+	typ      string
+	labels   []string
+	mu       sync.Mutex
+	children map[string]*child
+	create   func(values []string) interface{}
+}
+
+type child struct {
+	values []string
+	metric interface{}
+}
+
+func newVec(name, help, typ string, labels []string, create func(values []string) interface{}) *vec {
+	return &vec{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		children: map[string]*child{},
+		create:   create,
+	}
+}
+
+func (r *vec) with(values []string) interface{} {
+	if len(values) != len(r.labels) {
+		panic("metrics: " + r.name + " takes " + strconv.Itoa(len(r.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.children[key]
+	if c == nil {
+		values = append([]string{}, values...)
+		c = &child{values: values, metric: r.create(values)}
+		r.children[key] = c
+	}
+	return c.metric
+}
+
+func (r *vec) each(fn func(s Sample)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.children {
+		switch metric := c.metric.(type) {
+		case *Counter:
+			fn(Sample{Name: r.name, Type: r.typ, Labels: r.labels, Values: c.values, Value: float64(metric.Value())})
+		case *Gauge:
+			fn(Sample{Name: r.name, Type: r.typ, Labels: r.labels, Values: c.values, Value: float64(metric.Value())})
+		}
+	}
+}
+
+func (r *vec) write(w *bufio.Writer) {
+	r.mu.Lock()
+	children := make([]*child, 0, len(r.children))
+	for _, c := range r.children {
+		children = append(children, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(children, func(i, j int) bool {
+		return strings.Join(children[i].values, "\xff") < strings.Join(children[j].values, "\xff")
+	})
+
+	writeHeader(w, r.name, r.help, r.typ)
+	for _, c := range children {
+		labels := formatLabels(r.labels, c.values)
+		switch metric := c.metric.(type) {
+		case *Counter:
+			writeSample(w, r.name, labels, float64(metric.Value()))
+		case *Gauge:
+			writeSample(w, r.name, labels, float64(metric.Value()))
+		case *Histogram:
+			metric.write(w, r.name, r.labels, c.values)
+		}
+	}
+}
+
+func (r *Histogram) write(w *bufio.Writer, name string, labels, values []string) {
+	r.mu.Lock()
+	buckets := append([]uint64{}, r.buckets...)
+	count, sum := r.count, r.sum
+	r.mu.Unlock()
+
+	bucket_labels := append(append([]string{}, labels...), "le")
+	cumulative := uint64(0)
+	for i, bound := range r.bounds {
+		cumulative += buckets[i]
+		writeSample(w, name+"_bucket", formatLabels(bucket_labels, append(append([]string{}, values...), formatFloat(bound))), float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", formatLabels(bucket_labels, append(append([]string{}, values...), "+Inf")), float64(count))
+	writeSample(w, name+"_sum", formatLabels(labels, values), sum)
+	writeSample(w, name+"_count", formatLabels(labels, values), float64(count))
+}
+
+type CounterVec struct {
+	vec *vec
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := newVec(name, help, "counter", labels, func([]string) interface{} { return &Counter{} })
+	r.register(v)
+	return &CounterVec{v}
+}
+
+// With returns the counter for the label values, creating it at zero.
+func (r *CounterVec) With(values ...string) *Counter {
+	return r.vec.with(values).(*Counter)
+}
+
+type GaugeVec struct {
+	vec *vec
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := newVec(name, help, "gauge", labels, func([]string) interface{} { return &Gauge{} })
+	r.register(v)
+	return &GaugeVec{v}
+}
+
+func (r *GaugeVec) With(values ...string) *Gauge {
+	return r.vec.with(values).(*Gauge)
+}
+
+type HistogramVec struct {
+	vec *vec
+}
+
+func (r *Registry) NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	v := newVec(name, help, "histogram", labels, func(values []string) interface{} {
+		histogram := newHistogram(bounds)
+		histogram.observed = func(v float64) {
+			r.observe(name, labels, values, v)
+		}
+		return histogram
+	})
+	r.register(v)
+	return &HistogramVec{v}
+}
+
+func (r *HistogramVec) With(values ...string) *Histogram {
+	return r.vec.with(values).(*Histogram)
+}
+
+// Sample is one value of a family. Collector functions only fill in Values
+// and Value.
+type Sample struct {
+	Name   string
+	Type   string
+	Labels []string
+	Values []string
+	Value  float64
+}
+
+// Key names the sample the way it appears in the text format, e.g.
+// sqlproxy_bytes_total{direction="in"}.
+func (r Sample) Key() string {
+	return r.Name + formatLabels(r.Labels, r.Values)
+}
+
+type funcFamily struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	collect func() []Sample
+}
+
+// NewFunc registers a family whose samples are produced by collect each
+// time the metrics are written, for values kept elsewhere. typ is
+// "counter" or "gauge".
+func (r *Registry) NewFunc(name, help, typ string, labels []string, collect func() []Sample) {
+	r.register(&funcFamily{name: name, help: help, typ: typ, labels: labels, collect: collect})
+}
+
+func (r *funcFamily) each(fn func(s Sample)) {
+	for _, sample := range r.collect() {
+		sample.Name, sample.Type, sample.Labels = r.name, r.typ, r.labels
+		fn(sample)
+	}
+}
+
+func (r *funcFamily) write(w *bufio.Writer) {
+	writeHeader(w, r.name, r.help, r.typ)
+	for _, sample := range r.collect() {
+		writeSample(w, r.name, formatLabels(r.labels, sample.Values), sample.Value)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the registry's metrics.
+func Handler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.WriteTo(w)
+	})
+}
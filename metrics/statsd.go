@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTimings bounds the timer values kept between flushes. Beyond it a
+// random sample is kept and sent with its sample rate.
+const maxTimings = 10000
+
+// StatsD sends a registry's metrics to a DogStatsD agent over UDP. Counters
+// are sent as the increase since the last flush, gauges as their value and
+// histogram observations as timers in milliseconds. Labels become tags.
+type StatsD struct {
+	registry    *Registry
+	conn        net.Conn
+	prefix      string
+	tags        []string
+	packet_size int
+	stop        chan struct{}
+	done        chan struct{}
+
+	mu      sync.Mutex
+	timings []string
+	// timer values observed since the last flush, kept or not
+	observed int
+	// counter values sent last, by name and tags
+	last map[string]float64
+}
+
+// NewStatsD starts sending registry's metrics to the agent at address every
+// interval, adding tags to each one.
+func NewStatsD(registry *Registry, address, prefix string, tags []string, interval time.Duration, packet_size int) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	r := &StatsD{
+		registry:    registry,
+		conn:        conn,
+		prefix:      prefix,
+		tags:        tags,
+		packet_size: packet_size,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		last:        map[string]float64{},
+	}
+	registry.OnObserve(r.observe)
+	go r.run(interval)
+	return r, nil
+}
+
+func (r *StatsD) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			r.flush()
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// Close sends what is left and stops sending.
+func (r *StatsD) Close() error {
+	close(r.stop)
+	<-r.done
+	return r.conn.Close()
+}
+
+func (r *StatsD) observe(name string, labels, values []string, v float64) {
+	line := r.line(strings.TrimSuffix(name, "_seconds"), strconv.FormatFloat(v*1000, 'f', 3, 64), "ms", labels, values)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observed++
+	if len(r.timings) < maxTimings {
+		r.timings = append(r.timings, line)
+		return
+	}
+	// Reservoir sampling: every value observed has the same chance of
+	// being kept.
+	if i := rand.Intn(r.observed); i < maxTimings {
+		r.timings[i] = line
+	}
+}
+
+// flush sends the current values and the timers observed since the last
+// flush.
+func (r *StatsD) flush() {
+	r.mu.Lock()
+	timings, observed := r.timings, r.observed
+	r.timings, r.observed = nil, 0
+	r.mu.Unlock()
+
+	lines := []string{}
+	r.registry.Each(func(s Sample) {
+		switch s.Type {
+		case "counter":
+			key := s.Name + "\xff" + strings.Join(s.Values, "\xff")
+			delta := s.Value - r.last[key]
+			// The counter was reset.
+			if delta < 0 {
+				delta = s.Value
+			}
+			r.last[key] = s.Value
+			if delta > 0 {
+				lines = append(lines, r.line(strings.TrimSuffix(s.Name, "_total"), formatFloat(delta), "c", s.Labels, s.Values))
+			}
+		case "gauge":
+			lines = append(lines, r.line(s.Name, formatFloat(s.Value), "g", s.Labels, s.Values))
+		}
+	})
+	if len(timings) > 0 && observed > len(timings) {
+		rate := "|@" + strconv.FormatFloat(float64(len(timings))/float64(observed), 'f', 4, 64)
+		for i, line := range timings {
+			timings[i] = insertRate(line, rate)
+		}
+	}
+	lines = append(lines, timings...)
+	r.send(lines)
+}
+
+// send packs lines into datagrams of up to packet_size bytes.
+func (r *StatsD) send(lines []string) {
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > r.packet_size {
+			r.conn.Write([]byte(packet.String()))
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		r.conn.Write([]byte(packet.String()))
+	}
+}
+
+// line formats a metric as name:value|type|#tag:value,...
+func (r *StatsD) line(name, value, typ string, labels, values []string) string {
+	var b strings.Builder
+	b.WriteString(r.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(typ)
+	tags := len(r.tags) + len(labels)
+	if tags > 0 {
+		b.WriteString("|#")
+		for i, tag := range r.tags {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(tag)
+		}
+		for i, label := range labels {
+			if len(r.tags) > 0 || i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(label)
+			b.WriteByte(':')
+			b.WriteString(tagValue(values[i]))
+		}
+	}
+	return b.String()
+}
+
+// insertRate adds a sample rate after the type of a timer line, before its
+// tags.
+func insertRate(line, rate string) string {
+	i := strings.Index(line, "|#")
+	if i == -1 {
+		return line + rate
+	}
+	return line[:i] + rate + line[i:]
+}
+
+var tagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", " ")
+
+// tagValue keeps a tag value from breaking the line, within the 200
+// characters DogStatsD allows for a tag.
+func tagValue(value string) string {
+	value = tagEscaper.Replace(value)
+	if len(value) > 190 {
+		value = value[:190]
+	}
+	return value
+}
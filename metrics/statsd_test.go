@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen binds a local UDP listener standing in for the agent.
+func listen(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receive returns the next datagram, or fails after a second.
+func receive(t *testing.T, conn net.PacketConn) string {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+// sorted returns the lines of a datagram in order, as children of a vec are
+// sent in no particular one.
+func sorted(datagram string) string {
+	lines := strings.Split(datagram, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestStatsDLines(t *testing.T) {
+	agent := listen(t)
+	registry := NewRegistry()
+	commands := registry.NewCounterVec("commands_total", "", "command")
+	sessions := registry.NewGaugeVec("sessions", "")
+	latency := registry.NewHistogramVec("latency_seconds", "", ExponentialBuckets(0.001, 2, 10), "command")
+	sink, err := NewStatsD(registry, agent.LocalAddr().String(), "sqlproxy.", []string{"env:test"}, time.Hour, 1432)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	commands.With("query").Add(3)
+	commands.With("ping").Inc()
+	sessions.With().Set(5)
+	latency.With("query").Observe(0.25)
+	sink.flush()
+	got := sorted(receive(t, agent))
+	want := strings.Join([]string{
+		"sqlproxy.commands:1|c|#env:test,command:ping",
+		"sqlproxy.commands:3|c|#env:test,command:query",
+		"sqlproxy.latency:250.000|ms|#env:test,command:query",
+		"sqlproxy.sessions:5|g|#env:test",
+	}, "\n")
+	if got != want {
+		t.Fatalf("first flush:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Counters are sent as the increase, timers once.
+	commands.With("query").Add(2)
+	sink.flush()
+	got = receive(t, agent)
+	want = "sqlproxy.commands:2|c|#env:test,command:query\nsqlproxy.sessions:5|g|#env:test"
+	if got != want {
+		t.Fatalf("second flush:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStatsDPacketSize(t *testing.T) {
+	agent := listen(t)
+	registry := NewRegistry()
+	connections := registry.NewGaugeVec("connections", "", "backend")
+	sink, err := NewStatsD(registry, agent.LocalAddr().String(), "", nil, time.Hour, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	connections.With("a").Set(1)
+	connections.With("b").Set(2)
+	connections.With("c").Set(3)
+	sink.flush()
+	// Each line is 26 bytes, so two do not fit in 40.
+	datagrams := []string{receive(t, agent), receive(t, agent), receive(t, agent)}
+	sort.Strings(datagrams)
+	want := []string{"connections:1|g|#backend:a", "connections:2|g|#backend:b", "connections:3|g|#backend:c"}
+	for i := range want {
+		if datagrams[i] != want[i] {
+			t.Fatalf("datagrams %q, want %q", datagrams, want)
+		}
+	}
+}
+
+func TestStatsDInterval(t *testing.T) {
+	agent := listen(t)
+	registry := NewRegistry()
+	commands := registry.NewCounterVec("commands_total", "", "command")
+	sink, err := NewStatsD(registry, agent.LocalAddr().String(), "", nil, 50*time.Millisecond, 1432)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands.With("query").Add(2)
+	commands.With("quit").Inc()
+	// Everything observed in an interval goes out in one datagram.
+	got := sorted(receive(t, agent))
+	if got != "commands:1|c|#command:quit\ncommands:2|c|#command:query" {
+		t.Fatalf("interval flush: %q", got)
+	}
+
+	// Close sends what is left.
+	commands.With("query").Inc()
+	sink.Close()
+	got = receive(t, agent)
+	if got != "commands:1|c|#command:query" {
+		t.Fatalf("flush on close: %q", got)
+	}
+}
@@ -0,0 +1,42 @@
+package packets
+
+import (
+	"bytes"
+	"errors"
+)
+
+// MySQLAuthSwitchPacket asks the other side to authenticate again using
+// another auth plugin.
+type MySQLAuthSwitchPacket struct {
+	header     MySQLPacketHeader
+	PluginName string
+	PluginData []byte
+}
+
+func NewAuthSwitchPacket(sequence_id uint8, plugin string, data []byte) *MySQLAuthSwitchPacket {
+	return &MySQLAuthSwitchPacket{
+		header:     MySQLPacketHeader{sequence_id: sequence_id},
+		PluginName: plugin,
+		PluginData: data,
+	}
+}
+
+func (r *MySQLAuthSwitchPacket) Decode(pkt *MySQLGenericPacket) error {
+	if len(pkt.data) == 0 || pkt.data[0] != byte(PacketAuthSwitch) {
+		return errors.New("not an auth switch request")
+	}
+	r.header = pkt.header
+	plugin, data, _ := bytes.Cut(pkt.data[1:], []byte{0x00})
+	r.PluginName = string(plugin)
+	r.PluginData = data
+	return nil
+}
+
+func (r *MySQLAuthSwitchPacket) Encode() ([]byte, error) {
+	buf := make([]byte, 0, 2+len(r.PluginName)+len(r.PluginData))
+	buf = append(buf, byte(PacketAuthSwitch))
+	buf = append(buf, r.PluginName...)
+	buf = append(buf, 0x00)
+	buf = append(buf, r.PluginData...)
+	return NewGenericPacket(r.header.sequence_id, buf).Encode()
+}
@@ -0,0 +1,143 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// MySQLChangeUserPacket is COM_CHANGE_USER, re-authenticating an open
+// connection as another user.
+type MySQLChangeUserPacket struct {
+	header         MySQLPacketHeader
+	Username       string
+	AuthResp       []byte
+	Database       string
+	CharacterSet   uint16
+	AuthPluginName string
+	ConnectAttrs   map[string]string
+	capabilities   CapabilityFlags
+}
+
+// Decode parses the packet; capabilities are the ones the client negotiated
+// when it connected.
+func (r *MySQLChangeUserPacket) Decode(pkt *MySQLGenericPacket, capabilities CapabilityFlags) error {
+	payload := pkt.data
+	if len(payload) == 0 || payload[0] != byte(PacketComChangeUser) {
+		return errors.New("not a COM_CHANGE_USER packet")
+	}
+	r.header = pkt.header
+	r.capabilities = capabilities
+	position := 1
+
+	index := bytes.IndexByte(payload[position:], 0x00)
+	if index == -1 {
+		return errors.New("COM_CHANGE_USER truncated")
+	}
+	r.Username = string(payload[position : position+index])
+	position += index + 1
+
+	if capabilities.Has(clientSecureConn) {
+		if position >= len(payload) {
+			return errors.New("COM_CHANGE_USER truncated")
+		}
+		length := int(payload[position])
+		position++
+		if position+length > len(payload) {
+			return errors.New("COM_CHANGE_USER truncated")
+		}
+		r.AuthResp = payload[position : position+length]
+		position += length
+	} else {
+		index := bytes.IndexByte(payload[position:], 0x00)
+		if index == -1 {
+			return errors.New("COM_CHANGE_USER truncated")
+		}
+		r.AuthResp = payload[position : position+index]
+		position += index + 1
+	}
+
+	index = bytes.IndexByte(payload[position:], 0x00)
+	if index == -1 {
+		return errors.New("COM_CHANGE_USER truncated")
+	}
+	r.Database = string(payload[position : position+index])
+	position += index + 1
+
+	if position+2 > len(payload) {
+		return nil
+	}
+	r.CharacterSet = binary.LittleEndian.Uint16(payload[position : position+2])
+	position += 2
+
+	if capabilities.Has(clientPluginAuth) && position < len(payload) {
+		index := bytes.IndexByte(payload[position:], 0x00)
+		if index == -1 {
+			index = len(payload) - position
+		}
+		r.AuthPluginName = string(payload[position : position+index])
+		position += index + 1
+	}
+
+	if capabilities.Has(clientConnectAttrs) && position < len(payload) {
+		attrs, err := decodeConnectAttrs(payload[position:])
+		if err != nil {
+			return err
+		}
+		r.ConnectAttrs = attrs
+	}
+	return nil
+}
+
+func (r *MySQLChangeUserPacket) Encode() ([]byte, error) {
+	buf := make([]byte, 0, 64+len(r.AuthResp))
+	buf = append(buf, byte(PacketComChangeUser))
+	buf = append(buf, r.Username...)
+	buf = append(buf, 0x00)
+
+	if r.capabilities.Has(clientSecureConn) {
+		buf = append(buf, byte(len(r.AuthResp)))
+		buf = append(buf, r.AuthResp...)
+	} else {
+		buf = append(buf, r.AuthResp...)
+		buf = append(buf, 0x00)
+	}
+
+	buf = append(buf, r.Database...)
+	buf = append(buf, 0x00)
+
+	// Old clients stop after the database, leaving out the rest.
+	if r.CharacterSet != 0 {
+		charset := make([]byte, 2)
+		binary.LittleEndian.PutUint16(charset, r.CharacterSet)
+		buf = append(buf, charset...)
+
+		if r.capabilities.Has(clientPluginAuth) {
+			buf = append(buf, r.AuthPluginName...)
+			buf = append(buf, 0x00)
+		}
+		if r.capabilities.Has(clientConnectAttrs) {
+			buf = appendConnectAttrs(buf, r.ConnectAttrs)
+		}
+	}
+
+	return NewGenericPacket(r.header.sequence_id, buf).Encode()
+}
+
+// AuthPacket presents the packet as a handshake response so that it can go
+// through the same authentication as a new connection.
+func (r *MySQLChangeUserPacket) AuthPacket() *MySQLAuthPacket {
+	return &MySQLAuthPacket{
+		header:          r.header,
+		CapabilityFlags: r.capabilities,
+		Username:        r.Username,
+		AuthResp:        r.AuthResp,
+		Database:        r.Database,
+		AuthPluginName:  r.AuthPluginName,
+		ConnectAttrs:    r.ConnectAttrs,
+	}
+}
+
+func (r *MySQLChangeUserPacket) SetSequenceId(sequence_id uint8) {
+	r.header.sequence_id = sequence_id
+}
@@ -0,0 +1,56 @@
+package packets
+
+import (
+	"errors"
+	"sort"
+)
+
+// decodeConnectAttrs parses the connection attributes ending a handshake
+// response or COM_CHANGE_USER: their length encoded total size followed by
+// length encoded keys and values.
+func decodeConnectAttrs(data []byte) (map[string]string, error) {
+	attrs := map[string]string{}
+	if len(data) == 0 {
+		return attrs, nil
+	}
+	size, n, err := readLenEncInt(data)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)-n) < size {
+		return nil, errors.New("connection attributes truncated")
+	}
+	data = data[n : n+int(size)]
+
+	for len(data) > 0 {
+		key, n, err := readLenEncString(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		value, n, err := readLenEncString(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		attrs[string(key)] = string(value)
+	}
+	return attrs, nil
+}
+
+// appendConnectAttrs encodes attrs the way decodeConnectAttrs reads them,
+// sorted by key.
+func appendConnectAttrs(buf []byte, attrs map[string]string) []byte {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []byte{}
+	for _, key := range keys {
+		pairs = appendLenEncString(pairs, []byte(key))
+		pairs = appendLenEncString(pairs, []byte(attrs[key]))
+	}
+	return appendLenEncString(buf, pairs)
+}
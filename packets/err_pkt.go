@@ -0,0 +1,59 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+type MySQLErrPacket struct {
+	header       MySQLPacketHeader
+	ErrorCode    uint16
+	SQLState     string
+	ErrorMessage string
+}
+
+func NewErrPacket(sequence_id uint8, code uint16, state, message string) *MySQLErrPacket {
+	return &MySQLErrPacket{
+		header:       MySQLPacketHeader{sequence_id: sequence_id},
+		ErrorCode:    code,
+		SQLState:     state,
+		ErrorMessage: message,
+	}
+}
+
+func (r *MySQLErrPacket) Decode(pkt *MySQLGenericPacket) error {
+	if len(pkt.data) < 3 || pkt.data[0] != byte(PacketErr) {
+		return errors.New("not an ERR packet")
+	}
+	r.header = pkt.header
+	r.ErrorCode = binary.LittleEndian.Uint16(pkt.data[1:3])
+	position := 3
+	if len(pkt.data) >= 9 && pkt.data[3] == '#' {
+		r.SQLState = string(pkt.data[4:9])
+		position = 9
+	}
+	r.ErrorMessage = string(pkt.data[position:])
+	return nil
+}
+
+func (r *MySQLErrPacket) Encode() ([]byte, error) {
+	state := r.SQLState
+	if len(state) != 5 {
+		state = "HY000"
+	}
+
+	buf := make([]byte, 0, 9+len(r.ErrorMessage))
+	buf = append(buf, byte(PacketErr))
+	code := make([]byte, 2)
+	binary.LittleEndian.PutUint16(code, r.ErrorCode)
+	buf = append(buf, code...)
+	buf = append(buf, '#')
+	buf = append(buf, state...)
+	buf = append(buf, r.ErrorMessage...)
+
+	return NewGenericPacket(r.header.sequence_id, buf).Encode()
+}
+
+func (r *MySQLErrPacket) Error() string {
+	return r.ErrorMessage
+}
@@ -5,7 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"net"
+	"io"
 	"strings"
 )
 
@@ -37,6 +37,10 @@ const (
 	clientCanHandleExpiredPasswords
 	clientSessionTrack
 	clientDeprecateEOF
+	clientOptionalResultsetMetadata
+	clientZstdCompressionAlgorithm
+	clientQueryAttributes
+	clientMultiFactorAuthentication
 )
 
 var flags = map[CapabilityFlags]string{
@@ -65,6 +69,10 @@ var flags = map[CapabilityFlags]string{
 	clientCanHandleExpiredPasswords:  "clientCanHandleExpiredPasswords",
 	clientSessionTrack:               "clientSessionTrack",
 	clientDeprecateEOF:               "clientDeprecateEOF",
+	clientOptionalResultsetMetadata:  "clientOptionalResultsetMetadata",
+	clientZstdCompressionAlgorithm:   "clientZstdCompressionAlgorithm",
+	clientQueryAttributes:            "clientQueryAttributes",
+	clientMultiFactorAuthentication:  "clientMultiFactorAuthentication",
 }
 
 func (r CapabilityFlags) Has(flag CapabilityFlags) bool {
@@ -98,21 +106,45 @@ type MySQLHandshakePacket struct {
 	AuthPluginName    []byte
 }
 
-func (r *MySQLHandshakePacket) Decode(conn net.Conn) error {
-	data := make([]byte, 1024)
-	_, err := conn.Read(data)
+// serverCapabilities are advertised by the proxy when it is the server
+// itself rather than relaying MySQL's handshake.
+const serverCapabilities = clientLongPassword | clientLongFlag | clientConnectWithDB |
+	clientProtocol41 | clientTransactions | clientSecureConn | clientPluginAuth |
+	clientPluginAuthLenEncClientData | clientDeprecateEOF
+
+// NewHandshakePacket returns a handshake offering mysql_native_password
+// with a 20 byte scramble.
+func NewHandshakePacket(connection_id uint32, server_version string, scramble []byte) *MySQLHandshakePacket {
+	return &MySQLHandshakePacket{
+		ProtocolVersion:   0x0a,
+		ServerVersion:     []byte(server_version),
+		ConnectionId:      connection_id,
+		AuthPluginData:    append(append([]byte{}, scramble...), 0x00),
+		CapabilitiesFlags: serverCapabilities,
+		CharacterSet:      charsetUTF8MB4,
+		StatusFlags:       ServerStatusAutocommit,
+		AuthPluginDataLen: uint8(len(scramble) + 1),
+		AuthPluginName:    []byte("mysql_native_password"),
+	}
+}
+
+func (r *MySQLHandshakePacket) Decode(conn io.Reader) error {
+	pkt, err := ReadPacket(conn)
 	if err != nil {
 		return err
 	}
 
-	header := &MySQLPacketHeader{}
-	ln := []byte{data[0], data[1], data[2], 0x00}
-	header.length = binary.LittleEndian.Uint32(ln)
-	header.sequence_id = data[3]
+	r.header = pkt.header
 
-	r.header = *header
-
-	payload := data[4 : header.length+4]
+	payload := pkt.data
+	if len(payload) == 0 {
+		return errors.New("empty handshake packet")
+	}
+	if payload[0] == byte(PacketErr) {
+		err_pkt := &MySQLErrPacket{}
+		err_pkt.Decode(pkt)
+		return err_pkt
+	}
 	position := 0
 
 	r.ProtocolVersion = payload[0]
@@ -240,6 +272,27 @@ func (r MySQLHandshakePacket) Encode() ([]byte, error) {
 	return newBuf, nil
 }
 
+// SupportsConnectAttrs reports whether the server accepts connection
+// attributes.
+func (r *MySQLHandshakePacket) SupportsConnectAttrs() bool {
+	return r.CapabilitiesFlags.Has(clientConnectAttrs)
+}
+
+// DisableCompression stops the client from asking for a compressed
+// protocol, zlib or zstd, which the proxy does not speak.
+func (r *MySQLHandshakePacket) DisableCompression() {
+	r.CapabilitiesFlags &^= clientCompress | clientZstdCompressionAlgorithm
+}
+
+// EnableSSL sets or clears the SSL capability advertised to the client.
+func (r *MySQLHandshakePacket) EnableSSL(enable bool) {
+	if enable {
+		r.CapabilitiesFlags |= clientSSL
+	} else {
+		r.CapabilitiesFlags &^= clientSSL
+	}
+}
+
 func Max(a, b int) int {
 	if a > b {
 		return a
@@ -262,25 +315,42 @@ type MySQLAuthPacket struct {
 	AuthResp        []byte
 	Database        string
 	AuthPluginName  string
-	ConnectAttrs    []byte
+	ConnectAttrs    map[string]string
+	sslRequest      bool
+}
+
+// NewAuthPacket returns a handshake response logging in as user with
+// mysql_native_password. Connection attributes are only sent when attrs
+// is not nil.
+func NewAuthPacket(capabilities CapabilityFlags, charset uint8, user string, auth_resp []byte, attrs map[string]string) *MySQLAuthPacket {
+	capabilities |= clientProtocol41 | clientSecureConn | clientPluginAuth
+	if attrs != nil {
+		capabilities |= clientConnectAttrs
+	}
+	return &MySQLAuthPacket{
+		header:          MySQLPacketHeader{sequence_id: 1},
+		CapabilityFlags: capabilities,
+		CharacterSet:    charset,
+		MaxPacketSize:   MAX_PACKET_LENGTH,
+		Username:        user,
+		AuthResp:        auth_resp,
+		AuthPluginName:  "mysql_native_password",
+		ConnectAttrs:    attrs,
+	}
 }
 
-func (r *MySQLAuthPacket) Decode(conn net.Conn) error {
-	data := make([]byte, 1024)
-	_, err := conn.Read(data)
+func (r *MySQLAuthPacket) Decode(conn io.Reader) error {
+	pkt, err := ReadPacket(conn)
 	if err != nil {
 		return err
 	}
 
-	header := &MySQLPacketHeader{}
-	ln := []byte{data[0], data[1], data[2], 0x00}
-	header.length = binary.LittleEndian.Uint32(ln)
-	// a single byte integer is the same in BigEndian and LittleEndian
-	header.sequence_id = data[3]
+	r.header = pkt.header
 
-	r.header = *header
-
-	payload := data[4 : header.length+4]
+	payload := pkt.data
+	if len(payload) < 32 {
+		return errors.New("auth packet too short")
+	}
 	position := 0
 
 	cap := binary.LittleEndian.Uint32(payload[position : position+4])
@@ -298,16 +368,25 @@ func (r *MySQLAuthPacket) Decode(conn net.Conn) error {
 	r.Reserved = payload[position : position+23]
 	position += 23
 
+	// An SSLRequest is the fixed part of the response on its own; the full
+	// response follows once the TLS handshake is done.
+	r.sslRequest = position == len(payload) && r.CapabilityFlags&clientSSL != 0
+	if r.sslRequest {
+		return nil
+	}
+
 	index := bytes.IndexByte(payload[position:], byte(0x00))
 	r.Username = string(payload[position : position+index])
 	fmt.Printf("Username: %s\n", r.Username)
 	position += index + 1
 
 	if r.CapabilityFlags&clientPluginAuthLenEncClientData != 0 {
-		length := int(payload[position])
-		position++
-		r.AuthResp = payload[position : position+length]
-		position += length
+		auth_resp, n, err := readLenEncString(payload[position:])
+		if err != nil {
+			return err
+		}
+		r.AuthResp = auth_resp
+		position += n
 	} else if r.CapabilityFlags&clientSecureConn != 0 {
 		length := int(payload[position])
 		position++
@@ -334,7 +413,10 @@ func (r *MySQLAuthPacket) Decode(conn net.Conn) error {
 	}
 
 	if r.CapabilityFlags&clientConnectAttrs != 0 {
-		r.ConnectAttrs = payload[position:]
+		r.ConnectAttrs, err = decodeConnectAttrs(payload[position:])
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -363,10 +445,7 @@ func (r *MySQLAuthPacket) Encode() ([]byte, error) {
 	buf = append(buf, username...)
 
 	if r.CapabilityFlags&clientPluginAuthLenEncClientData != 0 {
-		auth_resp_len := make([]byte, 1)
-		auth_resp_len[0] = byte(len(r.AuthResp))
-		buf = append(buf, auth_resp_len...)
-		buf = append(buf, r.AuthResp...)
+		buf = appendLenEncString(buf, r.AuthResp)
 	} else if r.CapabilityFlags&clientSecureConn != 0 {
 		auth_resp_len := make([]byte, 1)
 		auth_resp_len[0] = byte(len(r.AuthResp))
@@ -391,7 +470,7 @@ func (r *MySQLAuthPacket) Encode() ([]byte, error) {
 	}
 
 	if r.CapabilityFlags&clientConnectAttrs != 0 {
-		buf = append(buf, r.ConnectAttrs...)
+		buf = appendConnectAttrs(buf, r.ConnectAttrs)
 	}
 
 	h := MySQLPacketHeader{
@@ -409,6 +488,53 @@ func (r *MySQLAuthPacket) Encode() ([]byte, error) {
 	return new_buf, nil
 }
 
+// IsSSLRequest reports whether the decoded packet was an SSLRequest asking
+// to switch the connection to TLS.
+func (r *MySQLAuthPacket) IsSSLRequest() bool {
+	return r.sslRequest
+}
+
+// DisableSSL clears the SSL capability so the packet can be relayed over a
+// plain text connection.
+func (r *MySQLAuthPacket) DisableSSL() {
+	r.CapabilityFlags &^= clientSSL
+}
+
+// DisableCompression clears the compression capabilities, which the proxy
+// does not relay.
+func (r *MySQLAuthPacket) DisableCompression() {
+	r.CapabilityFlags &^= clientCompress | clientZstdCompressionAlgorithm
+}
+
+// SessionCapabilities returns the client's capabilities that shape the
+// packets of the session, leaving out the ones that only matter while
+// connecting: SSL, compression, connection attributes and the initial
+// database.
+func (r *MySQLAuthPacket) SessionCapabilities() CapabilityFlags {
+	return r.CapabilityFlags &^ (clientSSL | clientCompress | clientZstdCompressionAlgorithm | clientConnectAttrs | clientConnectWithDB)
+}
+
+// CanHandleExpiredPasswords reports whether the client can log in with an
+// expired password to then change it.
+func (r *MySQLAuthPacket) CanHandleExpiredPasswords() bool {
+	return r.CapabilityFlags.Has(clientCanHandleExpiredPasswords)
+}
+
+// SetConnectAttrs replaces the connection attributes, announcing them even
+// if the client sent none.
+func (r *MySQLAuthPacket) SetConnectAttrs(attrs map[string]string) {
+	r.ConnectAttrs = attrs
+	r.CapabilityFlags |= clientConnectAttrs
+}
+
+func (r *MySQLAuthPacket) SequenceId() uint8 {
+	return r.header.sequence_id
+}
+
+func (r *MySQLAuthPacket) SetSequenceId(sequence_id uint8) {
+	r.header.sequence_id = sequence_id
+}
+
 func (r *MySQLAuthPacket) String() string {
 	return fmt.Sprintf("User: %s", r.Username)
 }
@@ -0,0 +1,68 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errLenEncTruncated = errors.New("length encoded value truncated")
+
+// readLenEncInt decodes a length encoded integer and returns it along with
+// the number of bytes it took.
+func readLenEncInt(data []byte) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errLenEncTruncated
+	}
+	switch data[0] {
+	case 0xfc:
+		if len(data) < 3 {
+			return 0, 0, errLenEncTruncated
+		}
+		return uint64(binary.LittleEndian.Uint16(data[1:3])), 3, nil
+	case 0xfd:
+		if len(data) < 4 {
+			return 0, 0, errLenEncTruncated
+		}
+		return uint64(data[1]) | uint64(data[2])<<8 | uint64(data[3])<<16, 4, nil
+	case 0xfe:
+		if len(data) < 9 {
+			return 0, 0, errLenEncTruncated
+		}
+		return binary.LittleEndian.Uint64(data[1:9]), 9, nil
+	default:
+		return uint64(data[0]), 1, nil
+	}
+}
+
+func appendLenEncInt(buf []byte, n uint64) []byte {
+	switch {
+	case n < 0xfb:
+		return append(buf, byte(n))
+	case n < 1<<16:
+		return append(buf, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		return append(buf, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, n)
+		return append(append(buf, 0xfe), b...)
+	}
+}
+
+// readLenEncString decodes a length encoded string and returns it along with
+// the number of bytes it took.
+func readLenEncString(data []byte) ([]byte, int, error) {
+	length, n, err := readLenEncInt(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint64(len(data)-n) < length {
+		return nil, 0, errLenEncTruncated
+	}
+	return data[n : n+int(length)], n + int(length), nil
+}
+
+func appendLenEncString(buf []byte, s []byte) []byte {
+	buf = appendLenEncInt(buf, uint64(len(s)))
+	return append(buf, s...)
+}
@@ -0,0 +1,113 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Server status flags carried by OK and EOF packets.
+const (
+	ServerStatusInTrans            uint16 = 0x0001
+	ServerStatusAutocommit         uint16 = 0x0002
+	ServerMoreResultsExists        uint16 = 0x0008
+	ServerStatusNoGoodIndexUsed    uint16 = 0x0010
+	ServerStatusNoIndexUsed        uint16 = 0x0020
+	ServerStatusCursorExists       uint16 = 0x0040
+	ServerStatusLastRowSent        uint16 = 0x0080
+	ServerStatusDatabaseDropped    uint16 = 0x0100
+	ServerStatusNoBackslashEscapes uint16 = 0x0200
+	ServerStatusMetadataChanged    uint16 = 0x0400
+	ServerQueryWasSlow             uint16 = 0x0800
+	ServerPSOutParams              uint16 = 0x1000
+	ServerStatusInTransReadonly    uint16 = 0x2000
+	ServerSessionStateChanged      uint16 = 0x4000
+)
+
+type MySQLOKPacket struct {
+	header       MySQLPacketHeader
+	AffectedRows uint64
+	LastInsertId uint64
+	StatusFlags  uint16
+	Warnings     uint16
+	Info         string
+	// Raw session state change information, present when the client set
+	// CLIENT_SESSION_TRACK and SERVER_SESSION_STATE_CHANGED is set.
+	SessionState []byte
+}
+
+func NewOKPacket(sequence_id uint8, affected_rows uint64, status uint16) *MySQLOKPacket {
+	return &MySQLOKPacket{
+		header:       MySQLPacketHeader{sequence_id: sequence_id},
+		AffectedRows: affected_rows,
+		StatusFlags:  status,
+	}
+}
+
+// Decode parses an OK packet, or an EOF packet standing in for one when
+// CLIENT_DEPRECATE_EOF is in effect. capabilities are the ones negotiated
+// by the client.
+func (r *MySQLOKPacket) Decode(pkt *MySQLGenericPacket, capabilities CapabilityFlags) error {
+	data := pkt.data
+	if len(data) < 7 || (data[0] != byte(PacketOK) && data[0] != byte(PacketEOF)) {
+		return errors.New("not an OK packet")
+	}
+	r.header = pkt.header
+	position := 1
+
+	affected_rows, n, err := readLenEncInt(data[position:])
+	if err != nil {
+		return err
+	}
+	r.AffectedRows = affected_rows
+	position += n
+
+	last_insert_id, n, err := readLenEncInt(data[position:])
+	if err != nil {
+		return err
+	}
+	r.LastInsertId = last_insert_id
+	position += n
+
+	if len(data) < position+4 {
+		return errors.New("OK packet truncated")
+	}
+	r.StatusFlags = binary.LittleEndian.Uint16(data[position : position+2])
+	r.Warnings = binary.LittleEndian.Uint16(data[position+2 : position+4])
+	position += 4
+
+	if !capabilities.Has(clientSessionTrack) {
+		r.Info = string(data[position:])
+		return nil
+	}
+	if position < len(data) {
+		info, n, err := readLenEncString(data[position:])
+		if err != nil {
+			return err
+		}
+		r.Info = string(info)
+		position += n
+	}
+	if r.StatusFlags&ServerSessionStateChanged != 0 && position < len(data) {
+		state, _, err := readLenEncString(data[position:])
+		if err != nil {
+			return err
+		}
+		r.SessionState = state
+	}
+	return nil
+}
+
+func (r *MySQLOKPacket) Encode() ([]byte, error) {
+	buf := make([]byte, 0, 16+len(r.Info))
+	buf = append(buf, byte(PacketOK))
+	buf = appendLenEncInt(buf, r.AffectedRows)
+	buf = appendLenEncInt(buf, r.LastInsertId)
+
+	tail := make([]byte, 4)
+	binary.LittleEndian.PutUint16(tail[0:2], r.StatusFlags)
+	binary.LittleEndian.PutUint16(tail[2:4], r.Warnings)
+	buf = append(buf, tail...)
+	buf = append(buf, r.Info...)
+
+	return NewGenericPacket(r.header.sequence_id, buf).Encode()
+}
@@ -3,6 +3,7 @@ package packets
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 type MySQLPacketHeader struct {
@@ -15,6 +16,47 @@ type MySQLGenericPacket struct {
 	data   []byte
 }
 
+// NewGenericPacket wraps a payload into a packet with the given sequence id.
+func NewGenericPacket(sequence_id uint8, data []byte) *MySQLGenericPacket {
+	return &MySQLGenericPacket{
+		header: MySQLPacketHeader{
+			length:      uint32(len(data)),
+			sequence_id: sequence_id,
+		},
+		data: data,
+	}
+}
+
+// ReadPacket reads exactly one packet (header and payload) from conn.
+func ReadPacket(conn io.Reader) (*MySQLGenericPacket, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := &MySQLGenericPacket{}
+	packet.header.Decode(hdr)
+	packet.data = make([]byte, packet.header.length)
+	_, err = io.ReadFull(conn, packet.data)
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (r *MySQLGenericPacket) Data() []byte {
+	return r.data
+}
+
+func (r *MySQLGenericPacket) SequenceId() uint8 {
+	return r.header.sequence_id
+}
+
+func (r *MySQLGenericPacket) SetSequenceId(sequence_id uint8) {
+	r.header.sequence_id = sequence_id
+}
+
 func (r *MySQLGenericPacket) dumpBytes() string {
 	return string(r.data)
 }
@@ -79,7 +121,7 @@ func DecodePackets(packets []byte, direction bool) {
 				fmt.Printf("%s\n", packet.data)
 			case byte(PacketComQuery):
 				query := MySQLCOMQueryPacket{}
-				query.Decode(packet)
+				query.Decode(packet, 0)
 				fmt.Printf("%s\n", query.sql)
 			case byte(PacketComFieldList):
 				fmt.Printf("PacketComFieldList\n")
@@ -139,87 +181,3 @@ func DecodePackets(packets []byte, direction bool) {
 
 	}
 }
-
-func InjectUser(packets []byte, direction bool, username string) ([]byte, error) {
-	packet_seq := []MySQLGenericPacket{}
-	for i := 0; i < len(packets); {
-		header := MySQLPacketHeader{}
-		header.length = binary.LittleEndian.Uint32([]byte{packets[i], packets[i+1], packets[i+2], 0})
-		header.sequence_id = packets[i+3]
-
-		packet := MySQLGenericPacket{}
-		packet.header = header
-		packet.data = packets[i+4 : i+4+int(header.length)]
-
-		packet_seq = append(packet_seq, packet)
-		i += 4 + int(header.length)
-	}
-	ret := []byte{}
-	for _, packet := range packet_seq {
-		if direction {
-			magic := packet.data[0]
-			switch magic {
-			case byte(PacketComSleep):
-
-			case byte(PacketComQuit):
-
-			case byte(PacketComInitDB):
-
-			case byte(PacketComQuery):
-				query := MySQLCOMQueryPacket{}
-				query.Decode(packet)
-				query.InjectUserName(username)
-				packet.header = query.header
-				data, err := query.EncodeData()
-				if err != nil {
-					return nil, err
-				}
-				packet.data = data
-
-			case byte(PacketComFieldList):
-
-			case byte(PacketComCreateDB):
-
-			case byte(PacketComDropDB):
-
-			case byte(PacketComRefresh):
-
-			case byte(PacketComShutdown):
-
-			case byte(PacketComStatistics):
-
-			case byte(PacketComProcessInfo):
-
-			case byte(PacketComConnect):
-
-			case byte(PacketComProcessKill):
-
-			case byte(PacketComDebug):
-
-			case byte(PacketComPing):
-
-			case byte(PacketComTime):
-
-			case byte(PacketComDelayedInsert):
-
-			case byte(PacketComChangeUser):
-
-			case byte(PacketResetConnection):
-
-			case byte(PacketComDaemon):
-
-			default:
-
-			}
-		} else {
-			//fmt.Println(packet)
-		}
-		data, err := packet.Encode()
-		if err != nil {
-			return nil, err
-		}
-		//fmt.Println(data)
-		ret = append(ret, data...)
-	}
-	return ret, nil
-}
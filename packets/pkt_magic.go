@@ -1,5 +1,7 @@
 package packets
 
+import "fmt"
+
 type PacketMagic uint8
 
 const (
@@ -21,8 +23,58 @@ const (
 	PacketComTime
 	PacketComDelayedInsert
 	PacketComChangeUser
-	PacketResetConnection
+	PacketComBinlogDump
+	PacketComTableDump
+	PacketComConnectOut
+	PacketComRegisterSlave
+	PacketComStmtPrepare
+	PacketComStmtExecute
+	PacketComStmtSendLongData
+	PacketComStmtClose
+	PacketComStmtReset
+	PacketComSetOption
+	PacketComStmtFetch
 	PacketComDaemon
+	PacketComBinlogDumpGTID
+	PacketResetConnection
 )
 
 const MAX_PACKET_LENGTH = 16 * 1024 * 1024
+
+// First payload byte of the generic server responses.
+const (
+	PacketOK          PacketMagic = 0x00
+	PacketLocalInfile PacketMagic = 0xfb
+	PacketAuthSwitch  PacketMagic = 0xfe
+	PacketEOF         PacketMagic = 0xfe
+	PacketErr         PacketMagic = 0xff
+)
+
+var commandNames = []string{
+	"COM_SLEEP", "COM_QUIT", "COM_INIT_DB", "COM_QUERY", "COM_FIELD_LIST",
+	"COM_CREATE_DB", "COM_DROP_DB", "COM_REFRESH", "COM_SHUTDOWN",
+	"COM_STATISTICS", "COM_PROCESS_INFO", "COM_CONNECT", "COM_PROCESS_KILL",
+	"COM_DEBUG", "COM_PING", "COM_TIME", "COM_DELAYED_INSERT",
+	"COM_CHANGE_USER", "COM_BINLOG_DUMP", "COM_TABLE_DUMP", "COM_CONNECT_OUT",
+	"COM_REGISTER_SLAVE", "COM_STMT_PREPARE", "COM_STMT_EXECUTE",
+	"COM_STMT_SEND_LONG_DATA", "COM_STMT_CLOSE", "COM_STMT_RESET",
+	"COM_SET_OPTION", "COM_STMT_FETCH", "COM_DAEMON", "COM_BINLOG_DUMP_GTID",
+	"COM_RESET_CONNECTION",
+}
+
+// String names the command, e.g. COM_QUERY.
+// HasResponse reports whether MySQL answers the command.
+func (r PacketMagic) HasResponse() bool {
+	switch r {
+	case PacketComQuit, PacketComStmtClose, PacketComStmtSendLongData:
+		return false
+	}
+	return true
+}
+
+func (r PacketMagic) String() string {
+	if int(r) < len(commandNames) {
+		return commandNames[r]
+	}
+	return fmt.Sprintf("COM_UNKNOWN(0x%02x)", uint8(r))
+}
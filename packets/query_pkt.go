@@ -1,28 +1,247 @@
 package packets
 
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Column types of the binary protocol, as used for query attributes.
+const (
+	TypeTiny      = 0x01
+	TypeShort     = 0x02
+	TypeLong      = 0x03
+	TypeFloat     = 0x04
+	TypeDouble    = 0x05
+	TypeNull      = 0x06
+	TypeTimestamp = 0x07
+	TypeLongLong  = 0x08
+	TypeInt24     = 0x09
+	TypeDate      = 0x0a
+	TypeTime      = 0x0b
+	TypeDateTime  = 0x0c
+	TypeYear      = 0x0d
+	TypeVarString = 0xfd
+	TypeString    = 0xfe
+)
+
+// QueryAttribute is a named value sent along with a query by clients that
+// negotiated CLIENT_QUERY_ATTRIBUTES, readable on the server with
+// mysql_query_attribute_string().
+type QueryAttribute struct {
+	Name string
+	// column type, with 0x8000 set for unsigned integers
+	Type uint16
+	// binary protocol encoding of the value, nil for NULL
+	Value []byte
+}
+
+// StringQueryAttribute returns a string valued attribute.
+func StringQueryAttribute(name, value string) QueryAttribute {
+	return QueryAttribute{
+		Name:  name,
+		Type:  TypeString,
+		Value: appendLenEncString(nil, []byte(value)),
+	}
+}
+
 type MySQLCOMQueryPacket struct {
-	header MySQLPacketHeader
-	magic  uint8
-	sql    string
+	header       MySQLPacketHeader
+	magic        uint8
+	sql          string
+	capabilities CapabilityFlags
+	Attributes   []QueryAttribute
 }
 
-func (r *MySQLCOMQueryPacket) Decode(pkt MySQLGenericPacket) error {
+// NewCOMQueryPacket returns a COM_QUERY for sql, to be sent on a connection
+// with the given capabilities.
+func NewCOMQueryPacket(sql string, capabilities CapabilityFlags) *MySQLCOMQueryPacket {
+	return &MySQLCOMQueryPacket{
+		magic:        byte(PacketComQuery),
+		sql:          sql,
+		capabilities: capabilities,
+	}
+}
+
+// Decode parses the packet; capabilities are the ones the client negotiated,
+// which tell whether the SQL text is preceded by query attributes.
+func (r *MySQLCOMQueryPacket) Decode(pkt MySQLGenericPacket, capabilities CapabilityFlags) error {
+	if len(pkt.data) == 0 {
+		return errors.New("empty COM_QUERY packet")
+	}
 	r.header = pkt.header
 	r.magic = pkt.data[0]
-	r.sql = string(pkt.data[1:])
+	r.capabilities = capabilities
+	r.Attributes = nil
+	payload := pkt.data[1:]
+
+	if capabilities.Has(clientQueryAttributes) {
+		n, err := r.decodeAttributes(payload)
+		if err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	r.sql = string(payload)
 
 	return nil
 }
 
+// decodeAttributes reads the parameter block preceding the SQL text and
+// returns its length.
+func (r *MySQLCOMQueryPacket) decodeAttributes(payload []byte) (int, error) {
+	count, position, err := readLenEncInt(payload)
+	if err != nil {
+		return 0, err
+	}
+	// The number of parameter sets, always 1.
+	_, n, err := readLenEncInt(payload[position:])
+	if err != nil {
+		return 0, err
+	}
+	position += n
+	if count == 0 {
+		return position, nil
+	}
+
+	bitmap_len := int(count+7) / 8
+	if position+bitmap_len+1 > len(payload) {
+		return 0, errors.New("query attributes truncated")
+	}
+	null_bitmap := payload[position : position+bitmap_len]
+	position += bitmap_len
+	// Types and names are always sent with COM_QUERY.
+	if payload[position] != 1 {
+		return 0, errors.New("query attributes without types")
+	}
+	position++
+
+	attrs := make([]QueryAttribute, count)
+	for i := range attrs {
+		if position+2 > len(payload) {
+			return 0, errors.New("query attributes truncated")
+		}
+		attrs[i].Type = binary.LittleEndian.Uint16(payload[position : position+2])
+		position += 2
+		name, n, err := readLenEncString(payload[position:])
+		if err != nil {
+			return 0, err
+		}
+		attrs[i].Name = string(name)
+		position += n
+	}
+	for i := range attrs {
+		if null_bitmap[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		n, err := binaryValueLength(byte(attrs[i].Type), payload[position:])
+		if err != nil {
+			return 0, err
+		}
+		attrs[i].Value = payload[position : position+n]
+		position += n
+	}
+	r.Attributes = attrs
+	return position, nil
+}
+
+// binaryValueLength returns the length of a value of the given type in the
+// binary protocol.
+func binaryValueLength(typ byte, data []byte) (int, error) {
+	length := 0
+	switch typ {
+	case TypeNull:
+		return 0, nil
+	case TypeTiny:
+		length = 1
+	case TypeShort, TypeYear:
+		length = 2
+	case TypeLong, TypeInt24, TypeFloat:
+		length = 4
+	case TypeLongLong, TypeDouble:
+		length = 8
+	case TypeDate, TypeTime, TypeDateTime, TypeTimestamp:
+		if len(data) == 0 {
+			return 0, errLenEncTruncated
+		}
+		length = 1 + int(data[0])
+	default:
+		_, n, err := readLenEncString(data)
+		return n, err
+	}
+	if length > len(data) {
+		return 0, errLenEncTruncated
+	}
+	return length, nil
+}
+
 func (r *MySQLCOMQueryPacket) EncodeData() ([]byte, error) {
-	buf := make([]byte, len(r.sql)+1)
-	buf[0] = r.magic
-	copy(buf[1:], []byte(r.sql))
+	buf := make([]byte, 0, len(r.sql)+1)
+	buf = append(buf, r.magic)
+	if r.capabilities.Has(clientQueryAttributes) {
+		buf = r.appendAttributes(buf)
+	}
+	buf = append(buf, r.sql...)
 	return buf, nil
 }
 
-func (r *MySQLCOMQueryPacket) InjectUserName(user string) {
-	r.sql += " /* user: " + user + " */"
-	// Update header
-	r.header.length = uint32(len(r.sql) + 1)
+func (r *MySQLCOMQueryPacket) appendAttributes(buf []byte) []byte {
+	buf = appendLenEncInt(buf, uint64(len(r.Attributes)))
+	buf = appendLenEncInt(buf, 1)
+	if len(r.Attributes) == 0 {
+		return buf
+	}
+
+	null_bitmap := make([]byte, (len(r.Attributes)+7)/8)
+	for i, attr := range r.Attributes {
+		if attr.Value == nil {
+			null_bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	buf = append(buf, null_bitmap...)
+	buf = append(buf, 1)
+	for _, attr := range r.Attributes {
+		buf = append(buf, byte(attr.Type), byte(attr.Type>>8))
+		buf = appendLenEncString(buf, []byte(attr.Name))
+	}
+	for _, attr := range r.Attributes {
+		buf = append(buf, attr.Value...)
+	}
+	return buf
+}
+
+// AttributesEnabled reports whether the client negotiated query attributes,
+// so that the packet can carry them.
+func (r *MySQLCOMQueryPacket) AttributesEnabled() bool {
+	return r.capabilities.Has(clientQueryAttributes)
+}
+
+// SetAttribute adds attr, replacing every attribute of the same name.
+func (r *MySQLCOMQueryPacket) SetAttribute(attr QueryAttribute) {
+	attrs := r.Attributes[:0]
+	for _, old := range r.Attributes {
+		if old.Name != attr.Name {
+			attrs = append(attrs, old)
+		}
+	}
+	r.Attributes = append(attrs, attr)
+}
+
+// RemoveAttributes drops every attribute whose name starts with prefix.
+func (r *MySQLCOMQueryPacket) RemoveAttributes(prefix string) {
+	attrs := r.Attributes[:0]
+	for _, attr := range r.Attributes {
+		if !strings.HasPrefix(attr.Name, prefix) {
+			attrs = append(attrs, attr)
+		}
+	}
+	r.Attributes = attrs
+}
+
+func (r *MySQLCOMQueryPacket) SQL() string {
+	return r.sql
+}
+
+func (r *MySQLCOMQueryPacket) SetSQL(sql string) {
+	r.sql = sql
 }
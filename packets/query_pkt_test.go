@@ -0,0 +1,161 @@
+package packets
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestQueryAttributesDecode(t *testing.T) {
+	// SELECT 1 with n1 = 'v1' and n2 = NULL
+	data := []byte{byte(PacketComQuery),
+		2,          // attributes
+		1,          // parameter sets
+		0x02,       // NULL bitmap, second one NULL
+		1,          // types and names follow
+		0xfe, 0x00, // MYSQL_TYPE_STRING
+		2, 'n', '1',
+		0x06, 0x00, // MYSQL_TYPE_NULL
+		2, 'n', '2',
+		2, 'v', '1',
+	}
+	data = append(data, "SELECT 1"...)
+
+	query_pkt := &MySQLCOMQueryPacket{}
+	err := query_pkt.Decode(*NewGenericPacket(0, data), clientQueryAttributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []QueryAttribute{
+		{Name: "n1", Type: TypeString, Value: []byte{2, 'v', '1'}},
+		{Name: "n2", Type: TypeNull},
+	}
+	if query_pkt.SQL() != "SELECT 1" || !reflect.DeepEqual(query_pkt.Attributes, want) {
+		t.Fatalf("decoded %q %+v", query_pkt.SQL(), query_pkt.Attributes)
+	}
+	enc, err := query_pkt.EncodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enc, data) {
+		t.Fatalf("encoded % x\nwant    % x", enc, data)
+	}
+}
+
+func TestQueryAttributesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs []QueryAttribute
+	}{
+		{"none", nil},
+		{"string", []QueryAttribute{StringQueryAttribute("proxy_user", "alice")}},
+		{
+			name: "every kind of value",
+			attrs: []QueryAttribute{
+				{Name: "tiny", Type: TypeTiny, Value: []byte{7}},
+				{Name: "short", Type: TypeShort | 0x8000, Value: []byte{1, 2}},
+				{Name: "long", Type: TypeLong, Value: []byte{1, 2, 3, 4}},
+				{Name: "longlong", Type: TypeLongLong, Value: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+				{Name: "double", Type: TypeDouble, Value: []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+				{Name: "null", Type: TypeNull},
+				{Name: "datetime", Type: TypeDateTime, Value: []byte{4, 0xea, 0x07, 10, 19}},
+				{Name: "empty date", Type: TypeDate, Value: []byte{0}},
+				{Name: "varstring", Type: TypeVarString, Value: []byte{3, 'a', 'b', 'c'}},
+			},
+		},
+		{
+			// The NULL bitmap takes a second byte.
+			name: "nine with NULLs",
+			attrs: func() []QueryAttribute {
+				attrs := []QueryAttribute{}
+				for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"} {
+					attrs = append(attrs, StringQueryAttribute(name, name+name))
+				}
+				attrs[0] = QueryAttribute{Name: "a", Type: TypeString}
+				attrs[8] = QueryAttribute{Name: "i", Type: TypeString}
+				return attrs
+			}(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query_pkt := NewCOMQueryPacket("SELECT 'x'", clientQueryAttributes)
+			query_pkt.Attributes = test.attrs
+			enc, err := query_pkt.EncodeData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := &MySQLCOMQueryPacket{}
+			err = decoded.Decode(*NewGenericPacket(0, enc), clientQueryAttributes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.SQL() != "SELECT 'x'" || len(decoded.Attributes) != len(test.attrs) {
+				t.Fatalf("decoded %q %+v", decoded.SQL(), decoded.Attributes)
+			}
+			for i, attr := range test.attrs {
+				got := decoded.Attributes[i]
+				if got.Name != attr.Name || got.Type != attr.Type || !bytes.Equal(got.Value, attr.Value) || (got.Value == nil) != (attr.Value == nil) {
+					t.Errorf("attribute %d: got %+v, want %+v", i, got, attr)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryAttributesTruncated(t *testing.T) {
+	query_pkt := NewCOMQueryPacket("SELECT 1", clientQueryAttributes)
+	query_pkt.SetAttribute(StringQueryAttribute("a", "value"))
+	enc, err := query_pkt.EncodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut inside the name and inside the value; the SQL text is gone too.
+	for _, end := range []int{6, 10} {
+		err = (&MySQLCOMQueryPacket{}).Decode(*NewGenericPacket(0, enc[:end]), clientQueryAttributes)
+		if err == nil {
+			t.Errorf("decoded % x", enc[:end])
+		}
+	}
+}
+
+func TestQueryAttributesWithoutCapability(t *testing.T) {
+	data := append([]byte{byte(PacketComQuery)}, "SELECT 1"...)
+	query_pkt := &MySQLCOMQueryPacket{}
+	err := query_pkt.Decode(*NewGenericPacket(0, data), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query_pkt.SetAttribute(StringQueryAttribute("proxy_user", "alice"))
+	enc, err := query_pkt.EncodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query_pkt.AttributesEnabled() || !bytes.Equal(enc, data) {
+		t.Fatalf("encoded % x", enc)
+	}
+}
+
+func TestSetAttribute(t *testing.T) {
+	query_pkt := NewCOMQueryPacket("SELECT 1", clientQueryAttributes)
+	query_pkt.Attributes = []QueryAttribute{
+		StringQueryAttribute("proxy_user", "mallory"),
+		StringQueryAttribute("app", "web"),
+		StringQueryAttribute("proxy_user", "root"),
+		StringQueryAttribute("proxy_conn_id", "1"),
+	}
+	query_pkt.SetAttribute(StringQueryAttribute("proxy_user", "alice"))
+	want := []QueryAttribute{
+		StringQueryAttribute("app", "web"),
+		StringQueryAttribute("proxy_conn_id", "1"),
+		StringQueryAttribute("proxy_user", "alice"),
+	}
+	if !reflect.DeepEqual(query_pkt.Attributes, want) {
+		t.Fatalf("attributes %+v", query_pkt.Attributes)
+	}
+
+	query_pkt.RemoveAttributes("proxy_")
+	if !reflect.DeepEqual(query_pkt.Attributes, want[:1]) {
+		t.Fatalf("attributes %+v", query_pkt.Attributes)
+	}
+}
@@ -0,0 +1,293 @@
+package packets
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+type responseState int
+
+const (
+	stateStart responseState = iota
+	stateColumnDefs
+	stateColumnsEOF
+	stateRows
+	statePrepareParams
+	statePrepareParamsEOF
+	statePrepareColumns
+	statePrepareColumnsEOF
+	stateFieldList
+	stateDone
+)
+
+// ResponseReader reads the packets making up the server's response to one
+// command and knows when that response is complete. What it has seen so far
+// is summarized in its exported fields.
+type ResponseReader struct {
+	conn         io.Reader
+	command      PacketMagic
+	capabilities CapabilityFlags
+	state        responseState
+	remaining    uint64
+	columns      uint64
+	continued    bool
+	local_infile bool
+
+	Rows        uint64
+	ResultSets  int
+	StatusFlags uint16
+	// set once a packet carrying status flags has been read
+	HasStatus bool
+	// session state changes reported by the OK packets of the response
+	SessionState []byte
+	OK           *MySQLOKPacket
+	Err          *MySQLErrPacket
+	// set for COM_STMT_PREPARE
+	StatementId uint32
+}
+
+// NewResponseReader starts reading the response to command from conn.
+// capabilities are the ones negotiated by the client.
+func NewResponseReader(conn io.Reader, command PacketMagic, capabilities CapabilityFlags) *ResponseReader {
+	r := &ResponseReader{
+		conn:         conn,
+		command:      command,
+		capabilities: capabilities,
+	}
+	if !command.HasResponse() {
+		r.state = stateDone
+	}
+	return r
+}
+
+// Done reports whether the whole response has been read.
+func (r *ResponseReader) Done() bool {
+	return r.state == stateDone
+}
+
+// LocalInfile reports whether the last packet was a LOCAL INFILE request,
+// which the client answers with the file contents before the response goes
+// on.
+func (r *ResponseReader) LocalInfile() bool {
+	return r.local_infile
+}
+
+// Next reads the next packet of the response, or returns io.EOF once the
+// response is complete.
+func (r *ResponseReader) Next() (*MySQLGenericPacket, error) {
+	if r.state == stateDone {
+		return nil, io.EOF
+	}
+	pkt, err := ReadPacket(r.conn)
+	if err != nil {
+		return nil, err
+	}
+	r.local_infile = false
+
+	// Payloads of 16M and more are split, the rest follows in packets of
+	// their own which carry no meaning of their own.
+	continuation := r.continued
+	r.continued = pkt.header.length == 0xffffff
+	if !continuation {
+		r.advance(pkt)
+	}
+	return pkt, nil
+}
+
+func (r *ResponseReader) deprecateEOF() bool {
+	return r.capabilities.Has(clientDeprecateEOF)
+}
+
+func isEOFPacket(data []byte) bool {
+	return len(data) > 0 && len(data) < 9 && data[0] == byte(PacketEOF)
+}
+
+// isTerminator tells the packet ending a list of rows or definitions apart
+// from a row: an EOF packet, or an OK packet with the EOF header when
+// CLIENT_DEPRECATE_EOF is in effect.
+func (r *ResponseReader) isTerminator(data []byte) bool {
+	if r.deprecateEOF() {
+		return len(data) > 0 && len(data) < 0xffffff && data[0] == byte(PacketEOF)
+	}
+	return isEOFPacket(data)
+}
+
+func (r *ResponseReader) readStatus(pkt *MySQLGenericPacket) {
+	data := pkt.data
+	if isEOFPacket(data) && !r.deprecateEOF() {
+		if len(data) >= 5 {
+			r.StatusFlags = binary.LittleEndian.Uint16(data[3:5])
+			r.HasStatus = true
+		}
+		return
+	}
+	ok := &MySQLOKPacket{}
+	if ok.Decode(pkt, r.capabilities) == nil {
+		r.okStatus(ok)
+	}
+}
+
+func (r *ResponseReader) okStatus(ok *MySQLOKPacket) {
+	r.StatusFlags = ok.StatusFlags
+	r.HasStatus = true
+	r.SessionState = append(r.SessionState, ok.SessionState...)
+}
+
+// endOfResult finishes a result set or an OK, going on with the next one
+// when the server announced more results.
+func (r *ResponseReader) endOfResult() {
+	if r.StatusFlags&ServerMoreResultsExists != 0 {
+		r.state = stateStart
+	} else {
+		r.state = stateDone
+	}
+}
+
+func (r *ResponseReader) advance(pkt *MySQLGenericPacket) {
+	data := pkt.data
+	first := byte(0xff)
+	if len(data) > 0 {
+		first = data[0]
+	}
+
+	if first == byte(PacketErr) && r.state != stateColumnDefs && r.state != statePrepareParams && r.state != statePrepareColumns {
+		r.Err = &MySQLErrPacket{}
+		r.Err.Decode(pkt)
+		r.state = stateDone
+		return
+	}
+
+	switch r.state {
+	case stateStart:
+		r.start(pkt)
+
+	case stateColumnDefs:
+		r.remaining--
+		if r.remaining == 0 {
+			r.state = stateRows
+			if !r.deprecateEOF() {
+				r.state = stateColumnsEOF
+			}
+		}
+
+	case stateColumnsEOF:
+		r.readStatus(pkt)
+		r.state = stateRows
+		// A cursor was opened: rows are fetched with COM_STMT_FETCH.
+		if r.command == PacketComStmtExecute && r.StatusFlags&ServerStatusCursorExists != 0 {
+			r.state = stateDone
+		}
+
+	case stateRows:
+		if r.isTerminator(data) {
+			r.readStatus(pkt)
+			r.endOfResult()
+			if r.command == PacketComStmtFetch {
+				r.state = stateDone
+			}
+			return
+		}
+		r.Rows++
+
+	case statePrepareParams:
+		r.remaining--
+		if r.remaining == 0 {
+			r.state = statePrepareParamsEOF
+			if r.deprecateEOF() {
+				r.preparedColumns()
+			}
+		}
+
+	case statePrepareParamsEOF:
+		r.preparedColumns()
+
+	case statePrepareColumns:
+		r.remaining--
+		if r.remaining == 0 {
+			r.state = statePrepareColumnsEOF
+			if r.deprecateEOF() {
+				r.state = stateDone
+			}
+		}
+
+	case statePrepareColumnsEOF:
+		r.state = stateDone
+
+	case stateFieldList:
+		if r.isTerminator(data) {
+			r.readStatus(pkt)
+			r.state = stateDone
+		}
+	}
+}
+
+// start handles the first packet of a response, or of a further result.
+func (r *ResponseReader) start(pkt *MySQLGenericPacket) {
+	data := pkt.data
+	if len(data) == 0 {
+		r.state = stateDone
+		return
+	}
+
+	switch {
+	case r.command == PacketComStatistics:
+		r.state = stateDone
+
+	case r.command == PacketComStmtPrepare && len(data) >= 12 && data[0] == byte(PacketOK):
+		r.StatementId = binary.LittleEndian.Uint32(data[1:5])
+		r.columns = uint64(binary.LittleEndian.Uint16(data[5:7]))
+		r.remaining = uint64(binary.LittleEndian.Uint16(data[7:9]))
+		if r.remaining > 0 {
+			r.state = statePrepareParams
+		} else {
+			r.preparedColumns()
+		}
+
+	case r.command == PacketComFieldList:
+		if r.isTerminator(data) {
+			r.readStatus(pkt)
+			r.state = stateDone
+			return
+		}
+		r.state = stateFieldList
+
+	case r.command == PacketComStmtFetch:
+		r.state = stateRows
+		r.advance(pkt)
+
+	case data[0] == byte(PacketOK):
+		r.OK = &MySQLOKPacket{}
+		if r.OK.Decode(pkt, r.capabilities) == nil {
+			r.okStatus(r.OK)
+		}
+		r.endOfResult()
+
+	case isEOFPacket(data):
+		r.readStatus(pkt)
+		r.state = stateDone
+
+	case data[0] == byte(PacketLocalInfile) && r.command == PacketComQuery:
+		r.local_infile = true
+
+	case r.command == PacketComQuery || r.command == PacketComStmtExecute || r.command == PacketComProcessInfo:
+		columns, _, err := readLenEncInt(data)
+		if err != nil || columns == 0 {
+			r.state = stateDone
+			return
+		}
+		r.ResultSets++
+		r.remaining = columns
+		r.state = stateColumnDefs
+
+	default:
+		r.state = stateDone
+	}
+}
+
+func (r *ResponseReader) preparedColumns() {
+	r.remaining = r.columns
+	r.state = statePrepareColumns
+	if r.remaining == 0 {
+		r.state = stateDone
+	}
+}
@@ -0,0 +1,305 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// stream encodes payloads as consecutive packets.
+func stream(payloads ...[]byte) *bytes.Reader {
+	buf := []byte{}
+	for i, payload := range payloads {
+		enc, _ := NewGenericPacket(uint8(i+1), payload).Encode()
+		buf = append(buf, enc...)
+	}
+	return bytes.NewReader(buf)
+}
+
+func okPayload(header byte, status uint16) []byte {
+	return []byte{header, 0, 0, byte(status), byte(status >> 8), 0, 0}
+}
+
+func errPayload() []byte {
+	return append([]byte{byte(PacketErr), 0x7a, 0x04, '#'}, "42S02Table 't' doesn't exist"...)
+}
+
+func prepareOKPayload(id uint32, columns, params uint16) []byte {
+	data := make([]byte, 12)
+	binary.LittleEndian.PutUint32(data[1:5], id)
+	binary.LittleEndian.PutUint16(data[5:7], columns)
+	binary.LittleEndian.PutUint16(data[7:9], params)
+	return data
+}
+
+var (
+	columnDef = []byte{3, 'd', 'e', 'f', 0, 0, 0, 1, 'a', 0, 0x0c, 33, 0, 255, 0, 0, 0, 253, 0, 0, 0, 0, 0}
+	row       = []byte{1, '1'}
+)
+
+// resultSet returns the packets of a result set of rows rows, ending with
+// status, as sent with or without CLIENT_DEPRECATE_EOF.
+func resultSet(deprecate_eof bool, rows int, status uint16) [][]byte {
+	payloads := [][]byte{{2}, columnDef, columnDef}
+	if !deprecate_eof {
+		payloads = append(payloads, eofPayload(ServerStatusAutocommit))
+	}
+	for i := 0; i < rows; i++ {
+		payloads = append(payloads, row)
+	}
+	if deprecate_eof {
+		return append(payloads, okPayload(byte(PacketEOF), status))
+	}
+	return append(payloads, eofPayload(status))
+}
+
+func concat(lists ...[][]byte) [][]byte {
+	ret := [][]byte{}
+	for _, list := range lists {
+		ret = append(ret, list...)
+	}
+	return ret
+}
+
+func TestResponseReader(t *testing.T) {
+	long := make([]byte, 0xffffff)
+	// A row with a column of 16M or more starts with 0xfe, like the OK
+	// ending the rows under CLIENT_DEPRECATE_EOF.
+	long[0] = 0xfe
+
+	tests := []struct {
+		name         string
+		command      PacketMagic
+		capabilities CapabilityFlags
+		payloads     [][]byte
+
+		rows        uint64
+		result_sets int
+		status      uint16
+		err         bool
+		statement   uint32
+	}{
+		{
+			name:     "OK",
+			command:  PacketComQuery,
+			payloads: [][]byte{okPayload(byte(PacketOK), ServerStatusAutocommit)},
+			status:   ServerStatusAutocommit,
+		},
+		{
+			name:     "ERR",
+			command:  PacketComQuery,
+			payloads: [][]byte{errPayload()},
+			err:      true,
+		},
+		{
+			name:        "result set",
+			command:     PacketComQuery,
+			payloads:    resultSet(false, 3, ServerStatusAutocommit|ServerStatusInTrans),
+			rows:        3,
+			result_sets: 1,
+			status:      ServerStatusAutocommit | ServerStatusInTrans,
+		},
+		{
+			name:         "result set without EOF",
+			command:      PacketComQuery,
+			capabilities: clientDeprecateEOF,
+			payloads:     resultSet(true, 3, ServerStatusAutocommit|ServerStatusInTrans),
+			rows:         3,
+			result_sets:  1,
+			status:       ServerStatusAutocommit | ServerStatusInTrans,
+		},
+		{
+			name:        "empty result set",
+			command:     PacketComQuery,
+			payloads:    resultSet(false, 0, ServerStatusAutocommit),
+			result_sets: 1,
+			status:      ServerStatusAutocommit,
+		},
+		{
+			name:    "multiple results",
+			command: PacketComQuery,
+			payloads: concat(
+				resultSet(false, 2, ServerMoreResultsExists),
+				resultSet(false, 1, ServerMoreResultsExists),
+				[][]byte{okPayload(byte(PacketOK), ServerStatusAutocommit)},
+			),
+			rows:        3,
+			result_sets: 2,
+			status:      ServerStatusAutocommit,
+		},
+		{
+			name:         "multiple results without EOF",
+			command:      PacketComQuery,
+			capabilities: clientDeprecateEOF,
+			payloads: concat(
+				resultSet(true, 2, ServerMoreResultsExists),
+				[][]byte{okPayload(byte(PacketOK), ServerMoreResultsExists)},
+				resultSet(true, 1, ServerMoreResultsExists),
+				[][]byte{okPayload(byte(PacketOK), ServerStatusAutocommit)},
+			),
+			rows:        3,
+			result_sets: 2,
+			status:      ServerStatusAutocommit,
+		},
+		{
+			name:    "error after a result",
+			command: PacketComQuery,
+			payloads: concat(
+				resultSet(false, 1, ServerMoreResultsExists),
+				[][]byte{errPayload()},
+			),
+			rows:        1,
+			result_sets: 1,
+			status:      ServerMoreResultsExists,
+			err:         true,
+		},
+		{
+			// The rest of the row looks like an EOF packet.
+			name:        "row of 16M",
+			command:     PacketComQuery,
+			payloads:    append(resultSet(false, 0, ServerStatusAutocommit)[:4], long, eofPayload(0), eofPayload(ServerStatusAutocommit)),
+			rows:        1,
+			result_sets: 1,
+			status:      ServerStatusAutocommit,
+		},
+		{
+			// A row of exactly 16M - 1 bytes is followed by an empty packet.
+			name:         "row of 16M without EOF",
+			command:      PacketComQuery,
+			capabilities: clientDeprecateEOF,
+			payloads:     append(resultSet(true, 0, 0)[:3], long, []byte{}, row, okPayload(byte(PacketEOF), ServerStatusAutocommit)),
+			rows:         2,
+			result_sets:  1,
+			status:       ServerStatusAutocommit,
+		},
+		{
+			name:    "prepare",
+			command: PacketComStmtPrepare,
+			payloads: [][]byte{
+				prepareOKPayload(5, 2, 3),
+				columnDef, columnDef, columnDef, eofPayload(ServerStatusAutocommit),
+				columnDef, columnDef, eofPayload(ServerStatusAutocommit),
+			},
+			statement: 5,
+		},
+		{
+			name:         "prepare without EOF",
+			command:      PacketComStmtPrepare,
+			capabilities: clientDeprecateEOF,
+			payloads: [][]byte{
+				prepareOKPayload(6, 2, 3),
+				columnDef, columnDef, columnDef,
+				columnDef, columnDef,
+			},
+			statement: 6,
+		},
+		{
+			name:         "prepare with columns only",
+			command:      PacketComStmtPrepare,
+			capabilities: clientDeprecateEOF,
+			payloads:     [][]byte{prepareOKPayload(7, 2, 0), columnDef, columnDef},
+			statement:    7,
+		},
+		{
+			name:      "prepare with parameters only",
+			command:   PacketComStmtPrepare,
+			payloads:  [][]byte{prepareOKPayload(8, 0, 1), columnDef, eofPayload(ServerStatusAutocommit)},
+			statement: 8,
+		},
+		{
+			name:      "prepare of neither",
+			command:   PacketComStmtPrepare,
+			payloads:  [][]byte{prepareOKPayload(9, 0, 0)},
+			statement: 9,
+		},
+		{
+			name:     "prepare failing",
+			command:  PacketComStmtPrepare,
+			payloads: [][]byte{errPayload()},
+			err:      true,
+		},
+		{
+			name:        "execute",
+			command:     PacketComStmtExecute,
+			payloads:    resultSet(false, 2, ServerStatusAutocommit),
+			rows:        2,
+			result_sets: 1,
+			status:      ServerStatusAutocommit,
+		},
+		{
+			name:        "execute opening a cursor",
+			command:     PacketComStmtExecute,
+			payloads:    append(resultSet(false, 0, 0)[:3], eofPayload(ServerStatusCursorExists)),
+			result_sets: 1,
+			status:      ServerStatusCursorExists,
+		},
+		{
+			name:     "fetch",
+			command:  PacketComStmtFetch,
+			payloads: [][]byte{row, row, eofPayload(ServerStatusCursorExists | ServerStatusLastRowSent)},
+			rows:     2,
+			status:   ServerStatusCursorExists | ServerStatusLastRowSent,
+		},
+		{
+			name:     "field list",
+			command:  PacketComFieldList,
+			payloads: [][]byte{columnDef, columnDef, eofPayload(ServerStatusAutocommit)},
+			status:   ServerStatusAutocommit,
+		},
+		{
+			name:     "statistics",
+			command:  PacketComStatistics,
+			payloads: [][]byte{[]byte("Uptime: 1")},
+		},
+		{
+			name:    "statement close",
+			command: PacketComStmtClose,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := stream(test.payloads...)
+			resp := NewResponseReader(conn, test.command, test.capabilities)
+			read := 0
+			for !resp.Done() {
+				_, err := resp.Next()
+				if err != nil {
+					t.Fatalf("after %d packets: %v", read, err)
+				}
+				read++
+			}
+			if _, err := resp.Next(); err != io.EOF {
+				t.Fatalf("read after the end: %v", err)
+			}
+			if read != len(test.payloads) || conn.Len() != 0 {
+				t.Fatalf("done after %d of %d packets", read, len(test.payloads))
+			}
+			if resp.Rows != test.rows || resp.ResultSets != test.result_sets || resp.StatusFlags != test.status ||
+				(resp.Err != nil) != test.err || resp.StatementId != test.statement {
+				t.Fatalf("rows %d, result sets %d, status %#x, error %v, statement %d",
+					resp.Rows, resp.ResultSets, resp.StatusFlags, resp.Err, resp.StatementId)
+			}
+		})
+	}
+}
+
+func TestResponseReaderLocalInfile(t *testing.T) {
+	// The client sends the file between the request and the OK.
+	conn := stream(append([]byte{byte(PacketLocalInfile)}, "/tmp/data.csv"...), okPayload(byte(PacketOK), ServerStatusAutocommit))
+	resp := NewResponseReader(conn, PacketComQuery, 0)
+	_, err := resp.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.LocalInfile() || resp.Done() {
+		t.Fatal("LOCAL INFILE request not recognized")
+	}
+	_, err = resp.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.LocalInfile() || !resp.Done() || resp.OK == nil {
+		t.Fatalf("not done after the OK")
+	}
+}
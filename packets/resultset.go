@@ -0,0 +1,231 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Character sets sent in column definitions.
+const (
+	charsetUTF8MB4 = 255
+	charsetBinary  = 63
+)
+
+// Column definition flags.
+const (
+	columnFlagBinary uint16 = 0x0080
+	columnFlagNum    uint16 = 0x8000
+)
+
+// Column describes a column of a result set made up by the proxy.
+type Column struct {
+	Name string
+	Type byte // TypeVarString or TypeLongLong
+}
+
+// ResultSet is a text protocol result set made up by the proxy rather than
+// relayed from MySQL, or one the proxy asked MySQL for itself.
+type ResultSet struct {
+	Columns []Column
+	// nil values are sent as NULL
+	Rows [][]*string
+}
+
+func NewResultSet(columns ...Column) *ResultSet {
+	return &ResultSet{Columns: columns}
+}
+
+// AddRow appends a row. Values are strings, integers, booleans (sent as 1
+// or 0) or nil for NULL; anything else is formatted with fmt.
+func (r *ResultSet) AddRow(values ...interface{}) {
+	row := make([]*string, len(values))
+	for i, value := range values {
+		var text string
+		switch value := value.(type) {
+		case nil:
+			continue
+		case string:
+			text = value
+		case bool:
+			text = "0"
+			if value {
+				text = "1"
+			}
+		default:
+			text = fmt.Sprint(value)
+		}
+		row[i] = &text
+	}
+	r.Rows = append(r.Rows, row)
+}
+
+// Encode returns the packets of the result set, numbered from sequence_id,
+// and the sequence id that follows them. capabilities are the client's, to
+// tell whether it expects EOF packets. Rows must fit in one packet.
+func (r *ResultSet) Encode(sequence_id uint8, capabilities CapabilityFlags, status uint16) ([]byte, uint8, error) {
+	buf := []byte{}
+	var err error
+	add := func(data []byte) {
+		if len(data) >= 0xffffff {
+			err = fmt.Errorf("result set packet of %d bytes is too large", len(data))
+		}
+		enc, _ := NewGenericPacket(sequence_id, data).Encode()
+		buf = append(buf, enc...)
+		sequence_id++
+	}
+
+	add(appendLenEncInt(nil, uint64(len(r.Columns))))
+	for _, column := range r.Columns {
+		add(column.encode())
+	}
+	deprecate_eof := capabilities.Has(clientDeprecateEOF)
+	if !deprecate_eof {
+		add(eofPayload(status))
+	}
+	for _, row := range r.Rows {
+		data := []byte{}
+		for _, value := range row {
+			if value == nil {
+				data = append(data, 0xfb)
+				continue
+			}
+			data = appendLenEncString(data, []byte(*value))
+		}
+		add(data)
+	}
+	if deprecate_eof {
+		// an OK packet with the EOF header
+		data := []byte{byte(PacketEOF), 0x00, 0x00, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint16(data[3:5], status)
+		add(data)
+	} else {
+		add(eofPayload(status))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf, sequence_id, nil
+}
+
+// encode returns a Protocol::ColumnDefinition41 payload.
+func (r Column) encode() []byte {
+	charset := uint16(charsetUTF8MB4)
+	length := uint32(1024 * 4)
+	flags := uint16(0)
+	if r.Type != TypeVarString && r.Type != TypeString {
+		charset = charsetBinary
+		length = 21
+		flags = columnFlagBinary | columnFlagNum
+	}
+
+	data := []byte{}
+	data = appendLenEncString(data, []byte("def"))
+	data = appendLenEncString(data, nil) // schema
+	data = appendLenEncString(data, nil) // table
+	data = appendLenEncString(data, nil) // org_table
+	data = appendLenEncString(data, []byte(r.Name))
+	data = appendLenEncString(data, []byte(r.Name))
+	data = append(data, 0x0c)
+
+	fixed := make([]byte, 12)
+	binary.LittleEndian.PutUint16(fixed[0:2], charset)
+	binary.LittleEndian.PutUint32(fixed[2:6], length)
+	fixed[6] = r.Type
+	binary.LittleEndian.PutUint16(fixed[7:9], flags)
+	// decimals and filler stay zero
+	return append(data, fixed...)
+}
+
+func eofPayload(status uint16) []byte {
+	data := []byte{byte(PacketEOF), 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(data[3:5], status)
+	return data
+}
+
+// ReadResultSet reads MySQL's answer to a COM_QUERY of the proxy's own as a
+// text result set, of which only the first is kept. An ERR is returned as
+// the error, an OK as a result set without columns.
+func ReadResultSet(conn io.Reader, capabilities CapabilityFlags) (*ResultSet, error) {
+	resp := NewResponseReader(conn, PacketComQuery, capabilities)
+	result := &ResultSet{}
+	for !resp.Done() {
+		state, rows := resp.state, resp.Rows
+		pkt, err := resp.Next()
+		if err != nil {
+			return nil, err
+		}
+		if resp.ResultSets > 1 || resp.continued {
+			continue
+		}
+		switch {
+		case state == stateColumnDefs && resp.Err == nil:
+			column, err := decodeColumn(pkt.data)
+			if err != nil {
+				return nil, err
+			}
+			result.Columns = append(result.Columns, column)
+		case resp.Rows > rows:
+			row, err := decodeRow(pkt.data, len(result.Columns))
+			if err != nil {
+				return nil, err
+			}
+			result.Rows = append(result.Rows, row)
+		}
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return result, nil
+}
+
+// Value returns the value of the named column in row i, nil for NULL or
+// when there is no such column.
+func (r *ResultSet) Value(i int, name string) *string {
+	for j, column := range r.Columns {
+		if column.Name == name && i < len(r.Rows) {
+			return r.Rows[i][j]
+		}
+	}
+	return nil
+}
+
+func decodeColumn(data []byte) (Column, error) {
+	column := Column{}
+	// catalog, schema, table, org_table, name, org_name
+	position := 0
+	for i := 0; i < 6; i++ {
+		text, n, err := readLenEncString(data[position:])
+		if err != nil {
+			return column, err
+		}
+		if i == 4 {
+			column.Name = string(text)
+		}
+		position += n
+	}
+	// length of the fixed fields, character set, column length, type
+	if len(data) < position+8 {
+		return column, fmt.Errorf("column definition truncated")
+	}
+	column.Type = data[position+7]
+	return column, nil
+}
+
+func decodeRow(data []byte, columns int) ([]*string, error) {
+	row := make([]*string, columns)
+	for i := range row {
+		if len(data) > 0 && data[0] == 0xfb {
+			data = data[1:]
+			continue
+		}
+		value, n, err := readLenEncString(data)
+		if err != nil {
+			return nil, err
+		}
+		text := string(value)
+		row[i] = &text
+		data = data[n:]
+	}
+	return row, nil
+}
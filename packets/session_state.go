@@ -0,0 +1,50 @@
+package packets
+
+// Types of the session state changes OK packets report when the client set
+// CLIENT_SESSION_TRACK.
+const (
+	SessionTrackSystemVariables uint8 = iota
+	SessionTrackSchema
+	SessionTrackStateChange
+	SessionTrackGTIDs
+	SessionTrackTransactionCharacteristics
+	SessionTrackTransactionState
+)
+
+// SessionStateChange is one entry of the session state information of an
+// OK packet.
+type SessionStateChange struct {
+	Type uint8
+	Data []byte
+}
+
+// ParseSessionState splits the session state information of OK packets
+// into its entries.
+func ParseSessionState(state []byte) ([]SessionStateChange, error) {
+	changes := []SessionStateChange{}
+	for len(state) > 0 {
+		data, n, err := readLenEncString(state[1:])
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, SessionStateChange{Type: state[0], Data: data})
+		state = state[1+n:]
+	}
+	return changes, nil
+}
+
+// Variable returns the name and value of a changed system variable.
+func (r SessionStateChange) Variable() (string, string) {
+	if r.Type != SessionTrackSystemVariables {
+		return "", ""
+	}
+	name, n, err := readLenEncString(r.Data)
+	if err != nil {
+		return "", ""
+	}
+	value, _, err := readLenEncString(r.Data[n:])
+	if err != nil {
+		return string(name), ""
+	}
+	return string(name), string(value)
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"o2buzzle/sqlproxy/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// startAdmin serves the admin HTTP API and the MySQL protocol admin
+// listener, whichever are configured. Every HTTP request must carry the
+// configured bearer token.
+func (r *Proxy) startAdmin(cfg *config.AdminConfig) error {
+	if cfg.MySQL != nil {
+		err := r.startMySQLAdmin(cfg.MySQL)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Listen == "" {
+		return nil
+	}
+	if cfg.Token == "" {
+		return errors.New("admin API needs a token")
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: r.adminHandler(cfg.Token)}
+	go func() {
+		var err error
+		if cfg.CertFile != "" {
+			err = server.ServeTLS(ln, cfg.CertFile, cfg.KeyFile)
+		} else {
+			err = server.Serve(ln)
+		}
+		log.Printf("Admin server stopped: %s", err)
+	}()
+	return nil
+}
+
+func (r *Proxy) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", r.adminSessions)
+	mux.HandleFunc("/sessions/", r.adminSession)
+	mux.HandleFunc("/reload", r.adminReload)
+	mux.HandleFunc("/drain", r.adminDrain)
+	mux.HandleFunc("/lockouts", r.adminLockouts)
+	mux.HandleFunc("/digests", r.adminDigests)
+	mux.HandleFunc("/backends", r.adminBackends)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// GET /sessions lists the open sessions.
+func (r *Proxy) adminSessions(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Sessions())
+}
+
+// GET /sessions/<id> describes a session, DELETE /sessions/<id> kills it.
+func (r *Proxy) adminSession(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	if req.Method == http.MethodDelete {
+		if !r.KillSession(id, "killed by administrator") {
+			writeJSONError(w, http.StatusNotFound, "no such session")
+			return
+		}
+		log.Printf("[admin] killed session %d from %s", id, req.RemoteAddr)
+		writeJSON(w, http.StatusOK, map[string]uint64{"killed": id})
+		return
+	}
+	session, ok := r.Session(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// POST /reload reads the configuration file again.
+func (r *Proxy) adminReload(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+	err := r.Reload()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+// POST /drain?timeout=30s stops accepting connections; sessions left after
+// the timeout are killed.
+func (r *Proxy) adminDrain(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+	timeout := time.Duration(0)
+	if value := req.URL.Query().Get("timeout"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid timeout: "+err.Error())
+			return
+		}
+	}
+	err := r.Drain(timeout)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": len(r.Sessions())})
+}
+
+// GET /lockouts lists failure counters, DELETE /lockouts?key=<key> clears
+// one, or all of them without a key.
+func (r *Proxy) adminLockouts(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if req.Method == http.MethodDelete {
+		key := req.URL.Query().Get("key")
+		if !r.ClearLockout(key) && key != "" {
+			writeJSONError(w, http.StatusNotFound, "no such lockout key")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"cleared": key})
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Lockouts())
+}
+
+// GET /digests lists the statement statistics, DELETE /digests resets them.
+func (r *Proxy) adminDigests(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if req.Method == http.MethodDelete {
+		r.ResetDigests()
+		writeJSON(w, http.StatusOK, map[string]bool{"reset": true})
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Digests())
+}
+
+// GET /backends lists the servers of the backends config as last checked.
+func (r *Proxy) adminBackends(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Backends())
+}
+
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,434 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/metrics"
+	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/sqlparse"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminServerVersion is announced in the handshake of the MySQL admin
+// listener.
+const adminServerVersion = "8.0.0-sqlproxy-admin"
+
+// startMySQLAdmin serves the admin statements over the MySQL protocol:
+//
+//	SHOW PROXY SESSIONS
+//	SHOW PROXY USERS
+//	SHOW PROXY STATS
+//	SHOW PROXY BACKENDS
+//	KILL PROXY SESSION <id>
+//	RELOAD PROXY CONFIG
+func (r *Proxy) startMySQLAdmin(cfg *config.AdminMySQLConfig) error {
+	if cfg.Password == "" {
+		return errors.New("MySQL admin listener needs a password")
+	}
+	user := cfg.User
+	if user == "" {
+		user = "admin"
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		id := uint32(0)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("MySQL admin listener stopped: %s", err)
+				return
+			}
+			id++
+			session := &adminSession{proxy: r, conn: conn}
+			go session.serve(id, user, cfg.Password)
+		}
+	}()
+	return nil
+}
+
+// adminSession is a client of the MySQL admin listener.
+type adminSession struct {
+	proxy        *Proxy
+	conn         net.Conn
+	reader       *bufio.Reader
+	capabilities packets.CapabilityFlags
+}
+
+func (r *adminSession) serve(id uint32, user, password string) {
+	defer r.conn.Close()
+	err := r.login(id, user, password)
+	if err != nil {
+		log.Printf("[admin] MySQL login from %s failed: %s", r.conn.RemoteAddr(), err)
+		return
+	}
+	for {
+		pkt, err := packets.ReadPacket(r.reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[admin] MySQL session from %s: %s", r.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		data := pkt.Data()
+		if len(data) == 0 {
+			return
+		}
+		switch packets.PacketMagic(data[0]) {
+		case packets.PacketComQuit:
+			return
+		case packets.PacketComPing, packets.PacketComInitDB:
+			err = r.writeOK(1, 0)
+		case packets.PacketComQuery:
+			err = r.query(string(data[1:]))
+		default:
+			err = r.writeError(1, 1047, "08S01", "Unknown command")
+		}
+		if err != nil {
+			log.Printf("[admin] MySQL session from %s: %s", r.conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// login runs the handshake and checks the client's mysql_native_password
+// response, switching the client to that plugin if it started with another.
+// TLS is offered when the proxy has a certificate, and failed logins count
+// towards the lockout of the client's IP like on the main listener.
+func (r *adminSession) login(id uint32, user, password string) error {
+	lockout_key := ipLockoutKey(r.conn.RemoteAddr())
+	if entry := r.proxy.lockout.Locked(lockout_key); entry != nil {
+		code, message := lockoutError(entry, "", r.conn.RemoteAddr())
+		r.writeError(0, code, "HY000", message)
+		return ErrLockedOut
+	}
+	r.proxy.mutex.RLock()
+	tls_config := r.proxy.tls_config
+	r.proxy.mutex.RUnlock()
+
+	scramble, err := newScramble()
+	if err != nil {
+		return err
+	}
+	handshake := packets.NewHandshakePacket(id, adminServerVersion, scramble)
+	handshake.EnableSSL(tls_config != nil)
+	enc, err := handshake.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.Write(enc)
+	if err != nil {
+		return err
+	}
+
+	// Unbuffered until TLS is set up: the client hello follows at once.
+	auth := &packets.MySQLAuthPacket{}
+	err = auth.Decode(r.conn)
+	if err != nil {
+		return err
+	}
+	if auth.IsSSLRequest() {
+		if tls_config == nil {
+			return errors.New("client requested TLS but none is configured")
+		}
+		tls_conn := tls.Server(r.conn, tls_config)
+		err = tls_conn.Handshake()
+		if err != nil {
+			return err
+		}
+		r.conn = tls_conn
+		err = auth.Decode(r.conn)
+		if err != nil {
+			return err
+		}
+	}
+	r.reader = bufio.NewReader(r.conn)
+	seq := auth.SequenceId()
+	resp := auth.AuthResp
+	if auth.AuthPluginName != "" && auth.AuthPluginName != "mysql_native_password" {
+		enc, err := packets.NewAuthSwitchPacket(seq+1, "mysql_native_password", handshake.AuthPluginData).Encode()
+		if err != nil {
+			return err
+		}
+		_, err = r.conn.Write(enc)
+		if err != nil {
+			return err
+		}
+		pkt, err := packets.ReadPacket(r.reader)
+		if err != nil {
+			return err
+		}
+		seq = pkt.SequenceId()
+		resp = pkt.Data()
+	}
+
+	expected := authn.HashNativePassword(password, handshake.AuthPluginData)
+	if auth.Username != user || subtle.ConstantTimeCompare(resp, expected) != 1 {
+		message := fmt.Sprintf("Access denied for user '%s'@'%s' (using password: %s)",
+			auth.Username, remoteIP(r.conn.RemoteAddr()), usingPassword(resp))
+		time.Sleep(r.proxy.lockout.Failure(lockout_key))
+		err = r.writeError(seq+1, 1045, "28000", message)
+		if err != nil {
+			return err
+		}
+		return authn.ErrBadPassword
+	}
+	r.proxy.lockout.Success(lockout_key)
+	r.capabilities = auth.CapabilityFlags
+	log.Printf("[admin] MySQL login as %s from %s", user, r.conn.RemoteAddr())
+	return r.writeOK(seq+1, 0)
+}
+
+func usingPassword(resp []byte) string {
+	if len(resp) == 0 {
+		return "NO"
+	}
+	return "YES"
+}
+
+// query answers an admin statement.
+func (r *adminSession) query(sql string) error {
+	tokens := sqlparse.Significant(sqlparse.Tokenize(sql))
+	for len(tokens) > 0 && tokens[len(tokens)-1].Text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	switch {
+	case isWords(tokens, "SHOW", "PROXY", "SESSIONS"):
+		return r.writeResult(r.proxy.sessionsResult())
+	case isWords(tokens, "SHOW", "PROXY", "USERS"):
+		result, err := r.proxy.usersResult()
+		if err != nil {
+			return r.writeError(1, 1105, "HY000", err.Error())
+		}
+		return r.writeResult(result)
+	case isWords(tokens, "SHOW", "PROXY", "STATS"):
+		return r.writeResult(r.proxy.statsResult())
+	case isWords(tokens, "SHOW", "PROXY", "BACKENDS"):
+		return r.writeResult(r.proxy.backendsResult())
+	case len(tokens) == 4 && isWords(tokens[:3], "KILL", "PROXY", "SESSION"):
+		id, err := strconv.ParseUint(tokens[3].Text, 10, 64)
+		if err != nil || !r.proxy.KillSession(id, "killed by administrator") {
+			return r.writeError(1, 1094, "HY000", fmt.Sprintf("Unknown thread id: %s", tokens[3].Text))
+		}
+		log.Printf("[admin] killed session %d from %s", id, r.conn.RemoteAddr())
+		return r.writeOK(1, 1)
+	case isWords(tokens, "RELOAD", "PROXY", "CONFIG"):
+		err := r.proxy.Reload()
+		if err != nil {
+			return r.writeError(1, 1105, "HY000", "Reload failed: "+err.Error())
+		}
+		return r.writeOK(1, 0)
+	case len(tokens) >= 2 && tokens[0].Is("SELECT") && strings.EqualFold(tokens[1].Text, "@@version_comment"):
+		// sent by the mysql client on connect
+		result := packets.NewResultSet(packets.Column{Name: "@@version_comment", Type: packets.TypeVarString})
+		result.AddRow("sqlproxy admin")
+		return r.writeResult(result)
+	}
+	return r.writeError(1, 1064, "42000", "Unsupported statement on the admin interface; try SHOW PROXY SESSIONS, SHOW PROXY USERS, SHOW PROXY STATS, SHOW PROXY BACKENDS, KILL PROXY SESSION <id> or RELOAD PROXY CONFIG")
+}
+
+// isWords reports whether tokens are exactly the given keywords.
+func isWords(tokens []sqlparse.Token, words ...string) bool {
+	if len(tokens) != len(words) {
+		return false
+	}
+	for i, word := range words {
+		if !tokens[i].Is(word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *adminSession) writeResult(result *packets.ResultSet) error {
+	enc, _, err := result.Encode(1, r.capabilities, packets.ServerStatusAutocommit)
+	if err != nil {
+		return r.writeError(1, 1105, "HY000", err.Error())
+	}
+	_, err = r.conn.Write(enc)
+	return err
+}
+
+func (r *adminSession) writeOK(sequence_id uint8, affected_rows uint64) error {
+	enc, err := packets.NewOKPacket(sequence_id, affected_rows, packets.ServerStatusAutocommit).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.Write(enc)
+	return err
+}
+
+func (r *adminSession) writeError(sequence_id uint8, code uint16, state, message string) error {
+	enc, err := packets.NewErrPacket(sequence_id, code, state, message).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.Write(enc)
+	return err
+}
+
+// sessionsResult lists the open sessions like SHOW PROCESSLIST.
+func (r *Proxy) sessionsResult() *packets.ResultSet {
+	result := packets.NewResultSet(
+		packets.Column{Name: "Id", Type: packets.TypeLongLong},
+		packets.Column{Name: "User", Type: packets.TypeVarString},
+		packets.Column{Name: "Backend_user", Type: packets.TypeVarString},
+		packets.Column{Name: "Backend_thread", Type: packets.TypeLongLong},
+		packets.Column{Name: "Backend", Type: packets.TypeVarString},
+		packets.Column{Name: "Host", Type: packets.TypeVarString},
+		packets.Column{Name: "db", Type: packets.TypeVarString},
+		packets.Column{Name: "State", Type: packets.TypeVarString},
+		packets.Column{Name: "Command", Type: packets.TypeVarString},
+		packets.Column{Name: "Time", Type: packets.TypeLongLong},
+		packets.Column{Name: "Query_ms", Type: packets.TypeLongLong},
+		packets.Column{Name: "Info", Type: packets.TypeVarString},
+		packets.Column{Name: "Bytes_in", Type: packets.TypeLongLong},
+		packets.Column{Name: "Bytes_out", Type: packets.TypeLongLong},
+		packets.Column{Name: "Pinned", Type: packets.TypeVarString},
+	)
+	for _, session := range r.Sessions() {
+		row := []interface{}{session.Id, nullable(session.ProxyUser), nullable(session.BackendUser),
+			nullableId(session.BackendThread), nullable(session.Backend), session.Client, nullable(session.Database), session.State, nullable(session.Command),
+			int64(time.Since(session.ConnectedAt).Seconds()), nil, nullable(session.Query),
+			session.BytesIn, session.BytesOut, nullable(session.Pinned)}
+		if session.State == "query" {
+			row[10] = session.QueryUs / 1000
+		}
+		result.AddRow(row...)
+	}
+	return result
+}
+
+// usersResult lists the accounts of the password store along with any
+// other user with an open session, such as token or certificate users.
+func (r *Proxy) usersResult() (*packets.ResultSet, error) {
+	r.mutex.RLock()
+	accounts_file := r.config.AccountsFile
+	r.mutex.RUnlock()
+	accounts, err := authn.ReadProxyAccounts(accounts_file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	type usage struct {
+		sessions  int
+		bytes_in  uint64
+		bytes_out uint64
+	}
+	users := map[string]*usage{}
+	for name := range accounts {
+		users[name] = &usage{}
+	}
+	for _, session := range r.Sessions() {
+		if session.ProxyUser == "" {
+			continue
+		}
+		if users[session.ProxyUser] == nil {
+			users[session.ProxyUser] = &usage{}
+		}
+		user := users[session.ProxyUser]
+		user.sessions++
+		user.bytes_in += session.BytesIn
+		user.bytes_out += session.BytesOut
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := packets.NewResultSet(
+		packets.Column{Name: "User", Type: packets.TypeVarString},
+		packets.Column{Name: "Sessions", Type: packets.TypeLongLong},
+		packets.Column{Name: "Bytes_in", Type: packets.TypeLongLong},
+		packets.Column{Name: "Bytes_out", Type: packets.TypeLongLong},
+		packets.Column{Name: "In_store", Type: packets.TypeVarString},
+		packets.Column{Name: "Disabled", Type: packets.TypeVarString},
+		packets.Column{Name: "Expires_at", Type: packets.TypeVarString},
+		packets.Column{Name: "Password_expires_at", Type: packets.TypeVarString},
+	)
+	for _, name := range names {
+		user := users[name]
+		account := accounts[name]
+		if account == nil {
+			result.AddRow(name, user.sessions, user.bytes_in, user.bytes_out, "NO", nil, nil, nil)
+			continue
+		}
+		result.AddRow(name, user.sessions, user.bytes_in, user.bytes_out, "YES", yesNo(account.Disabled),
+			nullable(account.ExpiresAt), nullable(account.PasswordExpiresAt))
+	}
+	return result, nil
+}
+
+// statsResult lists the counters and gauges of /metrics, like SHOW STATUS.
+func (r *Proxy) statsResult() *packets.ResultSet {
+	result := packets.NewResultSet(
+		packets.Column{Name: "Variable_name", Type: packets.TypeVarString},
+		packets.Column{Name: "Value", Type: packets.TypeVarString},
+	)
+	r.metrics.registry.Each(func(s metrics.Sample) {
+		result.AddRow(s.Key(), strconv.FormatFloat(s.Value, 'f', -1, 64))
+	})
+	result.AddRow("sqlproxy_sessions", len(r.Sessions()))
+	result.AddRow("sqlproxy_digests", len(r.Digests()))
+	return result
+}
+
+// backendsResult lists the servers of the backends config as last checked.
+func (r *Proxy) backendsResult() *packets.ResultSet {
+	result := packets.NewResultSet(
+		packets.Column{Name: "Address", Type: packets.TypeVarString},
+		packets.Column{Name: "Role", Type: packets.TypeVarString},
+		packets.Column{Name: "Up", Type: packets.TypeVarString},
+		packets.Column{Name: "Read_only", Type: packets.TypeVarString},
+		packets.Column{Name: "Lag", Type: packets.TypeLongLong},
+		packets.Column{Name: "Error", Type: packets.TypeVarString},
+		packets.Column{Name: "Checked_at", Type: packets.TypeVarString},
+	)
+	for _, backend := range r.Backends() {
+		var lag interface{}
+		if backend.LagSeconds >= 0 {
+			lag = backend.LagSeconds
+		}
+		result.AddRow(backend.Address, backend.Role, yesNo(backend.Up), yesNo(backend.ReadOnly), lag,
+			nullable(backend.Error), backend.CheckedAt.Format("2006-01-02 15:04:05"))
+	}
+	return result
+}
+
+// nullable turns an empty string into NULL.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullableId turns a zero id into NULL.
+func nullableId(id uint32) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "YES"
+	}
+	return "NO"
+}
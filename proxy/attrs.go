@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Connection attributes the proxy adds to the ones it forwards, so that the
+// backend's performance_schema.session_connect_attrs shows who is really
+// behind the shared backend account.
+const (
+	attrProxyUser       = "proxy_user"
+	attrProxyClientAddr = "proxy_client_addr"
+	attrProxyConnId     = "proxy_conn_id"
+)
+
+// ConnectAttr returns a connection attribute sent by the client, such as
+// _client_name or program_name.
+func (r *Connection) ConnectAttr(key string) string {
+	return r.connect_attrs[key]
+}
+
+// clientProgram names the client program as well as its attributes allow.
+func (r *Connection) clientProgram() string {
+	if program := r.ConnectAttr("program_name"); program != "" {
+		return program
+	}
+	return r.ConnectAttr("_client_name")
+}
+
+// forwardedAttrs returns the client's connection attributes with the proxy's
+// own added for proxy_user. Attributes the client sent under the proxy's
+// names are dropped so that they cannot be spoofed.
+func (r *Connection) forwardedAttrs(proxy_user string) map[string]string {
+	attrs := make(map[string]string, len(r.connect_attrs)+3)
+	for key, value := range r.connect_attrs {
+		if strings.HasPrefix(key, "proxy_") {
+			continue
+		}
+		attrs[key] = value
+	}
+	attrs[attrProxyUser] = proxy_user
+	attrs[attrProxyClientAddr] = r.conn.RemoteAddr().String()
+	attrs[attrProxyConnId] = strconv.FormatUint(r.id, 10)
+	return attrs
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"o2buzzle/sqlproxy/audit"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/slowlog"
+	"time"
+)
+
+// authFailureReason classifies an authentication error so that, e.g., a
+// wrong second factor is not reported as a wrong password.
+func authFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrLockedOut):
+		return "locked_out"
+	case errors.Is(err, authn.ErrAccountDisabled):
+		return "account_disabled"
+	case errors.Is(err, authn.ErrAccountExpired):
+		return "account_expired"
+	case errors.Is(err, authn.ErrPasswordExpired):
+		return "password_expired"
+	case errors.Is(err, authn.ErrOutsideAccessWindow):
+		return "outside_access_window"
+	case errors.Is(err, authn.ErrHostNotAllowed):
+		return "host_not_allowed"
+	case errors.Is(err, authn.ErrBadSecondFactor):
+		return "second_factor"
+	case errors.Is(err, authn.ErrReusedCode):
+		return "reused_code"
+	case errors.Is(err, authn.ErrBadPassword):
+		return "password"
+	case errors.Is(err, authn.ErrUnknownUser):
+		return "unknown_user"
+	default:
+		return "other"
+	}
+}
+
+// authError returns the MySQL error a failed login is answered with. Most
+// failures look alike to the client; account states are only revealed once
+// the credentials were right.
+func authError(err error, user string, addr net.Addr) (uint16, string, string) {
+	switch {
+	case errors.Is(err, authn.ErrAccountDisabled):
+		return 3118, "HY000", fmt.Sprintf("Access denied for user '%s'@'%s'. Account is locked.", user, remoteIP(addr))
+	case errors.Is(err, authn.ErrPasswordExpired):
+		return 1862, "HY000", "Your password has expired. To log in you must change it using a client that supports expired passwords."
+	}
+	return 1045, "28000", fmt.Sprintf("Access denied for user '%s'", user)
+}
+
+// logAuthEvent records the outcome of an authentication attempt.
+func (r *Connection) logAuthEvent(client_user, proxy_user string, err error) {
+	record := &audit.Record{
+		Event:       audit.EventAuthSuccess,
+		ProxyUser:   proxy_user,
+		BackendUser: r.proxy_uname,
+		Client:      r.conn.RemoteAddr().String(),
+		ConnId:      r.id,
+	}
+	if err != nil {
+		log.Printf("[audit] event=auth_failure reason=%s user=%q client=%s conn=%d error=%q",
+			authFailureReason(err), client_user, r.conn.RemoteAddr(), r.id, err.Error())
+		record.Event = audit.EventAuthFailure
+		record.ProxyUser = client_user
+		record.BackendUser = ""
+		record.Reason = authFailureReason(err)
+		record.Error = err.Error()
+		r.metrics.auth_failures.With(record.Reason).Inc()
+	} else {
+		log.Printf("[audit] event=auth_success user=%q client=%s conn=%d program=%q", proxy_user, r.conn.RemoteAddr(), r.id, r.clientProgram())
+		r.metrics.auth_successes.With(r.auth_method).Inc()
+		r.countLogin(proxy_user)
+	}
+	r.writeAudit(record)
+}
+
+// logDeniedConnection records a client refused by the global deny list.
+func (r *Proxy) logDeniedConnection(addr net.Addr, id uint64) {
+	log.Printf("[audit] event=connection_denied client=%s conn=%d", addr, id)
+	err := r.audit.Log(&audit.Record{
+		Event:  audit.EventConnectionDenied,
+		Client: addr.String(),
+		ConnId: id,
+	})
+	if err != nil {
+		log.Printf("Failed to write audit record: [%d] %s", id, err.Error())
+	}
+}
+
+// commandRecord starts the audit record of a command from the client, or
+// returns nil for commands that are not audited.
+func (r *Connection) commandRecord(command packets.PacketMagic, pkt *packets.MySQLGenericPacket) *audit.Record {
+	record := &audit.Record{
+		Event:       audit.EventQuery,
+		ProxyUser:   r.proxy_user,
+		BackendUser: r.proxy_uname,
+		Client:      r.conn.RemoteAddr().String(),
+		ConnId:      r.id,
+		Database:    r.database,
+		Command:     command.String(),
+	}
+	data := pkt.Data()
+	switch command {
+	case packets.PacketComQuit, packets.PacketComPing, packets.PacketComStmtSendLongData, packets.PacketComChangeUser:
+		return nil
+	case packets.PacketComQuery:
+		query_pkt := &packets.MySQLCOMQueryPacket{}
+		if query_pkt.Decode(*pkt, r.capabilities) == nil {
+			record.SQL = query_pkt.SQL()
+		}
+	case packets.PacketComStmtPrepare:
+		record.SQL = string(data[1:])
+	case packets.PacketComStmtExecute, packets.PacketComStmtClose, packets.PacketComStmtReset, packets.PacketComStmtFetch:
+		if len(data) >= 5 {
+			record.SQL = r.statements[binary.LittleEndian.Uint32(data[1:5])]
+		}
+	case packets.PacketComInitDB:
+		record.Database = string(data[1:])
+	}
+	return record
+}
+
+// logCommand completes the audit record of a command with the response it
+// got and writes it. The same record feeds the slow log and the statement
+// statistics.
+func (r *Connection) logCommand(record *audit.Record, start time.Time, resp *packets.ResponseReader) {
+	if record == nil {
+		return
+	}
+	duration := time.Since(start)
+	record.Time = start
+	record.DurationUs = duration.Microseconds()
+	r.metrics.latency.With(record.Command).Observe(duration.Seconds())
+	if resp != nil {
+		switch {
+		case resp.Err != nil:
+			record.ErrorCode = resp.Err.ErrorCode
+		case resp.ResultSets > 0:
+			record.Rows = resp.Rows
+		case resp.OK != nil:
+			record.Rows = resp.OK.AffectedRows
+		}
+	}
+	// These go first, before the audit log redacts the SQL.
+	r.logSlowQuery(record, resp)
+	if record.SQL != "" && (record.Command == packets.PacketComQuery.String() || record.Command == packets.PacketComStmtExecute.String()) {
+		r.digests.Add(record.SQL, record.ProxyUser, start, time.Duration(record.DurationUs)*time.Microsecond, record.Rows, record.ErrorCode != 0)
+	}
+	r.writeAudit(record)
+}
+
+func (r *Connection) logSlowQuery(record *audit.Record, resp *packets.ResponseReader) {
+	entry := &slowlog.Entry{
+		Time:        record.Time,
+		Duration:    time.Duration(record.DurationUs) * time.Microsecond,
+		ProxyUser:   record.ProxyUser,
+		BackendUser: record.BackendUser,
+		ClientIP:    remoteIP(r.conn.RemoteAddr()),
+		ConnId:      r.id,
+		Database:    record.Database,
+		Command:     record.Command,
+		SQL:         record.SQL,
+		ErrorCode:   record.ErrorCode,
+	}
+	if resp != nil {
+		entry.RowsSent = resp.Rows
+		if resp.OK != nil {
+			entry.RowsAffected = resp.OK.AffectedRows
+		}
+	}
+	err := r.slow_log.Log(entry)
+	if err != nil {
+		log.Printf("Failed to write slow log entry: [%d] %s", r.id, err.Error())
+	}
+}
+
+func (r *Connection) writeAudit(record *audit.Record) {
+	err := r.audit.Log(record)
+	if err != nil {
+		log.Printf("Failed to write audit record: [%d] %s", r.id, err.Error())
+	}
+}
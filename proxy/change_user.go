@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/packets"
+	"time"
+)
+
+// changeUser handles COM_CHANGE_USER. The new user is authenticated by the
+// proxy like a new connection and MySQL is asked to change to the backend
+// account, so the client never reaches MySQL with its own credentials. A
+// failed change ends the session, as MySQL does.
+func (r *Connection) changeUser(pkt *packets.MySQLGenericPacket) error {
+	change_pkt := &packets.MySQLChangeUserPacket{}
+	err := change_pkt.Decode(pkt, r.capabilities)
+	if err != nil {
+		r.metrics.decode_errors.With("change_user").Inc()
+		return err
+	}
+	auth_pkt := change_pkt.AuthPacket()
+	r.auth_seq = pkt.SequenceId()
+	if change_pkt.ConnectAttrs != nil {
+		r.connect_attrs = change_pkt.ConnectAttrs
+	}
+
+	lockout_keys := []string{userLockoutKey(change_pkt.Username), ipLockoutKey(r.conn.RemoteAddr())}
+	if entry := r.lockout.Locked(lockout_keys...); entry != nil {
+		err = fmt.Errorf("%w: %s", ErrLockedOut, entry.Key)
+		r.logAuthEvent(change_pkt.Username, "", err)
+		code, message := lockoutError(entry, change_pkt.Username, r.conn.RemoteAddr())
+		r.writeError(r.auth_seq+1, code, "HY000", message)
+		return err
+	}
+
+	r.account = nil
+	r.groups = nil
+	proxy_user, err := r.authenticate(auth_pkt, r.auth_random)
+	// The password sandbox only runs right after connecting.
+	if err == nil && r.must_change_password {
+		err = fmt.Errorf("%w: %s", authn.ErrPasswordExpired, proxy_user)
+	}
+	r.logAuthEvent(change_pkt.Username, proxy_user, err)
+	if err != nil {
+		// A reused code comes with the password and is no guess.
+		if !errors.Is(err, authn.ErrReusedCode) {
+			time.Sleep(r.lockout.Failure(lockout_keys...))
+		}
+		code, state, message := authError(err, change_pkt.Username, r.conn.RemoteAddr())
+		r.writeError(r.auth_seq+1, code, state, message)
+		return err
+	}
+	r.lockout.Success(lockout_keys...)
+
+	change_pkt.Username = r.proxy_uname
+	change_pkt.AuthResp = authn.HashNativePassword(r.proxy_pass, r.backend_random)
+	change_pkt.AuthPluginName = "mysql_native_password"
+	change_pkt.ConnectAttrs = r.forwardedAttrs(proxy_user)
+	change_pkt.SetSequenceId(0)
+	enc, err := change_pkt.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = r.mysql.Write(enc)
+	if err != nil {
+		return err
+	}
+
+	err = r.relayAuthResult(r.auth_seq)
+	if err != nil {
+		log.Printf("MySQL change user failed: [%d] %s", r.id, err.Error())
+		return err
+	}
+
+	log.Printf("Changed user from %s to %s: [%d]", r.proxy_user, proxy_user, r.id)
+	r.proxy_user = proxy_user
+	r.database = change_pkt.Database
+	r.statements = map[uint32]string{}
+	// MySQL starts the session afresh.
+	r.pinned = ""
+	r.in_trans = false
+	if r.backend != nil {
+		r.backend.database = r.database
+		r.backend.identity = ""
+	}
+	err = r.setSessionIdentity()
+	if err != nil {
+		return err
+	}
+	return r.armSessionDeadline()
+}
@@ -0,0 +1,405 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/sqlparse"
+	"sync"
+	"time"
+)
+
+// serve runs the command phase of the session. Each command from the client
+// is forwarded to MySQL and its whole response is relayed back before the
+// next command is read.
+func (r *Connection) serve() error {
+	for {
+		r.handBack()
+		r.publishSession("idle")
+		r.reusable = true
+		r.continued = nil
+		err := r.startWaiting()
+		if err != nil {
+			return err
+		}
+		pkt, err := packets.ReadPacket(r.client_reader)
+		r.stopWaiting()
+		if err != nil {
+			return err
+		}
+		r.reusable = false
+		r.followPools()
+		data := pkt.Data()
+		if len(data) == 0 {
+			return fmt.Errorf("empty command packet")
+		}
+		command := packets.PacketMagic(data[0])
+		r.metrics.commands.With(command.String()).Inc()
+		start := time.Now()
+		record := r.commandRecord(command, pkt)
+		if record != nil {
+			r.publishCommand(record.Command, record.SQL, start)
+		} else {
+			r.publishCommand(command.String(), "", start)
+		}
+		if record != nil && !r.audit.Accepting() {
+			log.Printf("Refusing command, audit log unavailable: [%d]", r.id)
+			err = r.skipContinued(pkt)
+			if err != nil {
+				return err
+			}
+			if !command.HasResponse() {
+				continue
+			}
+			err = r.writeError(pkt.SequenceId()+1, 3164, "HY000", "Aborted by Audit API ('audit log unavailable';1).")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		route := r.pool
+		switch command {
+		case packets.PacketComQuit:
+			// A pooled connection stays open for the next session.
+			if r.backend != nil || r.multiplex {
+				r.reusable = true
+				return io.EOF
+			}
+		case packets.PacketComChangeUser:
+			ok, err := r.holdBackend(r.pool, pkt.SequenceId(), record, start)
+			if err != nil || !ok {
+				return err
+			}
+			err = r.changeUser(pkt)
+			if err != nil {
+				return err
+			}
+			continue
+		case packets.PacketComBinlogDump, packets.PacketComBinlogDumpGTID:
+			// The binlog is streamed until either side hangs up.
+			ok, err := r.holdBackend(r.pool, pkt.SequenceId(), record, start)
+			if err != nil || !ok {
+				return err
+			}
+			r.logCommand(record, start, nil)
+			return r.passthrough(pkt)
+		case packets.PacketComProcessKill:
+			pkt, err = r.translateProcessKill(pkt, record, start)
+			if err != nil {
+				return err
+			}
+			if pkt == nil {
+				continue
+			}
+		case packets.PacketComStmtPrepare:
+			done, err := r.refusePreparedKill(pkt, record, start)
+			if err != nil {
+				return err
+			}
+			if done {
+				continue
+			}
+		case packets.PacketComQuery:
+			pkt, err = r.translateQuery(pkt, record, start)
+			if err != nil {
+				return err
+			}
+			if pkt == nil {
+				continue
+			}
+			route = r.routeQuery(pkt)
+			pkt, err = r.tagQuery(pkt)
+			if err != nil {
+				log.Printf("Refusing query: [%d] %s", r.id, err.Error())
+				record.ErrorCode = 1105
+				r.logCommand(record, start, nil)
+				err = r.writeError(pkt.SequenceId()+1, 1105, "HY000", "Query refused by proxy: "+err.Error())
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		ok, err := r.holdBackend(route, pkt.SequenceId(), record, start)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = r.forwardCommand(pkt)
+		if err != nil {
+			return err
+		}
+		if command == packets.PacketComQuit {
+			return io.EOF
+		}
+		resp, err := r.relayResponse(command)
+		if err != nil {
+			return err
+		}
+		r.trackSession(command, data, resp)
+		r.followTransaction(command, data, resp)
+		r.logCommand(record, start, resp)
+		// Resetting the connection clears the user variables.
+		if command == packets.PacketResetConnection && resp.OK != nil {
+			err = r.setSessionIdentity()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// trackSession follows the changes a command makes to the session: the
+// current database and the prepared statements. data is the command as the
+// client sent it.
+func (r *Connection) trackSession(command packets.PacketMagic, data []byte, resp *packets.ResponseReader) {
+	switch command {
+	case packets.PacketComStmtClose:
+		if len(data) >= 5 {
+			delete(r.statements, binary.LittleEndian.Uint32(data[1:5]))
+		}
+		return
+	case packets.PacketResetConnection:
+		if resp.OK != nil {
+			r.statements = map[uint32]string{}
+			if r.backend != nil {
+				r.backend.identity = ""
+			}
+		}
+		return
+	}
+	if resp.Err != nil {
+		return
+	}
+
+	switch command {
+	case packets.PacketComInitDB:
+		r.useDatabase(string(data[1:]))
+	case packets.PacketComQuery:
+		query_pkt := &packets.MySQLCOMQueryPacket{}
+		if query_pkt.Decode(*packets.NewGenericPacket(0, data), r.capabilities) != nil {
+			return
+		}
+		if database, ok := sqlparse.UseDatabase(query_pkt.SQL()); ok {
+			r.useDatabase(database)
+		}
+	case packets.PacketComStmtPrepare:
+		r.statements[resp.StatementId] = string(data[1:])
+	}
+}
+
+func (r *Connection) useDatabase(database string) {
+	r.database = database
+	if r.backend != nil {
+		r.backend.database = database
+	}
+}
+
+// setSessionIdentity sets the identity user variables on the backend session
+// when tagging is done that way. The response is not relayed, the client
+// never sees the statement.
+func (r *Connection) setSessionIdentity() error {
+	if r.tagger.mode != tagSessionVariables {
+		return nil
+	}
+	sql := r.tagger.sessionSQL(r)
+	// A pooled connection may have them set already.
+	if r.backend != nil && r.backend.identity == sql {
+		return nil
+	}
+	data, err := packets.NewCOMQueryPacket(sql, r.capabilities).EncodeData()
+	if err != nil {
+		return err
+	}
+	enc, err := packets.NewGenericPacket(0, data).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = r.mysql.Write(enc)
+	if err != nil {
+		return err
+	}
+
+	resp := packets.NewResponseReader(r.server, packets.PacketComQuery, r.capabilities)
+	for !resp.Done() {
+		_, err = resp.Next()
+		if err != nil {
+			return err
+		}
+	}
+	if resp.Err != nil {
+		return fmt.Errorf("failed to set session identity: %w", resp.Err)
+	}
+	if r.backend != nil {
+		r.backend.identity = sql
+	}
+	return nil
+}
+
+// tagQuery marks a COM_QUERY with the client behind it.
+func (r *Connection) tagQuery(pkt *packets.MySQLGenericPacket) (*packets.MySQLGenericPacket, error) {
+	// Queries that span several packets are left alone.
+	if len(pkt.Data()) >= 0xffffff {
+		return pkt, nil
+	}
+	query_pkt := &packets.MySQLCOMQueryPacket{}
+	err := query_pkt.Decode(*pkt, r.capabilities)
+	if err != nil {
+		r.metrics.decode_errors.With("query").Inc()
+		return pkt, err
+	}
+	if r.tagger.mode == tagSessionVariables {
+		return pkt, nil
+	}
+	if r.tagger.mode == tagQueryAttributes && query_pkt.AttributesEnabled() {
+		// The client cannot pass off attributes of its own as the proxy's.
+		query_pkt.RemoveAttributes("proxy_")
+		for _, attr := range r.tagger.attributes(query_pkt.SQL(), r) {
+			query_pkt.SetAttribute(attr)
+		}
+	} else {
+		sql, err := r.tagger.tag(query_pkt.SQL(), r)
+		if err != nil {
+			return pkt, err
+		}
+		query_pkt.SetSQL(sql)
+	}
+	data, err := query_pkt.EncodeData()
+	if err != nil || len(data) >= 0xffffff {
+		return pkt, nil
+	}
+	return packets.NewGenericPacket(pkt.SequenceId(), data), nil
+}
+
+// forwardCommand sends a command to MySQL, along with the packets that carry
+// the rest of it when it is 16M or more.
+func (r *Connection) forwardCommand(pkt *packets.MySQLGenericPacket) error {
+	for {
+		enc, err := pkt.Encode()
+		if err != nil {
+			return err
+		}
+		_, err = r.mysql.Write(enc)
+		if err != nil {
+			return err
+		}
+		if len(pkt.Data()) < 0xffffff {
+			return nil
+		}
+		if len(r.continued) > 0 {
+			pkt, r.continued = r.continued[0], r.continued[1:]
+			continue
+		}
+		pkt, err = packets.ReadPacket(r.client_reader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipContinued reads and drops the packets that carry the rest of a
+// command of 16M or more, which the proxy answers itself.
+func (r *Connection) skipContinued(pkt *packets.MySQLGenericPacket) error {
+	if r.continued != nil {
+		r.continued = nil
+		return nil
+	}
+	for len(pkt.Data()) >= 0xffffff {
+		var err error
+		pkt, err = packets.ReadPacket(r.client_reader)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relayResponse relays MySQL's response to command back to the client,
+// including the file contents the client sends for LOAD DATA LOCAL INFILE.
+func (r *Connection) relayResponse(command packets.PacketMagic) (*packets.ResponseReader, error) {
+	resp := packets.NewResponseReader(r.server, command, r.capabilities)
+	for !resp.Done() {
+		pkt, err := resp.Next()
+		if err != nil {
+			return nil, err
+		}
+		enc, err := pkt.Encode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = r.client.Write(enc)
+		if err != nil {
+			return nil, err
+		}
+		if resp.LocalInfile() {
+			err = r.relayLocalInfile()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return resp, r.client.Flush()
+}
+
+// relayLocalInfile forwards the file contents the client sends after a LOCAL
+// INFILE request, up to and including the empty packet that ends them.
+func (r *Connection) relayLocalInfile() error {
+	err := r.client.Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		pkt, err := packets.ReadPacket(r.client_reader)
+		if err != nil {
+			return err
+		}
+		enc, err := pkt.Encode()
+		if err != nil {
+			return err
+		}
+		_, err = r.mysql.Write(enc)
+		if err != nil {
+			return err
+		}
+		if len(pkt.Data()) == 0 {
+			return nil
+		}
+	}
+}
+
+// passthrough forwards pkt and then copies both directions unchanged until
+// one of them is closed.
+func (r *Connection) passthrough(pkt *packets.MySQLGenericPacket) error {
+	err := r.forwardCommand(pkt)
+	if err != nil {
+		return err
+	}
+	err = r.client.Flush()
+	if err != nil {
+		return err
+	}
+
+	var once sync.Once
+	done := make(chan error, 2)
+	finish := func(err error) {
+		once.Do(r.Close)
+		done <- err
+	}
+	go func() {
+		_, err := io.Copy(r.conn, r.server)
+		finish(err)
+	}()
+	go func() {
+		_, err := io.Copy(r.mysql, r.client_reader)
+		finish(err)
+	}()
+	err = <-done
+	<-done
+	return err
+}
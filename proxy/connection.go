@@ -1,61 +1,172 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"o2buzzle/sqlproxy/audit"
 	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/config"
 	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/slowlog"
+	"strings"
+	"sync"
+	"time"
 )
 
-func NewConnection(host string, port string, conn net.Conn, id uint64, proxy_uname, proxy_pass string) *Connection {
-	return &Connection{
-		host:        host,
-		port:        port,
-		conn:        conn,
-		id:          id,
-		proxy_uname: proxy_uname,
-		proxy_pass:  proxy_pass,
+func NewConnection(proxy *Proxy, conn net.Conn, id uint64) *Connection {
+	proxy.mutex.RLock()
+	defer proxy.mutex.RUnlock()
+	r := &Connection{
+		proxy:        proxy,
+		multiplex:    proxy.pool != nil && proxy.pool.multiplexing(),
+		address:      proxy.address,
+		id:           id,
+		proxy_uname:  proxy.proxy_uname,
+		proxy_pass:   proxy.proxy_pass,
+		tls_config:   proxy.tls_config,
+		tls_settings: proxy.config.TLS,
+		jwt:          proxy.jwt_verifier,
+		accounts:     proxy.config.AccountsFile,
+		lockout:      proxy.lockout,
+		totp_steps:   proxy.totp_steps,
+		tagger:       proxy.tagger,
+		audit:        proxy.audit,
+		slow_log:     proxy.slow_log,
+		digests:      proxy.digests,
+		metrics:      proxy.metrics,
+		pool:         proxy.pool,
+		replicas:     proxy.replicas,
+		reads:        id,
+		statements:   map[uint32]string{},
+		status:       newSessionStatus(conn),
 	}
+	// Bytes are counted below TLS, as they go over the wire.
+	r.conn = proxy.metrics.countClient(conn, r.status)
+	r.client = newPacketWriter(r.conn)
+	return r
 }
 
 type Connection struct {
-	id          uint64
-	conn        net.Conn
-	host        string
-	port        string
-	proxy_uname string
-	proxy_pass  string
-}
+	id uint64
+	// for looking up the other sessions
+	proxy *Proxy
+	conn  net.Conn
+	// MySQL server the session connects to without a pool
+	address      string
+	proxy_uname  string
+	proxy_pass   string
+	tls_config   *tls.Config
+	tls_settings *config.TLSConfig
+	jwt          *authn.JWTVerifier
+	accounts     string
+	lockout      *Lockout
+	totp_steps   *authn.TOTPSteps
+	tagger       *identityTagger
+	audit        *audit.Logger
+	slow_log     *slowlog.Logger
+	digests      *Digests
+	metrics      *proxyMetrics
+	// nil when every session connects to MySQL on its own
+	pool *backendPool
+	// pools of the replicas, which take turns answering reads
+	replicas []*backendPool
+	reads    uint64
+	// set when the session hands its backend connection back between
+	// transactions, see multiplex.go
+	multiplex bool
+	pool_key  poolKey
+	backend   *backendConn
+	// guards mysql and closed, which Close uses from other goroutines
+	backend_mutex sync.Mutex
+	closed        bool
+	mysql         net.Conn
+	// buffered sides of conn and mysql used once the handshake is done
+	client        *packetWriter
+	client_reader *bufio.Reader
+	server        *bufio.Reader
+	// packets carrying the rest of a command of 16M or more, read ahead of
+	// forwarding it
+	continued []*packets.MySQLGenericPacket
 
-const MAX_PACKET_LENGTH = 16 * 1024 * 1024
+	proxy_user string
+	// user the session is counted as active for
+	active_user *string
+	// what the admin interfaces see of the session
+	status *sessionStatus
+	// connection attributes as sent by the client
+	connect_attrs map[string]string
+	capabilities  packets.CapabilityFlags
+	database      string
+	// SQL text of the prepared statements, by statement id
+	statements  map[uint32]string
+	auth_random []byte
+	// thread id of the backend connection, which the client does not see,
+	// and the scramble it got from MySQL
+	backend_thread uint32
+	backend_random []byte
+	// set while waiting for the next command, when the backend connection
+	// can be reset and handed to another session
+	reusable bool
+	// why a multiplexed session keeps its backend connection, if it must,
+	// and whether MySQL reported a transaction open
+	pinned   string
+	in_trans bool
+	// last id MySQL generated for the session, answering LAST_INSERT_ID()
+	// on another connection
+	last_insert_id uint64
+	// guards deadline, waiting and expired, which the deadline timer uses
+	idle_mutex sync.Mutex
+	deadline   *time.Timer
+	// set while serve waits for the next command
+	waiting bool
+	// why the session ends once its command is done, if it has to
+	expired     string
+	account     *authn.ProxyAccount
+	auth_method string
+	groups      []string
+	// set when the password has expired and the client can only change it
+	must_change_password bool
+	// sequence id of the last packet received from the client while
+	// authenticating
+	auth_seq uint8
+}
 
 func (r *Connection) Handle() error {
-	address := fmt.Sprintf("%s%s", r.host, r.port)
-	mysql, err := net.Dial("tcp", address)
-	if err != nil {
-		log.Printf("Failed to connection to MySQL: [%d] %s", r.id, err.Error())
-		return err
+	if entry := r.lockout.Locked(ipLockoutKey(r.conn.RemoteAddr())); entry != nil {
+		r.logAuthEvent("", "", ErrLockedOut)
+		code, message := lockoutError(entry, "", r.conn.RemoteAddr())
+		r.writeError(0, code, "HY000", message)
+		return ErrLockedOut
 	}
-	handshake_pkt := &packets.MySQLHandshakePacket{}
-	err = handshake_pkt.Decode(mysql)
+
+	handshake_pkt, err := r.greeting()
 	if err != nil {
-		log.Printf("Failed to decode handshake packet: [%d] %s", r.id, err.Error())
 		return err
 	}
 	//log.Printf("Handshake packet: [%d] %s", r.id, handshake_pkt.String())
 	//fmt.Printf("Authentication Data: %s\n", handshake_pkt.AuthPluginData)
 	auth_random := handshake_pkt.AuthPluginData
+	r.auth_random = auth_random
+	handshake_pkt.ConnectionId = uint32(r.id)
+
+	// TLS towards the client is terminated here, so only offer it when we
+	// have a certificate of our own, whatever the backend supports.
+	handshake_pkt.EnableSSL(r.tls_config != nil)
+	handshake_pkt.DisableCompression()
 
 	enc, err := handshake_pkt.Encode()
 	if err != nil {
 		log.Printf("Failed to encode handshake packet: [%d] %s", r.id, err.Error())
 		return err
 	}
-	_, err = r.conn.Write(enc)
-
+	err = r.writeClient(enc)
 	if err != nil {
 		log.Printf("Failed to write handshake packet: [%d] %s", r.id, err.Error())
 		return err
@@ -64,95 +175,563 @@ func (r *Connection) Handle() error {
 	handshake_auth_pkt := &packets.MySQLAuthPacket{}
 	err = handshake_auth_pkt.Decode(r.conn)
 	if err != nil {
+		r.metrics.decode_errors.With("auth").Inc()
 		log.Printf("Failed to decode handshake auth packet: [%d] %s", r.id, err.Error())
 		return err
 	}
+
+	if handshake_auth_pkt.IsSSLRequest() {
+		if r.tls_config == nil {
+			log.Printf("Client requested TLS but none is configured: [%d]", r.id)
+			return fmt.Errorf("Client requested TLS but none is configured")
+		}
+		tls_conn := tls.Server(r.conn, r.tls_config)
+		err = tls_conn.Handshake()
+		if err != nil {
+			log.Printf("TLS handshake failed: [%d] %s", r.id, err.Error())
+			return err
+		}
+		r.conn = tls_conn
+		r.client = newPacketWriter(tls_conn)
+
+		err = handshake_auth_pkt.Decode(r.conn)
+		if err != nil {
+			r.metrics.decode_errors.With("auth").Inc()
+			log.Printf("Failed to decode handshake auth packet: [%d] %s", r.id, err.Error())
+			return err
+		}
+	}
 	//log.Printf("Handshake auth packet: [%d] %s", r.id, handshake_auth_pkt.String())
+	r.auth_seq = handshake_auth_pkt.SequenceId()
+	r.client_reader = bufio.NewReader(r.conn)
+	r.connect_attrs = handshake_auth_pkt.ConnectAttrs
+	r.database = handshake_auth_pkt.Database
 
-	proxy_user := handshake_auth_pkt.Username
-	//fmt.Printf("Authentication Response (hex): %x\n", handshake_auth_pkt.AuthResp)
+	lockout_keys := []string{userLockoutKey(handshake_auth_pkt.Username), ipLockoutKey(r.conn.RemoteAddr())}
+	if entry := r.lockout.Locked(lockout_keys...); entry != nil {
+		err = fmt.Errorf("%w: %s", ErrLockedOut, entry.Key)
+		r.logAuthEvent(handshake_auth_pkt.Username, "", err)
+		code, message := lockoutError(entry, handshake_auth_pkt.Username, r.conn.RemoteAddr())
+		r.writeError(r.auth_seq+1, code, "HY000", message)
+		return err
+	}
 
-	// Verify it on our own, then replace with what the proxy will use
-	user_password, err := authn.ReadProxyPassword("proxyauthn.json", proxy_user)
+	proxy_user, err := r.authenticate(handshake_auth_pkt, auth_random)
+	r.logAuthEvent(handshake_auth_pkt.Username, proxy_user, err)
 	if err != nil {
-		log.Printf("Failed to read proxy password: [%d] %s", r.id, err.Error())
+		// A reused code comes with the password and is no guess.
+		if !errors.Is(err, authn.ErrReusedCode) {
+			time.Sleep(r.lockout.Failure(lockout_keys...))
+		}
+		code, state, message := authError(err, handshake_auth_pkt.Username, r.conn.RemoteAddr())
+		r.writeError(r.auth_seq+1, code, state, message)
 		return err
 	}
-	fmt.Printf("Proxy Password: %s\n", user_password)
-	if user_password == "" {
-		log.Printf("Failed to find user password for %s", proxy_user)
-		return fmt.Errorf("Failed to find user password for %s", proxy_user)
+
+	r.lockout.Success(lockout_keys...)
+	r.proxy_user = proxy_user
+
+	if r.pool != nil {
+		err = r.checkoutBackend(handshake_auth_pkt)
+	} else {
+		err = r.loginBackend(handshake_pkt, handshake_auth_pkt)
+	}
+	if err != nil {
+		log.Printf("MySQL authentication failed: [%d] %s", r.id, err.Error())
+		return err
 	}
 
-	hashed_pw := authn.HashNativePassword(user_password, auth_random)
-	//fmt.Printf("Hashed Password: %x\n", hashed_pw)
-	//fmt.Printf("Handshake auth packet: %x\n", handshake_auth_pkt.AuthResp)
+	err = r.setSessionIdentity()
+	if err != nil {
+		log.Printf("Failed to set session identity: [%d] %s", r.id, err.Error())
+		return err
+	}
 
-	res := bytes.Compare(hashed_pw, handshake_auth_pkt.AuthResp)
-	if res != 0 {
-		log.Printf("Failed to verify proxy password for %s", proxy_user)
-		return fmt.Errorf("Failed to verify proxy password for %s", proxy_user)
+	if r.must_change_password {
+		r.publishSession("password_change")
+		quit, err := r.runPasswordSandbox(proxy_user)
+		if err != nil || quit {
+			return err
+		}
 	}
 
-	// Replace the auth response with the one that the proxy will use
+	err = r.armSessionDeadline()
+	if err != nil {
+		return err
+	}
+	defer r.stopSessionDeadline()
 
-	handshake_auth_pkt.Username = r.proxy_uname
-	handshake_auth_pkt.AuthResp = authn.HashNativePassword(r.proxy_pass, auth_random)
+	err = r.serve()
+	if err != nil && err != io.EOF {
+		log.Printf("Connection error: [%d] %s", r.id, err.Error())
+		return err
+	}
 
-	enc, err = handshake_auth_pkt.Encode()
+	log.Printf("Connection closed: [%d]", r.id)
+	return nil
+}
+
+// greeting returns the handshake for the client. Without a pool, it is the
+// one of a new connection to MySQL, which then waits for the client's
+// credentials.
+func (r *Connection) greeting() (*packets.MySQLHandshakePacket, error) {
+	if r.pool != nil {
+		handshake_pkt, err := r.pool.greeting()
+		if err != nil {
+			log.Printf("Failed to connection to MySQL: [%d] %s", r.id, err.Error())
+		}
+		return handshake_pkt, err
+	}
+
+	mysql, err := net.Dial("tcp", r.address)
+	if err != nil {
+		log.Printf("Failed to connection to MySQL: [%d] %s", r.id, err.Error())
+		r.metrics.dial_errors.Inc()
+		return nil, err
+	}
+	r.backend_mutex.Lock()
+	r.mysql = r.metrics.countBackend(mysql)
+	r.backend_mutex.Unlock()
+	r.server = bufio.NewReader(r.mysql)
+	handshake_pkt := &packets.MySQLHandshakePacket{}
+	err = handshake_pkt.Decode(r.server)
+	if err != nil {
+		r.metrics.decode_errors.With("handshake").Inc()
+		log.Printf("Failed to decode handshake packet: [%d] %s", r.id, err.Error())
+		return nil, err
+	}
+	r.backend_thread = handshake_pkt.ConnectionId
+	r.backend_random = handshake_pkt.AuthPluginData
+	return handshake_pkt, nil
+}
+
+// loginBackend logs in to the connection opened by greeting, replacing the
+// client's credentials with the backend account's, and relays the result.
+func (r *Connection) loginBackend(handshake_pkt *packets.MySQLHandshakePacket, auth_pkt *packets.MySQLAuthPacket) error {
+	auth_pkt.Username = r.proxy_uname
+	auth_pkt.AuthResp = authn.HashNativePassword(r.proxy_pass, r.backend_random)
+	auth_pkt.DisableSSL()
+	auth_pkt.DisableCompression()
+	auth_pkt.SetSequenceId(1)
+	if handshake_pkt.SupportsConnectAttrs() {
+		auth_pkt.SetConnectAttrs(r.forwardedAttrs(r.proxy_user))
+	}
+	r.capabilities = auth_pkt.CapabilityFlags
+
+	enc, err := auth_pkt.Encode()
 	if err != nil {
 		log.Printf("Failed to encode handshake auth packet: [%d] %s", r.id, err.Error())
 		return err
 	}
+	_, err = r.mysql.Write(enc)
+	if err != nil {
+		log.Printf("Failed to write handshake auth packet: [%d] %s", r.id, err.Error())
+		return err
+	}
+	return r.relayAuthResult(r.auth_seq)
+}
 
-	_, err = mysql.Write(enc)
+// checkoutBackend takes a connection from the pool in place of logging in,
+// switches it to the client's database and tells the client it is in.
+func (r *Connection) checkoutBackend(auth_pkt *packets.MySQLAuthPacket) error {
+	r.capabilities = auth_pkt.SessionCapabilities()
+	r.pool_key = poolKey{capabilities: r.capabilities, charset: auth_pkt.CharacterSet}
+	err := r.acquireBackend(r.pool)
+	var err_pkt *packets.MySQLErrPacket
+	if errors.As(err, &err_pkt) {
+		r.reusable = true
+		r.writeError(r.auth_seq+1, err_pkt.ErrorCode, err_pkt.SQLState, err_pkt.ErrorMessage)
+		return err
+	}
+	if err != nil {
+		r.writeError(r.auth_seq+1, 1040, "08004", "Too many connections")
+		return err
+	}
+	return r.writeOK(r.auth_seq+1, 0)
+}
 
-	go func() {
-		buf := make([]byte, MAX_PACKET_LENGTH)
-		for {
-			n, err := mysql.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					log.Printf("MySQL connection closed: [%d] %s", r.id, err.Error())
-					return
-				}
-				log.Printf("Error reading from MySQL: [%d] %s", r.id, err.Error())
-				return
-			}
-			log.Default().Printf("MySQL --> %s:\n", proxy_user)
-			// packets.DecodePackets(buf[:n], false)
-			r.conn.Write(buf[:n])
+// armSessionDeadline schedules the end of the session for when the access
+// window of its account closes or the account expires.
+func (r *Connection) armSessionDeadline() error {
+	r.stopSessionDeadline()
+	if r.account == nil {
+		return nil
+	}
+	deadline, err := r.account.SessionDeadline(time.Now())
+	if err != nil || deadline.IsZero() {
+		return err
+	}
+	r.idle_mutex.Lock()
+	defer r.idle_mutex.Unlock()
+	r.deadline = time.AfterFunc(time.Until(deadline), func() {
+		r.expire("access window closed or account expired")
+	})
+	return nil
+}
+
+func (r *Connection) stopSessionDeadline() {
+	r.idle_mutex.Lock()
+	defer r.idle_mutex.Unlock()
+	r.expired = ""
+	if r.deadline != nil {
+		r.deadline.Stop()
+		r.deadline = nil
+	}
+}
+
+// expire ends the session for reason: at once if it is waiting for a
+// command, or else once the command is done, so that its response is not
+// cut short.
+func (r *Connection) expire(reason string) {
+	r.idle_mutex.Lock()
+	defer r.idle_mutex.Unlock()
+	r.expired = reason
+	if r.waiting {
+		r.killLocked(reason)
+	}
+}
+
+// startWaiting marks the session as waiting for the next command. It tells
+// the client the session is over and returns io.EOF instead if it expired
+// while the last command ran or, should the timer be late, the account is no
+// longer active.
+func (r *Connection) startWaiting() error {
+	r.idle_mutex.Lock()
+	defer r.idle_mutex.Unlock()
+	reason := r.expired
+	if reason == "" && r.account != nil && r.account.CheckActive(time.Now()) != nil {
+		reason = "access window closed or account expired"
+	}
+	if reason != "" {
+		log.Printf("Killing connection: [%d] %s", r.id, reason)
+		r.writeError(0, 1927, "70100", "Connection was killed: "+reason)
+		return io.EOF
+	}
+	r.waiting = true
+	return nil
+}
+
+func (r *Connection) stopWaiting() {
+	r.idle_mutex.Lock()
+	defer r.idle_mutex.Unlock()
+	r.waiting = false
+}
+
+// Close closes both the client and the MySQL connection.
+func (r *Connection) Close() {
+	r.conn.Close()
+	r.backend_mutex.Lock()
+	defer r.backend_mutex.Unlock()
+	r.closed = true
+	if r.mysql != nil {
+		r.mysql.Close()
+	}
+}
+
+// release ends the session once it is over. A pooled backend connection
+// goes back to the pool if the session left it between commands; if it
+// was closed under the session by Close, resetting it fails and it is
+// dropped.
+func (r *Connection) release() {
+	if r.backend == nil {
+		r.Close()
+		return
+	}
+	r.conn.Close()
+	// Not while another session is killing it.
+	r.backend_mutex.Lock()
+	backend := r.backend
+	r.backend = nil
+	r.backend_mutex.Unlock()
+	backend.pool.checkin(backend, r.reusable, true)
+}
+
+// kill ends the session, telling the client why before closing it if it is
+// waiting for a command. In the middle of a response, the error would only
+// corrupt it.
+func (r *Connection) kill(reason string) {
+	r.idle_mutex.Lock()
+	defer r.idle_mutex.Unlock()
+	r.killLocked(reason)
+}
+
+func (r *Connection) killLocked(reason string) {
+	log.Printf("Killing connection: [%d] %s", r.id, reason)
+	if r.waiting {
+		r.writeError(0, 1927, "70100", "Connection was killed: "+reason)
+	}
+	r.Close()
+}
+
+// authenticate verifies the client, either by a mapped client certificate, a
+// bearer token or against the proxy password store, then checks that the
+// account may log in from this host at this time. It returns the proxy user.
+func (r *Connection) authenticate(pkt *packets.MySQLAuthPacket, auth_random []byte) (string, error) {
+	proxy_user, account, err := r.verifyCredentials(pkt, auth_random)
+	if err != nil {
+		return "", err
+	}
+	if account == nil {
+		return proxy_user, nil
+	}
+	err = r.checkAccount(proxy_user, account, pkt.CanHandleExpiredPasswords())
+	if err != nil {
+		return "", err
+	}
+	r.account = account
+	return proxy_user, nil
+}
+
+// verifyCredentials returns the proxy user the client proved to be, and its
+// password store entry if it has one.
+func (r *Connection) verifyCredentials(pkt *packets.MySQLAuthPacket, auth_random []byte) (string, *authn.ProxyAccount, error) {
+	if user, ok := r.certIdentity(); ok {
+		if r.tls_settings.CheckUsername && pkt.Username != "" && pkt.Username != user {
+			return "", nil, fmt.Errorf("Certificate identity %s does not match user %s", user, pkt.Username)
+		}
+		log.Printf("Client certificate authenticated as %s: [%d]", user, r.id)
+		r.auth_method = "certificate"
+		account, err := authn.ReadProxyAccount(r.accounts, user)
+		return user, account, err
+	}
+
+	proxy_user := pkt.Username
+	account, err := authn.ReadProxyAccount(r.accounts, proxy_user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Users without a password log in with a bearer token when it is enabled.
+	if r.jwt != nil && (account == nil || account.Password == "") {
+		user, err := r.authenticateToken(pkt)
+		if err != nil {
+			return "", nil, err
+		}
+		account, err := authn.ReadProxyAccount(r.accounts, user)
+		if err != nil {
+			return "", nil, err
+		}
+		// Nor does the token stand in for the password and second factor
+		// of the user it names.
+		if account != nil && (account.Password != "" || account.TOTPSecret != "") {
+			return "", nil, fmt.Errorf("%w: token for %s, who logs in with a password", authn.ErrBadPassword, user)
+		}
+		r.auth_method = "token"
+		return user, account, nil
+	}
+
+	if account == nil || account.Password == "" {
+		return "", nil, fmt.Errorf("%w: %s", authn.ErrUnknownUser, proxy_user)
+	}
+
+	if account.TOTPSecret != "" {
+		r.auth_method = "totp"
+		return proxy_user, account, r.authenticateTOTP(pkt, account)
+	}
+
+	hashed_pw := authn.HashNativePassword(account.Password, auth_random)
+	if !bytes.Equal(hashed_pw, pkt.AuthResp) {
+		return "", nil, fmt.Errorf("%w for %s", authn.ErrBadPassword, proxy_user)
+	}
+	r.auth_method = "password"
+	return proxy_user, account, nil
+}
+
+// checkAccount enforces the restrictions of a password store entry: allowed
+// hosts, disabled and expired accounts, access windows and password expiry.
+// An expired password is let through, limited to changing it, when the
+// client can handle that.
+func (r *Connection) checkAccount(user string, account *authn.ProxyAccount, can_handle_expired bool) error {
+	allowed, err := account.HostAllowed(net.ParseIP(remoteIP(r.conn.RemoteAddr())))
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s from %s", authn.ErrHostNotAllowed, user, remoteIP(r.conn.RemoteAddr()))
+	}
+
+	now := time.Now()
+	err = account.CheckActive(now)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, user)
+	}
+
+	if r.auth_method != "password" && r.auth_method != "totp" {
+		return nil
+	}
+	expired, err := account.PasswordExpired(now)
+	if err != nil || !expired {
+		return err
+	}
+	if !can_handle_expired {
+		return fmt.Errorf("%w: %s", authn.ErrPasswordExpired, user)
+	}
+	log.Printf("Password of %s has expired, only allowing a password change: [%d]", user, r.id)
+	r.must_change_password = true
+	return nil
+}
+
+// authenticateTOTP checks the password of an account enrolled in TOTP. The
+// client sends it through mysql_clear_password with the current one time code
+// appended, e.g. "secret123456".
+func (r *Connection) authenticateTOTP(pkt *packets.MySQLAuthPacket, account *authn.ProxyAccount) error {
+	secret, err := r.readClearPassword(pkt)
+	if err != nil {
+		return err
+	}
+	if len(secret) < authn.TOTPDigits {
+		return fmt.Errorf("%w for %s", authn.ErrBadPassword, pkt.Username)
+	}
+	password := secret[:len(secret)-authn.TOTPDigits]
+	code := secret[len(secret)-authn.TOTPDigits:]
+
+	if subtle.ConstantTimeCompare([]byte(password), []byte(account.Password)) != 1 {
+		return fmt.Errorf("%w for %s", authn.ErrBadPassword, pkt.Username)
+	}
+	step, ok := authn.VerifyTOTP(account.TOTPSecret, code, time.Now())
+	if !ok {
+		return fmt.Errorf("%w for %s", authn.ErrBadSecondFactor, pkt.Username)
+	}
+	if !r.totp_steps.Accept(pkt.Username, step) {
+		return fmt.Errorf("%w by %s", authn.ErrReusedCode, pkt.Username)
+	}
+	return nil
+}
+
+// authenticateToken verifies a JWT sent through mysql_clear_password and
+// takes the proxy user and groups from its claims.
+func (r *Connection) authenticateToken(pkt *packets.MySQLAuthPacket) (string, error) {
+	token, err := r.readClearPassword(pkt)
+	if err != nil {
+		return "", err
+	}
+	identity, err := r.jwt.Verify(token, time.Now())
+	if err != nil {
+		return "", err
+	}
+	r.groups = identity.Groups
+	log.Printf("Token authenticated as %s %v: [%d]", identity.User, identity.Groups, r.id)
+	return identity.User, nil
+}
+
+// readClearPassword returns what the client sent through mysql_clear_password,
+// asking it to switch to that plugin first if it used another one. This is
+// only done over TLS.
+func (r *Connection) readClearPassword(pkt *packets.MySQLAuthPacket) (string, error) {
+	if _, ok := r.conn.(*tls.Conn); !ok {
+		return "", fmt.Errorf("mysql_clear_password is only allowed over TLS")
+	}
+	if pkt.AuthPluginName == "mysql_clear_password" {
+		return strings.TrimSuffix(string(pkt.AuthResp), "\x00"), nil
+	}
+
+	enc, err := packets.NewAuthSwitchPacket(r.auth_seq+1, "mysql_clear_password", nil).Encode()
+	if err != nil {
+		return "", err
+	}
+	err = r.writeClient(enc)
+	if err != nil {
+		return "", err
+	}
+	resp, err := packets.ReadPacket(r.client_reader)
+	if err != nil {
+		return "", err
+	}
+	r.auth_seq = resp.SequenceId()
+	return strings.TrimSuffix(string(resp.Data()), "\x00"), nil
+}
+
+// certIdentity returns the proxy user mapped from the verified client
+// certificate, if the client connected over TLS and presented one.
+func (r *Connection) certIdentity() (string, bool) {
+	tls_conn, ok := r.conn.(*tls.Conn)
+	if !ok || r.tls_settings == nil {
+		return "", false
+	}
+	certs := tls_conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", false
+	}
+	return authn.CertIdentity(certs[0], r.tls_settings.CertIdentities)
+}
+
+// relayAuthResult forwards MySQL's answer to the rewritten auth packet to the
+// client, renumbered to follow the client's own sequence. An auth switch to
+// mysql_native_password is answered by the proxy itself.
+func (r *Connection) relayAuthResult(client_seq uint8) error {
+	for {
+		pkt, err := packets.ReadPacket(r.server)
+		if err != nil {
+			return err
+		}
+		data := pkt.Data()
+		if len(data) == 0 {
+			return fmt.Errorf("empty auth response from MySQL")
 		}
-	}()
 
-	go func() {
-		buf := make([]byte, MAX_PACKET_LENGTH)
-		for {
-			n, err := r.conn.Read(buf)
+		if data[0] == byte(packets.PacketAuthSwitch) {
+			switch_pkt := &packets.MySQLAuthSwitchPacket{}
+			switch_pkt.Decode(pkt)
+			if switch_pkt.PluginName != "mysql_native_password" {
+				return fmt.Errorf("unsupported auth plugin requested by MySQL: %s", switch_pkt.PluginName)
+			}
+			scramble := switch_pkt.PluginData
+			if len(scramble) == 20 {
+				scramble = append(scramble, 0x00)
+			}
+			resp := packets.NewGenericPacket(pkt.SequenceId()+1, authn.HashNativePassword(r.proxy_pass, scramble))
+			enc, err := resp.Encode()
 			if err != nil {
-				if err == io.EOF {
-					log.Printf("Proxy connection closed: [%d] %s", r.id, err.Error())
-					return
-				}
-				log.Printf("Error reading from Proxy: [%d] %s", r.id, err.Error())
-				return
+				return err
 			}
-			log.Default().Printf("%s --> MySQL:\n", proxy_user)
-			// packets.DecodePackets(buf[:n], true)
-			new_buf, err := packets.InjectUser(buf[:n], true, proxy_user)
+			_, err = r.mysql.Write(enc)
 			if err != nil {
-				log.Printf("Failed to inject user: [%d] %s", r.id, err.Error())
-				return
+				return err
 			}
-			mysql.Write(new_buf)
+			continue
 		}
-	}()
 
+		pkt.SetSequenceId(client_seq + 1)
+		enc, err := pkt.Encode()
+		if err != nil {
+			return err
+		}
+		err = r.writeClient(enc)
+		if err != nil {
+			return err
+		}
+		if data[0] == byte(packets.PacketErr) {
+			err_pkt := &packets.MySQLErrPacket{}
+			err_pkt.Decode(pkt)
+			return err_pkt
+		}
+		return nil
+	}
+}
+
+// writeError sends an ERR packet to the client.
+func (r *Connection) writeError(sequence_id uint8, code uint16, state, message string) error {
+	enc, err := packets.NewErrPacket(sequence_id, code, state, message).Encode()
 	if err != nil {
-		log.Printf("Connection error: [%d] %s", r.id, err.Error())
 		return err
 	}
+	return r.writeClient(enc)
+}
 
-	log.Printf("Connection closed.")
-	return nil
+// writeOK sends an OK packet to the client.
+func (r *Connection) writeOK(sequence_id uint8, affected_rows uint64) error {
+	enc, err := packets.NewOKPacket(sequence_id, affected_rows, packets.ServerStatusAutocommit).Encode()
+	if err != nil {
+		return err
+	}
+	return r.writeClient(enc)
+}
+
+// writeClient sends encoded packets to the client right away.
+func (r *Connection) writeClient(enc []byte) error {
+	_, err := r.client.Write(enc)
+	if err != nil {
+		return err
+	}
+	return r.client.Flush()
 }
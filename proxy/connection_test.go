@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/packets"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hs256Token returns a token for user signed with secret, valid for an
+// hour.
+func hs256Token(user, secret string) string {
+	segment := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	claims := fmt.Sprintf(`{"iss":"idp","aud":"sqlproxy","sub":%q,"exp":%d}`, user, time.Now().Add(time.Hour).Unix())
+	signed := segment(`{"alg":"HS256"}`) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokenConnection returns a session over TLS, as tokens require, that
+// checks them against the password store accounts.
+func tokenConnection(t *testing.T, accounts string) *Connection {
+	verifier, err := authn.NewJWTVerifier(&config.JWTConfig{HMACSecret: "secret", Issuer: "idp", Audience: "sqlproxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "proxyauthn.json")
+	err = os.WriteFile(path, []byte(accounts), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	// Only its type matters, the handshake never runs.
+	conn := tls.Server(server, &tls.Config{})
+	return &Connection{conn: conn, jwt: verifier, accounts: path}
+}
+
+func TestTokenLogin(t *testing.T) {
+	accounts := `{"accounts": {
+		"alice": {"password": "pw"},
+		"bob": {"password": "pw", "totp_secret": "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"},
+		"carol": {"allowed_hosts": ["10.0.0.0/8"]}
+	}}`
+	tests := []struct {
+		// user the client logs in as and the one the token names
+		login string
+		token string
+		ok    bool
+	}{
+		{"dave", "dave", true},
+		{"carol", "carol", true},
+		{"", "carol", true},
+		// The token does not stand in for a password or second factor.
+		{"mallory", "alice", false},
+		{"mallory", "bob", false},
+		{"", "alice", false},
+	}
+	for _, test := range tests {
+		t.Run(test.login+" as "+test.token, func(t *testing.T) {
+			r := tokenConnection(t, accounts)
+			pkt := &packets.MySQLAuthPacket{
+				Username:       test.login,
+				AuthPluginName: "mysql_clear_password",
+				AuthResp:       []byte(hs256Token(test.token, "secret")),
+			}
+			user, _, err := r.verifyCredentials(pkt, nil)
+			if !test.ok {
+				if !errors.Is(err, authn.ErrBadPassword) {
+					t.Fatalf("logged in as %q: %v", user, err)
+				}
+				return
+			}
+			if err != nil || user != test.token || r.auth_method != "token" {
+				t.Fatalf("user %q, method %q: %v", user, r.auth_method, err)
+			}
+		})
+	}
+}
+
+func TestTokenOfUserWithPassword(t *testing.T) {
+	// A user with a password cannot log in with a token of their own
+	// either: the password is checked.
+	r := tokenConnection(t, `{"accounts": {"alice": {"password": "pw"}}}`)
+	pkt := &packets.MySQLAuthPacket{
+		Username:       "alice",
+		AuthPluginName: "mysql_clear_password",
+		AuthResp:       []byte(hs256Token("alice", "secret")),
+	}
+	_, _, err := r.verifyCredentials(pkt, make([]byte, 20))
+	if !errors.Is(err, authn.ErrBadPassword) {
+		t.Fatalf("got %v", err)
+	}
+}
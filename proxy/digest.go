@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"o2buzzle/sqlproxy/sqlparse"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxDigests bounds the number of fingerprints tracked. Statements with new
+// fingerprints beyond it are counted under an empty digest.
+const maxDigests = 10000
+
+// latencyBuckets are the upper bounds of the latency histogram kept for
+// each digest, from which p99 is estimated.
+var latencyBuckets = func() []time.Duration {
+	buckets := []time.Duration{}
+	for bound := 50 * time.Microsecond; bound < 10*time.Minute; bound *= 2 {
+		buckets = append(buckets, bound)
+	}
+	return buckets
+}()
+
+// DigestStat summarizes the executions of statements sharing a fingerprint.
+type DigestStat struct {
+	Calls     uint64    `json:"calls"`
+	Errors    uint64    `json:"errors"`
+	Rows      uint64    `json:"rows"`
+	TotalUs   int64     `json:"total_us"`
+	MinUs     int64     `json:"min_us"`
+	MaxUs     int64     `json:"max_us"`
+	P99Us     int64     `json:"p99_us"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// DigestSummary is a fingerprint's statistics, overall and by proxy user.
+type DigestSummary struct {
+	Digest      string `json:"digest"`
+	Fingerprint string `json:"fingerprint"`
+	DigestStat
+	Users map[string]DigestStat `json:"users"`
+}
+
+type digestCounters struct {
+	stat    DigestStat
+	buckets []uint64
+}
+
+func (r *digestCounters) add(at time.Time, duration time.Duration, rows uint64, failed bool) {
+	us := duration.Microseconds()
+	if r.stat.Calls == 0 {
+		r.stat.FirstSeen = at
+		r.stat.MinUs = us
+		r.buckets = make([]uint64, len(latencyBuckets)+1)
+	}
+	r.stat.Calls++
+	if failed {
+		r.stat.Errors++
+	}
+	r.stat.Rows += rows
+	r.stat.TotalUs += us
+	if us < r.stat.MinUs {
+		r.stat.MinUs = us
+	}
+	if us > r.stat.MaxUs {
+		r.stat.MaxUs = us
+	}
+	r.stat.LastSeen = at
+	r.buckets[sort.Search(len(latencyBuckets), func(i int) bool { return latencyBuckets[i] >= duration })]++
+}
+
+// summary returns the counters with p99 estimated as the upper bound of the
+// bucket holding the 99th percentile, capped by the maximum.
+func (r *digestCounters) summary() DigestStat {
+	stat := r.stat
+	rank := (stat.Calls*99 + 99) / 100
+	seen := uint64(0)
+	for i, count := range r.buckets {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		stat.P99Us = stat.MaxUs
+		if i < len(latencyBuckets) && latencyBuckets[i].Microseconds() < stat.MaxUs {
+			stat.P99Us = latencyBuckets[i].Microseconds()
+		}
+		break
+	}
+	return stat
+}
+
+type digestEntry struct {
+	fingerprint string
+	total       digestCounters
+	users       map[string]*digestCounters
+}
+
+// Digests keeps statistics by statement fingerprint.
+type Digests struct {
+	mutex   sync.Mutex
+	entries map[string]*digestEntry
+}
+
+func NewDigests() *Digests {
+	return &Digests{entries: map[string]*digestEntry{}}
+}
+
+// Add counts an execution of sql by user.
+func (r *Digests) Add(sql, user string, at time.Time, duration time.Duration, rows uint64, failed bool) {
+	fingerprint := sqlparse.Fingerprint(sql)
+	digest := sqlparse.Digest(fingerprint)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry := r.entries[digest]
+	if entry == nil {
+		if len(r.entries) >= maxDigests {
+			digest, fingerprint = "", ""
+			entry = r.entries[digest]
+		}
+		if entry == nil {
+			entry = &digestEntry{fingerprint: fingerprint, users: map[string]*digestCounters{}}
+			r.entries[digest] = entry
+		}
+	}
+	entry.total.add(at, duration, rows, failed)
+	counters := entry.users[user]
+	if counters == nil {
+		counters = &digestCounters{}
+		entry.users[user] = counters
+	}
+	counters.add(at, duration, rows, failed)
+}
+
+// Summaries returns the statistics of every digest, the most time
+// consuming first.
+func (r *Digests) Summaries() []DigestSummary {
+	r.mutex.Lock()
+	summaries := make([]DigestSummary, 0, len(r.entries))
+	for digest, entry := range r.entries {
+		summary := DigestSummary{
+			Digest:      digest,
+			Fingerprint: entry.fingerprint,
+			DigestStat:  entry.total.summary(),
+			Users:       map[string]DigestStat{},
+		}
+		for user, counters := range entry.users {
+			summary.Users[user] = counters.summary()
+		}
+		summaries = append(summaries, summary)
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].TotalUs != summaries[j].TotalUs {
+			return summaries[i].TotalUs > summaries[j].TotalUs
+		}
+		return summaries[i].Digest < summaries[j].Digest
+	})
+	return summaries
+}
+
+// Reset forgets every digest.
+func (r *Digests) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries = map[string]*digestEntry{}
+}
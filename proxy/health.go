@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/packets"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 2 * time.Second
+	defaultHealthTimeout  = time.Second
+	defaultHealthFailures = 3
+)
+
+// BackendInfo describes a MySQL server of the backends config for the admin
+// interfaces.
+type BackendInfo struct {
+	Address string `json:"address"`
+	// "primary", "standby" or "replica"
+	Role     string `json:"role"`
+	Up       bool   `json:"up"`
+	ReadOnly bool   `json:"read_only"`
+	// seconds behind the source, for replicas; -1 when unknown
+	LagSeconds int64 `json:"lag_s"`
+	// why the last check failed
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type backendHealth struct {
+	BackendInfo
+	// failed checks in a row
+	failures int
+}
+
+// healthChecker checks the servers of the backends config on an interval.
+// A backend is down after a number of failed checks in a row and up again
+// after one that passes. Replicas that are down get no reads, and a primary
+// that is down is replaced by the standby once the standby is writable.
+type healthChecker struct {
+	proxy *Proxy
+
+	mutex    sync.Mutex
+	backends map[string]*backendHealth
+}
+
+func newHealthChecker(proxy *Proxy) *healthChecker {
+	return &healthChecker{proxy: proxy, backends: map[string]*backendHealth{}}
+}
+
+// run checks the backends until the process ends. The settings are read
+// again for each round, so that a reload applies.
+func (r *healthChecker) run() {
+	for {
+		r.proxy.mutex.RLock()
+		cfg := r.proxy.config
+		primary := r.proxy.address
+		r.proxy.mutex.RUnlock()
+
+		interval := defaultHealthInterval
+		if cfg.Backends != nil {
+			settings := cfg.Backends.HealthCheck
+			if settings == nil {
+				settings = &config.HealthCheckConfig{}
+			}
+			if settings.IntervalMillis > 0 {
+				interval = time.Duration(settings.IntervalMillis) * time.Millisecond
+			}
+			r.round(cfg, primary, settings)
+		} else {
+			r.mutex.Lock()
+			r.backends = map[string]*backendHealth{}
+			r.mutex.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// backendRoles returns the role of each server of the backends config,
+// given the current primary.
+func (r *Proxy) backendRoles(backends *config.BackendsConfig, primary string) map[string]string {
+	configured := backends.Primary
+	if configured == "" {
+		configured = r.host + r.port
+	}
+	ret := map[string]string{primary: "primary"}
+	for _, address := range []string{configured, backends.Standby} {
+		if address != "" && address != primary {
+			ret[address] = "standby"
+		}
+	}
+	for _, address := range backends.Replicas {
+		if _, ok := ret[address]; !ok {
+			ret[address] = "replica"
+		}
+	}
+	return ret
+}
+
+// round checks every backend at once, then takes down replicas and fails
+// over as the results call for.
+func (r *healthChecker) round(cfg *config.Config, primary string, settings *config.HealthCheckConfig) {
+	timeout := time.Duration(settings.TimeoutMillis) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	failures := settings.Failures
+	if failures <= 0 {
+		failures = defaultHealthFailures
+	}
+
+	type result struct {
+		read_only bool
+		lag       int64
+		err       error
+	}
+	targets := r.proxy.backendRoles(cfg.Backends, primary)
+	results := map[string]*result{}
+	var wg sync.WaitGroup
+	for address, role := range targets {
+		res := &result{}
+		results[address] = res
+		wg.Add(1)
+		go func(address, role string) {
+			defer wg.Done()
+			res.read_only, res.lag, res.err = r.check(address, role, cfg.ProxyUser, cfg.ProxyPass, timeout, settings.MaxLagSeconds)
+		}(address, role)
+	}
+	wg.Wait()
+
+	r.mutex.Lock()
+	for address := range r.backends {
+		if _, ok := targets[address]; !ok {
+			delete(r.backends, address)
+		}
+	}
+	standby := ""
+	for address, res := range results {
+		health := r.backends[address]
+		if health == nil {
+			health = &backendHealth{BackendInfo: BackendInfo{Address: address, Up: true}}
+			r.backends[address] = health
+		}
+		health.Role = targets[address]
+		health.ReadOnly = res.read_only
+		health.LagSeconds = res.lag
+		health.CheckedAt = time.Now()
+		if res.err == nil {
+			health.failures = 0
+			health.Error = ""
+			if !health.Up {
+				health.Up = true
+				log.Printf("Backend %s (%s) is up", address, health.Role)
+			}
+		} else {
+			health.failures++
+			health.Error = res.err.Error()
+			if health.Up && health.failures >= failures {
+				health.Up = false
+				log.Printf("Backend %s (%s) is down: %s", address, health.Role, health.Error)
+			}
+		}
+		if health.Role == "standby" && health.Up && !health.ReadOnly {
+			standby = address
+		}
+	}
+	primary_up := r.backends[primary].Up
+	r.mutex.Unlock()
+
+	r.proxy.markPools()
+	if !primary_up && standby != "" {
+		r.proxy.failover(primary, standby)
+	}
+}
+
+// check connects to a backend as the backend account and queries it. It
+// returns @@read_only and, for replicas, how far behind they are. A primary
+// that is read only and a replica that does not replicate or lags too much
+// fail the check.
+func (r *healthChecker) check(address, role, user, password string, timeout time.Duration, max_lag int) (bool, int64, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		r.proxy.metrics.dial_errors.Inc()
+		return false, -1, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	// The connection belongs to no pool, only to this check.
+	probe := &backendPool{address: address, metrics: r.proxy.metrics}
+	backend := &backendConn{
+		pool:    probe,
+		key:     poolKey{charset: 255}, // utf8mb4
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		created: time.Now(),
+	}
+	err = backend.login(user, password)
+	if err != nil {
+		return false, -1, err
+	}
+
+	_, err = backend.query("SELECT 1")
+	if err != nil {
+		return false, -1, err
+	}
+	result, err := backend.query("SELECT @@read_only")
+	if err != nil {
+		return false, -1, err
+	}
+	value := result.Value(0, "@@read_only")
+	read_only := value != nil && *value == "1"
+	switch role {
+	case "primary":
+		if read_only {
+			return read_only, -1, errors.New("primary is read only")
+		}
+	case "replica":
+		lag, err := replicaLag(backend)
+		if err == nil && max_lag > 0 && lag > int64(max_lag) {
+			err = fmt.Errorf("replica is %d s behind its source", lag)
+		}
+		return read_only, lag, err
+	}
+	return read_only, -1, nil
+}
+
+// replicaLag returns how many seconds a replica is behind its source, the
+// most of all channels, or an error when replication is stopped.
+func replicaLag(backend *backendConn) (int64, error) {
+	column := "Seconds_Behind_Source"
+	result, err := backend.query("SHOW REPLICA STATUS")
+	// before MySQL 8.0.22
+	var err_pkt *packets.MySQLErrPacket
+	if errors.As(err, &err_pkt) && err_pkt.ErrorCode == 1064 {
+		column = "Seconds_Behind_Master"
+		result, err = backend.query("SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return -1, err
+	}
+	if len(result.Rows) == 0 {
+		return -1, errors.New("replication is not configured")
+	}
+	lag := int64(0)
+	for i := range result.Rows {
+		value := result.Value(i, column)
+		if value == nil {
+			return -1, errors.New("replication is stopped")
+		}
+		seconds, err := strconv.ParseInt(*value, 10, 64)
+		if err != nil {
+			return -1, fmt.Errorf("bad %s: %s", column, *value)
+		}
+		if seconds > lag {
+			lag = seconds
+		}
+	}
+	return lag, nil
+}
+
+// up reports whether the backend at address passed its checks lately, or
+// has not been checked yet.
+func (r *healthChecker) up(address string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	health := r.backends[address]
+	return health == nil || health.Up
+}
+
+// Backends describes the servers of the backends config as last checked.
+func (r *Proxy) Backends() []BackendInfo {
+	r.health.mutex.Lock()
+	backends := make([]BackendInfo, 0, len(r.health.backends))
+	for _, health := range r.health.backends {
+		backends = append(backends, health.BackendInfo)
+	}
+	r.health.mutex.Unlock()
+	order := map[string]int{"primary": 0, "standby": 1, "replica": 2}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].Role != backends[j].Role {
+			return order[backends[i].Role] < order[backends[j].Role]
+		}
+		return backends[i].Address < backends[j].Address
+	})
+	return backends
+}
+
+// markPools takes the pools of backends that are down out of rotation.
+func (r *Proxy) markPools() {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, pool := range r.pools {
+		pool.setDown(!r.health.up(pool.address))
+	}
+}
+
+// failover makes the standby the primary, for the sessions to come and for
+// the multiplexed sessions holding no connection. The former primary
+// becomes the standby.
+func (r *Proxy) failover(from, to string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// Unless a reload changed the primary meanwhile.
+	if r.address != from {
+		return
+	}
+	log.Printf("Failing over from primary %s to standby %s", from, to)
+	r.promoted = !r.promoted
+	r.address = r.primaryAddress(r.config)
+	r.pool, r.replicas = r.poolsFor(r.config)
+	r.metrics.failovers.Inc()
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"o2buzzle/sqlproxy/audit"
+	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/sqlparse"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clients are given the proxy's session id as their connection id, in the
+// handshake and by CONNECTION_ID(), rather than the thread id of the
+// backend connection behind them. KILL statements and COM_PROCESS_KILL
+// name sessions by that id and are translated to the backend's thread id,
+// but only for sessions of the same proxy user: the backend account is
+// shared, so MySQL itself would let anyone kill anything.
+
+// parseKill recognizes "KILL [CONNECTION | QUERY] <id>".
+func parseKill(sql string) (uint64, bool, bool) {
+	tokens := sqlparse.Significant(sqlparse.Tokenize(sql))
+	for len(tokens) > 0 && tokens[len(tokens)-1].Text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) < 2 || !tokens[0].Is("KILL") {
+		return 0, false, false
+	}
+	query := false
+	switch {
+	case len(tokens) == 3 && tokens[1].Is("QUERY"):
+		query = true
+	case len(tokens) == 3 && tokens[1].Is("CONNECTION"):
+	case len(tokens) == 2:
+	default:
+		return 0, false, false
+	}
+	id, err := strconv.ParseUint(tokens[len(tokens)-1].Text, 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	return id, query, true
+}
+
+// replaceCall puts value in place of every call of function without
+// arguments, such as CONNECTION_ID(). Statements that create or alter a
+// stored object are left alone, along with the rest of the query: the body
+// is kept to run later, in other sessions.
+func replaceCall(sql, function string, value uint64) (string, bool) {
+	tokens := sqlparse.Tokenize(sql)
+	var b strings.Builder
+	replaced := false
+	for i := 0; i < len(tokens); i++ {
+		if i == 0 || tokens[i-1].Type == sqlparse.TokenPunct && tokens[i-1].Text == ";" {
+			end := i
+			for end < len(tokens) && !(tokens[end].Type == sqlparse.TokenPunct && tokens[end].Text == ";") {
+				end++
+			}
+			if sqlparse.DefinesStoredObject(sqlparse.Significant(tokens[i:end])) {
+				b.WriteString(sql[tokens[i].Pos:])
+				break
+			}
+		}
+		if tokens[i].Is(function) {
+			if end, ok := emptyParens(tokens, i+1); ok {
+				b.WriteString(strconv.FormatUint(value, 10))
+				i = end
+				replaced = true
+				continue
+			}
+		}
+		b.WriteString(tokens[i].Text)
+	}
+	return b.String(), replaced
+}
+
+// emptyParens returns the index of the ")" of a "()" starting at tokens[i],
+// whitespace and comments aside.
+func emptyParens(tokens []sqlparse.Token, i int) (int, bool) {
+	want := "("
+	for ; i < len(tokens); i++ {
+		if !tokens[i].Significant() {
+			continue
+		}
+		if tokens[i].Type != sqlparse.TokenPunct || tokens[i].Text != want {
+			return 0, false
+		}
+		if want == ")" {
+			return i, true
+		}
+		want = ")"
+	}
+	return 0, false
+}
+
+// killTarget returns the backend thread id of session id, or an ERR code
+// and message when the session is not there or not the client's to kill.
+// A thread id of 0 means the session holds no backend connection.
+func (r *Connection) killTarget(id uint64) (*Connection, uint32, uint16, string) {
+	if id == r.id {
+		return r, r.backend_thread, 0, ""
+	}
+	target := r.proxy.session(id)
+	if target == nil {
+		return nil, 0, 1094, fmt.Sprintf("Unknown thread id: %d", id)
+	}
+	info := target.status.info(id, false)
+	if info.ProxyUser != r.proxy_user {
+		return nil, 0, 1095, fmt.Sprintf("You are not owner of thread %d", id)
+	}
+	return target, info.BackendThread, 0, ""
+}
+
+// killBackend kills the statement or the connection of the pooled backend
+// connection the session holds, from another connection of its pool. The
+// session cannot hand its connection back meanwhile, so the KILL cannot
+// reach another session that took it over. pooled is false when the
+// session holds no pooled connection, and held when it holds none at all.
+func (r *Connection) killBackend(query bool) (bool, bool, error) {
+	r.backend_mutex.Lock()
+	defer r.backend_mutex.Unlock()
+	if r.backend == nil {
+		return false, r.mysql != nil, nil
+	}
+	return true, true, r.backend.pool.kill(r.backend.key, r.backend.thread, query)
+}
+
+// translateQuery rewrites the session ids in a COM_QUERY to backend thread
+// ids. A multiplexed session about to run a single statement on whichever
+// connection is free also gets its own LAST_INSERT_ID(). KILL statements
+// that do not name a session on their own are refused. It returns nil once
+// it has answered the client itself.
+func (r *Connection) translateQuery(pkt *packets.MySQLGenericPacket, record *audit.Record, start time.Time) (*packets.MySQLGenericPacket, error) {
+	// Queries that span several packets are only checked for KILL.
+	if len(pkt.Data()) >= 0xffffff {
+		data, err := r.readContinued(pkt)
+		if err != nil {
+			return nil, err
+		}
+		query_pkt := &packets.MySQLCOMQueryPacket{}
+		if query_pkt.Decode(*packets.NewGenericPacket(pkt.SequenceId(), data), r.capabilities) == nil && sqlparse.HasKill(query_pkt.SQL()) {
+			return nil, r.refuseKill(pkt.SequenceId(), record, start)
+		}
+		return pkt, nil
+	}
+	query_pkt := &packets.MySQLCOMQueryPacket{}
+	if query_pkt.Decode(*pkt, r.capabilities) != nil {
+		return pkt, nil
+	}
+	sql := query_pkt.SQL()
+
+	// KILL CONNECTION_ID() names the session itself.
+	rewritten, ok := replaceCall(sql, "CONNECTION_ID", r.id)
+	if id, query, is_kill := parseKill(rewritten); is_kill {
+		thread, done, err := r.authorizeKill(id, query, pkt.SequenceId(), record, start)
+		if err != nil || done {
+			return nil, err
+		}
+		if query {
+			sql = fmt.Sprintf("KILL QUERY %d", thread)
+		} else {
+			sql = fmt.Sprintf("KILL CONNECTION %d", thread)
+		}
+	} else {
+		if sqlparse.HasKill(rewritten) {
+			return nil, r.refuseKill(pkt.SequenceId(), record, start)
+		}
+		// Within several statements, LAST_INSERT_ID() may follow a write on
+		// the same connection.
+		if r.multiplex && r.backend == nil && !sqlparse.MultiStatement(sql) {
+			var replaced bool
+			rewritten, replaced = replaceCall(rewritten, "LAST_INSERT_ID", r.last_insert_id)
+			ok = ok || replaced
+		}
+		if !ok {
+			return pkt, nil
+		}
+		sql = rewritten
+	}
+
+	query_pkt.SetSQL(sql)
+	data, err := query_pkt.EncodeData()
+	if err != nil {
+		return pkt, nil
+	}
+	return packets.NewGenericPacket(pkt.SequenceId(), data), nil
+}
+
+// refusePreparedKill refuses a COM_STMT_PREPARE of a KILL statement, which
+// would go to MySQL untranslated. It reports whether it answered the
+// client.
+func (r *Connection) refusePreparedKill(pkt *packets.MySQLGenericPacket, record *audit.Record, start time.Time) (bool, error) {
+	data := pkt.Data()
+	if len(data) >= 0xffffff {
+		var err error
+		data, err = r.readContinued(pkt)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !sqlparse.HasKill(string(data[1:])) {
+		return false, nil
+	}
+	return true, r.refuseKill(pkt.SequenceId(), record, start)
+}
+
+// refuseKill answers a KILL the proxy cannot translate. Passed on as it is,
+// it could reach any backend thread.
+func (r *Connection) refuseKill(sequence_id uint8, record *audit.Record, start time.Time) error {
+	log.Printf("Refusing KILL that does not name a session on its own: [%d]", r.id)
+	r.continued = nil
+	record.ErrorCode = 1095
+	r.logCommand(record, start, nil)
+	return r.writeError(sequence_id+1, 1095, "HY000", "KILL must name a session id on its own, as KILL [CONNECTION | QUERY] <id>")
+}
+
+// readContinued reads the packets that carry the rest of a command of 16M or
+// more, for forwardCommand to send after it, and returns the whole payload.
+func (r *Connection) readContinued(pkt *packets.MySQLGenericPacket) ([]byte, error) {
+	data := append([]byte{}, pkt.Data()...)
+	for last := pkt; len(last.Data()) >= 0xffffff; {
+		next, err := packets.ReadPacket(r.client_reader)
+		if err != nil {
+			return nil, err
+		}
+		r.continued = append(r.continued, next)
+		data = append(data, next.Data()...)
+		last = next
+	}
+	return data, nil
+}
+
+// translateProcessKill rewrites the session id of a COM_PROCESS_KILL to a
+// backend thread id. It returns nil once it has answered the client itself.
+func (r *Connection) translateProcessKill(pkt *packets.MySQLGenericPacket, record *audit.Record, start time.Time) (*packets.MySQLGenericPacket, error) {
+	data := pkt.Data()
+	if len(data) < 5 {
+		return pkt, nil
+	}
+	thread, done, err := r.authorizeKill(uint64(binary.LittleEndian.Uint32(data[1:5])), false, pkt.SequenceId(), record, start)
+	if err != nil || done {
+		return nil, err
+	}
+	translated := make([]byte, 5)
+	translated[0] = data[0]
+	binary.LittleEndian.PutUint32(translated[1:5], thread)
+	return packets.NewGenericPacket(pkt.SequenceId(), translated), nil
+}
+
+// authorizeKill checks killing session id and returns the backend thread to
+// pass on to MySQL. It reports done when it has answered the client
+// itself: the kill was refused, the session holds a pooled connection
+// and was killed from another one, or it holds no backend connection and
+// is ended by the proxy.
+func (r *Connection) authorizeKill(id uint64, query bool, sequence_id uint8, record *audit.Record, start time.Time) (uint32, bool, error) {
+	target, thread, code, message := r.killTarget(id)
+	if code != 0 {
+		log.Printf("Refusing to kill session %d: [%d] %s", id, r.id, message)
+		record.ErrorCode = code
+		r.logCommand(record, start, nil)
+		return 0, true, r.writeError(sequence_id+1, code, "HY000", message)
+	}
+	if target != r {
+		pooled, held, err := target.killBackend(query)
+		if pooled {
+			var err_pkt *packets.MySQLErrPacket
+			if errors.As(err, &err_pkt) {
+				record.ErrorCode = err_pkt.ErrorCode
+				r.logCommand(record, start, nil)
+				return 0, true, r.writeError(sequence_id+1, err_pkt.ErrorCode, err_pkt.SQLState, err_pkt.ErrorMessage)
+			}
+			if err != nil {
+				log.Printf("Failed to kill session %d: [%d] %s", id, r.id, err.Error())
+				record.ErrorCode = 1105
+				r.logCommand(record, start, nil)
+				return 0, true, r.writeError(sequence_id+1, 1105, "HY000", "Failed to reach the backend of the session")
+			}
+			r.logCommand(record, start, nil)
+			return 0, true, r.writeOK(sequence_id+1, 0)
+		}
+		if !held {
+			thread = 0
+		}
+	}
+	if thread != 0 {
+		return thread, false, nil
+	}
+	if !query {
+		r.proxy.KillSession(id, fmt.Sprintf("killed by session %d", r.id))
+	}
+	r.logCommand(record, start, nil)
+	return 0, true, r.writeOK(sequence_id+1, 0)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"o2buzzle/sqlproxy/config"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrLockedOut = errors.New("locked out after too many failed logins")
+
+// LockoutEntry tracks consecutive failed logins for a "user:<name>" or
+// "ip:<address>" key.
+type LockoutEntry struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// Lockout keeps failure counters for brute-force protection. Every failure
+// is answered after an exponentially growing delay and once max_failures is
+// reached the key is refused outright for the lockout period.
+type Lockout struct {
+	mutex        sync.Mutex
+	entries      map[string]*LockoutEntry
+	disabled     bool
+	max_failures int
+	duration     time.Duration
+	backoff      time.Duration
+	max_backoff  time.Duration
+	// time.Now, but for tests
+	now func() time.Time
+}
+
+func NewLockout(cfg *config.LockoutConfig) *Lockout {
+	if cfg == nil {
+		cfg = &config.LockoutConfig{}
+	}
+	r := &Lockout{
+		entries:      map[string]*LockoutEntry{},
+		disabled:     cfg.Disabled,
+		max_failures: cfg.MaxFailures,
+		duration:     time.Duration(cfg.LockoutSeconds) * time.Second,
+		backoff:      time.Duration(cfg.BackoffMillis) * time.Millisecond,
+		max_backoff:  time.Duration(cfg.MaxBackoffMs) * time.Millisecond,
+		now:          time.Now,
+	}
+	if r.max_failures <= 0 {
+		r.max_failures = 5
+	}
+	if r.duration <= 0 {
+		r.duration = 15 * time.Minute
+	}
+	if r.backoff <= 0 {
+		r.backoff = 500 * time.Millisecond
+	}
+	if r.max_backoff <= 0 {
+		r.max_backoff = 8 * time.Second
+	}
+	return r
+}
+
+// lockoutError returns the MySQL error to answer a locked out key with.
+func lockoutError(entry *LockoutEntry, user string, addr net.Addr) (uint16, string) {
+	if entry.Key == ipLockoutKey(addr) {
+		return 1129, fmt.Sprintf("Host '%s' is blocked because of many failed logins; try again later", remoteIP(addr))
+	}
+	remaining := int(time.Until(entry.LockedUntil).Seconds()) + 1
+	return 3955, fmt.Sprintf("Access denied for user '%s'@'%s'. Account is blocked for %d second(s) due to %d consecutive failed logins.", user, remoteIP(addr), remaining, entry.Failures)
+}
+
+func userLockoutKey(user string) string {
+	return "user:" + user
+}
+
+func ipLockoutKey(addr net.Addr) string {
+	return "ip:" + remoteIP(addr)
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Locked returns the entry of the first key that is currently locked out.
+func (r *Lockout) Locked(keys ...string) *LockoutEntry {
+	if r.disabled {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	for _, key := range keys {
+		entry := r.entry(key, now)
+		if entry != nil && now.Before(entry.LockedUntil) {
+			locked := *entry
+			return &locked
+		}
+	}
+	return nil
+}
+
+// entry returns the live entry for key, forgetting it once its lockout or
+// failure window has passed. Callers hold the mutex.
+func (r *Lockout) entry(key string, now time.Time) *LockoutEntry {
+	entry, ok := r.entries[key]
+	if !ok {
+		return nil
+	}
+	if now.Before(entry.LockedUntil) || (entry.LockedUntil.IsZero() && now.Sub(entry.LastFailure) < r.duration) {
+		return entry
+	}
+	delete(r.entries, key)
+	return nil
+}
+
+// Failure counts a failed login against every key and returns how long to
+// hold back the answer to the client.
+func (r *Lockout) Failure(keys ...string) time.Duration {
+	if r.disabled {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	failures := 0
+	for _, key := range keys {
+		entry := r.entry(key, now)
+		if entry == nil {
+			entry = &LockoutEntry{Key: key}
+			r.entries[key] = entry
+		}
+		entry.Failures += 1
+		entry.LastFailure = now
+		if entry.Failures >= r.max_failures {
+			entry.LockedUntil = now.Add(r.duration)
+		}
+		if entry.Failures > failures {
+			failures = entry.Failures
+		}
+	}
+
+	delay := r.backoff
+	for i := 1; i < failures && delay < r.max_backoff; i++ {
+		delay *= 2
+	}
+	if delay > r.max_backoff {
+		delay = r.max_backoff
+	}
+	return delay
+}
+
+// Success resets the counters of every key.
+func (r *Lockout) Success(keys ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, key := range keys {
+		delete(r.entries, key)
+	}
+}
+
+// Entries lists the keys with recent failures, locked ones included.
+func (r *Lockout) Entries() []LockoutEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	entries := []LockoutEntry{}
+	for key := range r.entries {
+		entry := r.entry(key, now)
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// Clear forgets key, or every key when it is empty. It reports whether
+// anything was removed.
+func (r *Lockout) Clear(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if key == "" {
+		cleared := len(r.entries) > 0
+		r.entries = map[string]*LockoutEntry{}
+		return cleared
+	}
+	_, ok := r.entries[key]
+	delete(r.entries, key)
+	return ok
+}
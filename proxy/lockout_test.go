@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"o2buzzle/sqlproxy/config"
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for time.Now, moving only when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (r *fakeClock) Now() time.Time {
+	return r.now
+}
+
+func (r *fakeClock) Advance(d time.Duration) {
+	r.now = r.now.Add(d)
+}
+
+func newTestLockout(cfg *config.LockoutConfig) (*Lockout, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	lockout := NewLockout(cfg)
+	lockout.now = clock.Now
+	return lockout, clock
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *config.LockoutConfig
+		// delay after each failure
+		delays []time.Duration
+	}{
+		{
+			name:   "defaults",
+			cfg:    &config.LockoutConfig{MaxFailures: 100},
+			delays: []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "capped between doublings",
+			cfg:    &config.LockoutConfig{MaxFailures: 100, BackoffMillis: 300, MaxBackoffMs: 1000},
+			delays: []time.Duration{300 * time.Millisecond, 600 * time.Millisecond, time.Second, time.Second},
+		},
+		{
+			name:   "disabled",
+			cfg:    &config.LockoutConfig{Disabled: true},
+			delays: []time.Duration{0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lockout, clock := newTestLockout(test.cfg)
+			for i, want := range test.delays {
+				if delay := lockout.Failure("user:alice"); delay != want {
+					t.Fatalf("failure %d: delay %v, want %v", i+1, delay, want)
+				}
+				clock.Advance(time.Second)
+			}
+		})
+	}
+}
+
+func TestLockoutThreshold(t *testing.T) {
+	type step struct {
+		advance  time.Duration
+		failures int
+		// key locked afterwards, if any
+		locked string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "locked at max_failures",
+			steps: []step{
+				{failures: 2},
+				{failures: 1, locked: "user:alice"},
+				{advance: 59 * time.Second, locked: "user:alice"},
+				{advance: time.Second},
+			},
+		},
+		{
+			name: "failures forgotten after the lockout period",
+			steps: []step{
+				{failures: 2},
+				{advance: 60 * time.Second},
+				{failures: 2},
+				{advance: 59 * time.Second, failures: 1, locked: "user:alice"},
+			},
+		},
+		{
+			name: "failures during a lockout extend it",
+			steps: []step{
+				{failures: 3, locked: "user:alice"},
+				{advance: 30 * time.Second, failures: 1, locked: "user:alice"},
+				{advance: 59 * time.Second, locked: "user:alice"},
+				{advance: time.Second},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lockout, clock := newTestLockout(&config.LockoutConfig{MaxFailures: 3, LockoutSeconds: 60})
+			for i, step := range test.steps {
+				clock.Advance(step.advance)
+				for j := 0; j < step.failures; j++ {
+					lockout.Failure("user:alice")
+				}
+				locked := ""
+				if entry := lockout.Locked("user:alice"); entry != nil {
+					locked = entry.Key
+				}
+				if locked != step.locked {
+					t.Fatalf("step %d: locked %q, want %q", i+1, locked, step.locked)
+				}
+			}
+		})
+	}
+}
+
+func TestLockoutUnlocked(t *testing.T) {
+	tests := []struct {
+		name string
+		// ends the lockout of user:alice
+		unlock func(lockout *Lockout) bool
+		// whether unlock reports removing anything
+		removed bool
+	}{
+		{"success", func(lockout *Lockout) bool { lockout.Success("user:alice", "ip:10.0.0.1"); return true }, true},
+		{"clear key", func(lockout *Lockout) bool { return lockout.Clear("user:alice") }, true},
+		{"clear all", func(lockout *Lockout) bool { return lockout.Clear("") }, true},
+		{"clear other key", func(lockout *Lockout) bool { return lockout.Clear("user:bob") }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lockout, _ := newTestLockout(&config.LockoutConfig{MaxFailures: 2})
+			lockout.Failure("user:alice")
+			lockout.Failure("user:alice")
+			if lockout.Locked("user:alice") == nil {
+				t.Fatal("not locked")
+			}
+			if removed := test.unlock(lockout); removed != test.removed {
+				t.Fatalf("removed %v", removed)
+			}
+			entry := lockout.Locked("user:alice")
+			if test.removed == (entry != nil) {
+				t.Fatalf("locked %+v after unlocking", entry)
+			}
+			if test.removed && lockout.Failure("user:alice") != 500*time.Millisecond {
+				t.Fatal("failures not reset")
+			}
+		})
+	}
+}
+
+func TestLockoutKeys(t *testing.T) {
+	lockout, _ := newTestLockout(&config.LockoutConfig{MaxFailures: 3})
+	// alice fails from three hosts, mallory guesses three users from one.
+	for _, keys := range [][]string{
+		{"user:alice", "ip:10.0.0.1"},
+		{"user:alice", "ip:10.0.0.2"},
+		{"user:alice", "ip:10.0.0.3"},
+		{"user:bob", "ip:10.0.0.9"},
+		{"user:carol", "ip:10.0.0.9"},
+		{"user:dave", "ip:10.0.0.9"},
+	} {
+		lockout.Failure(keys...)
+	}
+	tests := []struct {
+		keys   []string
+		locked string
+	}{
+		{[]string{"user:alice", "ip:10.0.0.4"}, "user:alice"},
+		{[]string{"user:bob", "ip:10.0.0.1"}, ""},
+		{[]string{"user:eve", "ip:10.0.0.9"}, "ip:10.0.0.9"},
+		{[]string{"user:bob", "ip:10.0.0.8"}, ""},
+	}
+	for _, test := range tests {
+		locked := ""
+		if entry := lockout.Locked(test.keys...); entry != nil {
+			locked = entry.Key
+		}
+		if locked != test.locked {
+			t.Errorf("%v: locked %q, want %q", test.keys, locked, test.locked)
+		}
+	}
+
+	entries := lockout.Entries()
+	if len(entries) != 8 || entries[0].Key != "ip:10.0.0.1" || entries[7].Key != "user:dave" {
+		t.Fatalf("entries: %+v", entries)
+	}
+}
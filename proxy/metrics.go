@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// proxyMetrics are the metrics the proxy keeps about its sessions.
+type proxyMetrics struct {
+	registry           *metrics.Registry
+	connections        *metrics.Counter
+	connections_active *metrics.GaugeVec
+	logins             *metrics.CounterVec
+	auth_successes     *metrics.CounterVec
+	auth_failures      *metrics.CounterVec
+	bytes              *metrics.CounterVec
+	commands           *metrics.CounterVec
+	latency            *metrics.HistogramVec
+	dial_errors        *metrics.Counter
+	decode_errors      *metrics.CounterVec
+	pins               *metrics.CounterVec
+	failovers          *metrics.Counter
+}
+
+func newProxyMetrics(proxy *Proxy) *proxyMetrics {
+	registry := metrics.NewRegistry()
+	r := &proxyMetrics{
+		registry:           registry,
+		connections:        registry.NewCounterVec("sqlproxy_connections_accepted_total", "Client connections accepted.").With(),
+		connections_active: registry.NewGaugeVec("sqlproxy_connections_active", "Authenticated client sessions open, by proxy user.", "user"),
+		logins:             registry.NewCounterVec("sqlproxy_connections_total", "Client sessions authenticated, by proxy user.", "user"),
+		auth_successes:     registry.NewCounterVec("sqlproxy_auth_success_total", "Successful authentications, by method.", "method"),
+		auth_failures:      registry.NewCounterVec("sqlproxy_auth_failures_total", "Failed authentications, by reason.", "reason"),
+		bytes:              registry.NewCounterVec("sqlproxy_bytes_total", "Bytes relayed, by direction.", "direction"),
+		commands:           registry.NewCounterVec("sqlproxy_commands_total", "Commands received from clients, by type.", "command"),
+		latency: registry.NewHistogramVec("sqlproxy_command_duration_seconds", "Time from a command to the end of its response, by type.",
+			metrics.ExponentialBuckets(0.0001, 2, 18), "command"),
+		dial_errors:   registry.NewCounterVec("sqlproxy_backend_dial_errors_total", "Failed connections to MySQL.").With(),
+		decode_errors: registry.NewCounterVec("sqlproxy_packet_decode_errors_total", "Packets that could not be decoded, by packet.", "packet"),
+		pins:          registry.NewCounterVec("sqlproxy_session_pins_total", "Multiplexed sessions pinned to their backend connection, by reason.", "reason"),
+		failovers:     registry.NewCounterVec("sqlproxy_backend_failovers_total", "Failovers from the primary to the standby.").With(),
+	}
+	registry.NewFunc("sqlproxy_audit_dropped_total", "Audit records dropped because a sink was full.", "counter", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(proxy.audit.Dropped())}}
+	})
+	registry.NewFunc("sqlproxy_backend_connections", "Pooled connections to MySQL, by state.", "gauge", []string{"state"}, func() []metrics.Sample {
+		idle, in_use := 0, 0
+		proxy.mutex.RLock()
+		for _, pool := range proxy.pools {
+			pool_idle, pool_in_use := pool.counts()
+			idle += pool_idle
+			in_use += pool_in_use
+		}
+		proxy.mutex.RUnlock()
+		return []metrics.Sample{
+			{Values: []string{"idle"}, Value: float64(idle)},
+			{Values: []string{"in_use"}, Value: float64(in_use)},
+		}
+	})
+	registry.NewFunc("sqlproxy_backend_up", "Whether the backend passes its health checks, by role.", "gauge", []string{"backend", "role"}, func() []metrics.Sample {
+		backends := proxy.Backends()
+		samples := make([]metrics.Sample, 0, len(backends))
+		for _, backend := range backends {
+			value := 0.0
+			if backend.Up {
+				value = 1
+			}
+			samples = append(samples, metrics.Sample{Values: []string{backend.Address, backend.Role}, Value: value})
+		}
+		return samples
+	})
+	registry.NewFunc("sqlproxy_backend_replication_lag_seconds", "Seconds replicas are behind their source.", "gauge", []string{"backend"}, func() []metrics.Sample {
+		samples := []metrics.Sample{}
+		for _, backend := range proxy.Backends() {
+			if backend.LagSeconds >= 0 {
+				samples = append(samples, metrics.Sample{Values: []string{backend.Address}, Value: float64(backend.LagSeconds)})
+			}
+		}
+		return samples
+	})
+	return r
+}
+
+// countingConn counts the bytes read from and written to a connection, and
+// for the client side, the session's own totals too.
+type countingConn struct {
+	net.Conn
+	read    *metrics.Counter
+	written *metrics.Counter
+	session *sessionStatus
+}
+
+func (r *countingConn) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.read.Add(uint64(n))
+	if r.session != nil {
+		atomic.AddUint64(&r.session.bytes_in, uint64(n))
+	}
+	return n, err
+}
+
+func (r *countingConn) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	r.written.Add(uint64(n))
+	if r.session != nil {
+		atomic.AddUint64(&r.session.bytes_out, uint64(n))
+	}
+	return n, err
+}
+
+func (r *proxyMetrics) countClient(conn net.Conn, session *sessionStatus) net.Conn {
+	return &countingConn{conn, r.bytes.With("client_to_proxy"), r.bytes.With("proxy_to_client"), session}
+}
+
+func (r *proxyMetrics) countBackend(conn net.Conn) net.Conn {
+	return &countingConn{conn, r.bytes.With("backend_to_proxy"), r.bytes.With("proxy_to_backend"), nil}
+}
+
+// countLogin counts the session as open for user, moving it from the user
+// it was open for before a COM_CHANGE_USER.
+func (r *Connection) countLogin(user string) {
+	r.countLogout()
+	r.metrics.logins.With(user).Inc()
+	r.metrics.connections_active.With(user).Inc()
+	r.active_user = &user
+}
+
+func (r *Connection) countLogout() {
+	if r.active_user != nil {
+		r.metrics.connections_active.With(*r.active_user).Dec()
+		r.active_user = nil
+	}
+}
+
+// startStatsD sends the metrics to a DogStatsD agent, tagged with the
+// backend.
+func (r *Proxy) startStatsD(cfg *config.StatsDConfig) error {
+	address := cfg.Address
+	if address == "" {
+		address = "127.0.0.1:8125"
+	}
+	interval := time.Duration(cfg.FlushMillis) * time.Millisecond
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	packet_size := cfg.MaxPacketSize
+	if packet_size <= 0 {
+		packet_size = 1432
+	}
+	r.mutex.RLock()
+	tags := append([]string{"backend:" + r.address}, cfg.Tags...)
+	r.mutex.RUnlock()
+	_, err := metrics.NewStatsD(r.metrics.registry, address, cfg.Prefix, tags, interval, packet_size)
+	return err
+}
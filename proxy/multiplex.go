@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"o2buzzle/sqlproxy/audit"
+	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/sqlparse"
+	"strings"
+	"time"
+)
+
+// A multiplexed session takes a backend connection from the pool for each
+// command and hands it back as soon as nothing ties it to that connection:
+// no transaction is open, as the status flags of MySQL's answers tell, and
+// the session left no state behind. Statements that do, like setting user
+// variables, creating temporary tables or preparing statements, pin the
+// session to its connection until it is reset or ends. The database and the
+// identity variables are all a session carries over to the next connection.
+//
+// Only a session holding no connection can have a read answered by a
+// replica, which it hands back right after: transactions and pinned state
+// live on the primary.
+
+// acquireBackend takes a connection from pool for the session and brings it
+// to the session's database and identity.
+func (r *Connection) acquireBackend(pool *backendPool) error {
+	// MySQL cannot go back to no database: a session without one gets a
+	// connection that never had one, or unqualified names would reach the
+	// database of another session.
+	backend, err := pool.checkout(r.pool_key, r.database == "")
+	if err != nil {
+		return err
+	}
+	r.attachBackend(backend)
+
+	if r.database != "" && r.database != backend.database {
+		data := append([]byte{byte(packets.PacketComInitDB)}, r.database...)
+		err = r.forwardCommand(packets.NewGenericPacket(0, data))
+		if err != nil {
+			return err
+		}
+		resp := packets.NewResponseReader(r.server, packets.PacketComInitDB, r.capabilities)
+		for !resp.Done() {
+			_, err = resp.Next()
+			if err != nil {
+				return err
+			}
+		}
+		if resp.Err != nil {
+			return resp.Err
+		}
+		backend.database = r.database
+	}
+	return r.setSessionIdentity()
+}
+
+func (r *Connection) attachBackend(backend *backendConn) {
+	r.backend_mutex.Lock()
+	r.backend = backend
+	r.mysql = backend.conn
+	closed := r.closed
+	r.backend_mutex.Unlock()
+	// Killed while waiting for the pool: the next write fails.
+	if closed {
+		backend.conn.Close()
+	}
+	r.server = backend.reader
+	r.backend_thread = backend.thread
+	r.backend_random = backend.scramble
+	r.publishBackend()
+}
+
+// detachBackend hands the backend connection back to the pool as it is, or
+// closes it when it is not reusable or the session was killed, which may
+// have closed it already.
+func (r *Connection) detachBackend(reusable bool) {
+	r.backend_mutex.Lock()
+	backend := r.backend
+	closed := r.closed
+	r.backend = nil
+	r.mysql = nil
+	r.backend_mutex.Unlock()
+	r.server = nil
+	r.backend_thread = 0
+	r.backend_random = nil
+	r.publishBackend()
+	backend.pool.checkin(backend, reusable && !closed, false)
+}
+
+// holdBackend makes sure a multiplexed session has a backend connection
+// before a command goes to MySQL, taking one from pool when it has none.
+// When it cannot get one ready, the client is answered with an error in
+// place of running the command and it returns false.
+func (r *Connection) holdBackend(pool *backendPool, sequence_id uint8, record *audit.Record, start time.Time) (bool, error) {
+	if !r.multiplex || r.backend != nil {
+		return true, nil
+	}
+	err := r.acquireBackend(pool)
+	if err == nil {
+		return true, nil
+	}
+
+	log.Printf("Failed to get a backend connection: [%d] %s", r.id, err.Error())
+	code, state, message := uint16(1040), "08004", "Too many connections"
+	var err_pkt *packets.MySQLErrPacket
+	if errors.As(err, &err_pkt) {
+		code, state, message = err_pkt.ErrorCode, err_pkt.SQLState, err_pkt.ErrorMessage
+	}
+	if r.backend != nil {
+		r.detachBackend(err_pkt != nil)
+	}
+	if record != nil {
+		record.ErrorCode = code
+	}
+	r.logCommand(record, start, nil)
+	return false, r.writeError(sequence_id+1, code, state, message)
+}
+
+// handBack returns the backend connection of a multiplexed session to the
+// pool when nothing ties the session to it.
+func (r *Connection) handBack() {
+	if !r.multiplex || r.backend == nil {
+		return
+	}
+	if r.backend.pool == r.pool && (r.pinned != "" || r.in_trans) {
+		return
+	}
+	r.detachBackend(true)
+}
+
+// followPools takes up the primary and replicas of the proxy, which change
+// on failover and reload, while the multiplexed session holds no connection.
+func (r *Connection) followPools() {
+	if !r.multiplex || r.backend != nil {
+		return
+	}
+	r.proxy.mutex.RLock()
+	defer r.proxy.mutex.RUnlock()
+	if r.proxy.pool == nil {
+		return
+	}
+	r.pool = r.proxy.pool
+	r.replicas = r.proxy.replicas
+	r.address = r.proxy.address
+}
+
+// routeQuery returns the pool a COM_QUERY should run from: a replica that
+// is up for reads, unless the user or a hint keeps them on the primary, and
+// the primary otherwise. It only matters while the session holds no
+// connection.
+func (r *Connection) routeQuery(pkt *packets.MySQLGenericPacket) *backendPool {
+	if !r.multiplex || len(r.replicas) == 0 || r.backend != nil || len(pkt.Data()) >= 0xffffff {
+		return r.pool
+	}
+	query_pkt := &packets.MySQLCOMQueryPacket{}
+	if query_pkt.Decode(*pkt, r.capabilities) != nil {
+		return r.pool
+	}
+	sql := query_pkt.SQL()
+	// What would pin the session has to stay on the primary.
+	if !sqlparse.ReadOnly(sql) || sqlparse.SessionPin(sql) != "" {
+		return r.pool
+	}
+	// A hint overrides the user's setting, which overrides the default.
+	replica := r.account == nil || r.account.ReadReplicas == nil || *r.account.ReadReplicas
+	switch hint := sqlparse.CommentValue(sql, "route"); {
+	case strings.EqualFold(hint, "primary"):
+		replica = false
+	case strings.EqualFold(hint, "replica"):
+		replica = true
+	}
+	if !replica {
+		return r.pool
+	}
+	for range r.replicas {
+		pool := r.replicas[r.reads%uint64(len(r.replicas))]
+		r.reads++
+		if !pool.isDown() {
+			return pool
+		}
+	}
+	return r.pool
+}
+
+// followTransaction notes what ties a multiplexed session to its backend
+// connection after a command. data is the command as the client sent it.
+func (r *Connection) followTransaction(command packets.PacketMagic, data []byte, resp *packets.ResponseReader) {
+	// A replica only answers reads, then the connection goes back.
+	if !r.multiplex || (r.backend != nil && r.backend.pool != r.pool) {
+		return
+	}
+	if resp.HasStatus {
+		r.in_trans = resp.StatusFlags&packets.ServerStatusInTrans != 0 ||
+			resp.StatusFlags&packets.ServerStatusAutocommit == 0
+	}
+	if resp.OK != nil && resp.OK.LastInsertId != 0 {
+		r.last_insert_id = resp.OK.LastInsertId
+	}
+
+	switch command {
+	case packets.PacketResetConnection:
+		if resp.OK != nil {
+			r.pinned = ""
+			r.in_trans = false
+		}
+		return
+	case packets.PacketComStmtPrepare:
+		r.pin("prepared statement")
+	case packets.PacketComSetOption:
+		r.pin("multiple statements option")
+	case packets.PacketComQuery:
+		query_pkt := &packets.MySQLCOMQueryPacket{}
+		if query_pkt.Decode(*packets.NewGenericPacket(0, data), r.capabilities) == nil {
+			r.pin(sqlparse.SessionPin(query_pkt.SQL()))
+		}
+	}
+	r.pin(sessionStatePin(resp.SessionState))
+}
+
+// pin ties the session to its backend connection for reason, unless it
+// already is or reason is empty.
+func (r *Connection) pin(reason string) {
+	if reason == "" || r.pinned != "" {
+		return
+	}
+	r.pinned = reason
+	r.metrics.pins.With(reason).Inc()
+	log.Printf("Session pinned to backend thread %d by %s: [%d]", r.backend_thread, reason, r.id)
+}
+
+// sessionStatePin tells from the session state changes MySQL reported
+// whether the session was left with state of its own. A change of the
+// database alone is carried over by the proxy.
+func sessionStatePin(state []byte) string {
+	changes, _ := packets.ParseSessionState(state)
+	schema := false
+	for _, change := range changes {
+		if change.Type == packets.SessionTrackSchema {
+			schema = true
+		}
+	}
+	for _, change := range changes {
+		switch change.Type {
+		case packets.SessionTrackSystemVariables:
+			if name, _ := change.Variable(); !strings.EqualFold(name, "autocommit") {
+				return "session variable"
+			}
+		case packets.SessionTrackTransactionCharacteristics:
+			// An empty string is reported once they are used up.
+			if len(change.Data) > 1 {
+				return "transaction characteristics"
+			}
+		case packets.SessionTrackStateChange:
+			if !schema {
+				return "session state"
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"log"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/packets"
+	"regexp"
+	"strings"
+)
+
+var passwordChangeStatements = []*regexp.Regexp{
+	regexp.MustCompile(`(?is)^\s*SET\s+PASSWORD\s*=\s*'((?:[^'\\]|\\.|'')*)'\s*;?\s*$`),
+	regexp.MustCompile(`(?is)^\s*ALTER\s+USER\s+(?:USER\s*\(\s*\)|CURRENT_USER(?:\s*\(\s*\))?)\s+IDENTIFIED\s+BY\s+'((?:[^'\\]|\\.|'')*)'\s*;?\s*$`),
+}
+
+var passwordUnescaper = strings.NewReplacer(`''`, `'`, `\'`, `'`, `\\`, `\`, `\"`, `"`, `\n`, "\n", `\t`, "\t", `\0`, "\x00")
+
+// parsePasswordChange recognizes the statements a client uses to change its
+// own password, "SET PASSWORD = '...'" and
+// "ALTER USER USER() IDENTIFIED BY '...'", and returns the new password.
+func parsePasswordChange(sql string) (string, bool) {
+	for _, statement := range passwordChangeStatements {
+		match := statement.FindStringSubmatch(sql)
+		if match != nil {
+			return passwordUnescaper.Replace(match[1]), true
+		}
+	}
+	return "", false
+}
+
+// runPasswordSandbox serves a client that logged in with an expired password
+// the way MySQL does: nothing but a password change is accepted. The change
+// is made in the proxy password store, after which the session carries on
+// normally. It reports whether the client quit instead.
+func (r *Connection) runPasswordSandbox(proxy_user string) (bool, error) {
+	for {
+		err := r.startWaiting()
+		if err != nil {
+			return true, nil
+		}
+		pkt, err := packets.ReadPacket(r.client_reader)
+		r.stopWaiting()
+		if err != nil {
+			return false, err
+		}
+		data := pkt.Data()
+		if len(data) == 0 {
+			continue
+		}
+		seq := pkt.SequenceId() + 1
+
+		switch packets.PacketMagic(data[0]) {
+		case packets.PacketComQuit:
+			return true, nil
+		case packets.PacketComPing:
+			r.writeOK(seq, 0)
+			continue
+		case packets.PacketComQuery:
+			query_pkt := &packets.MySQLCOMQueryPacket{}
+			if query_pkt.Decode(*pkt, r.capabilities) != nil {
+				break
+			}
+			password, ok := parsePasswordChange(query_pkt.SQL())
+			if !ok {
+				break
+			}
+			// An empty password would leave a token-only account behind.
+			if password == "" {
+				r.writeError(seq, 1819, "HY000", "Your password does not satisfy the current policy requirements")
+				continue
+			}
+			err = r.changePassword(proxy_user, password)
+			if err != nil {
+				log.Printf("Failed to change password of %s: [%d] %s", proxy_user, r.id, err.Error())
+				r.writeError(seq, 1133, "42000", "Could not change the password")
+				return false, err
+			}
+			log.Printf("Password of %s changed: [%d]", proxy_user, r.id)
+			r.must_change_password = false
+			return false, r.writeOK(seq, 0)
+		}
+		r.writeError(seq, 1820, "HY000", "You must reset your password using ALTER USER statement before executing this statement.")
+	}
+}
+
+func (r *Connection) changePassword(proxy_user, password string) error {
+	account, err := authn.ReadProxyAccount(r.accounts, proxy_user)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return authn.ErrUnknownUser
+	}
+	account.Password = password
+	account.PasswordExpiresAt = ""
+	r.account = account
+	return authn.WriteProxyAccount(r.accounts, proxy_user, account)
+}
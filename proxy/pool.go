@@ -0,0 +1,641 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/packets"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolMaxOpen     = 100
+	defaultPoolIdleTimeout = 300 * time.Second
+	defaultPoolWait        = 5 * time.Second
+	// bounds the dial, ping and reset round trips of pooled connections
+	backendTimeout = 10 * time.Second
+	// idle connections are pinged before being handed out once idle this
+	// long
+	pingIdle = time.Second
+)
+
+var ErrPoolExhausted = errors.New("no backend connection available")
+
+// poolKey tells apart connections that cannot stand in for one another:
+// the capabilities a client negotiates shape every packet MySQL sends, and
+// the character set is what a reset connection goes back to.
+type poolKey struct {
+	capabilities packets.CapabilityFlags
+	charset      uint8
+}
+
+// backendConn is an authenticated connection to MySQL, owned by a pool.
+type backendConn struct {
+	pool     *backendPool
+	key      poolKey
+	conn     net.Conn
+	reader   *bufio.Reader
+	thread   uint32
+	scramble []byte
+	created  time.Time
+	idle_at  time.Time
+	// current database, and the identity statement last run on it, so
+	// that multiplexed sessions only restore what differs
+	database string
+	identity string
+}
+
+// backendPool keeps connections to one MySQL server as one account.
+type backendPool struct {
+	address string
+	metrics *proxyMetrics
+
+	mutex        sync.Mutex
+	user         string
+	password     string
+	min_idle     int
+	max_open     int
+	max_lifetime time.Duration
+	idle_timeout time.Duration
+	wait         time.Duration
+	multiplex    bool
+	// MySQL's greeting, from which the one sent to clients is made
+	template *packets.MySQLHandshakePacket
+	// idle connections by key, most recently used last
+	idle   map[poolKey][]*backendConn
+	open   int
+	in_use int
+	// key of the latest checkout, used to keep min_idle connections open
+	last_key *poolKey
+	// closed and replaced whenever a connection is returned or closed
+	changed chan struct{}
+	closed  bool
+	stop    chan struct{}
+	// set while health checks find the server down
+	down bool
+}
+
+func newBackendPool(address string, metrics *proxyMetrics) *backendPool {
+	pool := &backendPool{
+		address: address,
+		metrics: metrics,
+		idle:    map[poolKey][]*backendConn{},
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go pool.maintain()
+	return pool
+}
+
+// configure applies the pool settings and backend credentials, which can
+// change on reload.
+func (r *backendPool) configure(cfg *config.PoolConfig, user, password string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.user = user
+	r.password = password
+	r.min_idle = cfg.MinIdle
+	r.max_open = cfg.MaxOpen
+	if r.max_open <= 0 {
+		r.max_open = defaultPoolMaxOpen
+	}
+	r.max_lifetime = time.Duration(cfg.MaxLifetimeSeconds) * time.Second
+	r.idle_timeout = time.Duration(cfg.IdleTimeoutSeconds) * time.Second
+	if cfg.IdleTimeoutSeconds == 0 {
+		r.idle_timeout = defaultPoolIdleTimeout
+	}
+	r.wait = time.Duration(cfg.WaitMillis) * time.Millisecond
+	if cfg.WaitMillis == 0 {
+		r.wait = defaultPoolWait
+	}
+	r.multiplex = cfg.Multiplex
+}
+
+// multiplexing reports whether sessions hand their connection back between
+// transactions.
+func (r *backendPool) multiplexing() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.multiplex
+}
+
+func (r *backendPool) setDown(down bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.down = down
+}
+
+// isDown reports whether health checks found the server down.
+func (r *backendPool) isDown() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.down
+}
+
+// Close closes the idle connections and those returned from then on.
+func (r *backendPool) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.stop)
+	for key, conns := range r.idle {
+		for _, backend := range conns {
+			r.discardLocked(backend)
+		}
+		delete(r.idle, key)
+	}
+}
+
+// greeting returns the handshake to send a client: MySQL's own, with a
+// scramble of the proxy's since the client never talks to MySQL directly.
+func (r *backendPool) greeting() (*packets.MySQLHandshakePacket, error) {
+	r.mutex.Lock()
+	template := r.template
+	r.mutex.Unlock()
+	if template == nil {
+		conn, err := net.DialTimeout("tcp", r.address, backendTimeout)
+		if err != nil {
+			r.metrics.dial_errors.Inc()
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(backendTimeout))
+		template = &packets.MySQLHandshakePacket{}
+		err = template.Decode(conn)
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.mutex.Lock()
+		r.template = template
+		r.mutex.Unlock()
+	}
+
+	scramble, err := newScramble()
+	if err != nil {
+		return nil, err
+	}
+	greeting := *template
+	greeting.AuthPluginData = append(scramble, 0x00)
+	greeting.AuthPluginDataLen = uint8(len(greeting.AuthPluginData))
+	greeting.AuthPluginName = []byte("mysql_native_password")
+	return &greeting, nil
+}
+
+// poolsFor returns the pools of backend connections cfg asks for, if any,
+// to the primary and to each replica, and closes the pools of accounts and
+// servers no longer in use. Called with mutex held.
+func (r *Proxy) poolsFor(cfg *config.Config) (*backendPool, []*backendPool) {
+	if cfg.Pool == nil {
+		for k, pool := range r.pools {
+			pool.Close()
+			delete(r.pools, k)
+		}
+		return nil, nil
+	}
+	used := map[string]bool{}
+	pool := func(address string) *backendPool {
+		key := cfg.ProxyUser + "@" + address
+		used[key] = true
+		pool := r.pools[key]
+		if pool == nil {
+			pool = newBackendPool(address, r.metrics)
+			r.pools[key] = pool
+		}
+		pool.configure(cfg.Pool, cfg.ProxyUser, cfg.ProxyPass)
+		return pool
+	}
+	primary := pool(r.primaryAddress(cfg))
+	replicas := []*backendPool{}
+	if cfg.Backends != nil {
+		for _, address := range cfg.Backends.Replicas {
+			replicas = append(replicas, pool(address))
+		}
+	}
+	for k, pool := range r.pools {
+		if !used[k] {
+			pool.Close()
+			delete(r.pools, k)
+		}
+	}
+	return primary, replicas
+}
+
+// newScramble returns 20 random printable bytes, as MySQL sends in its
+// greeting.
+func newScramble() ([]byte, error) {
+	scramble := make([]byte, 20)
+	_, err := rand.Read(scramble)
+	if err != nil {
+		return nil, err
+	}
+	for i := range scramble {
+		scramble[i] = '!' + scramble[i]%94
+	}
+	return scramble, nil
+}
+
+// checkout returns a working connection for key: an idle one, pinged if it
+// has been idle for a while, or a new one. When max_open are open it waits for one to be
+// returned, closing idle connections of other keys to make room. With
+// no_database set, only a connection that never had a database chosen
+// will do.
+func (r *backendPool) checkout(key poolKey, no_database bool) (*backendConn, error) {
+	deadline := time.Now().Add(r.wait)
+	for {
+		r.mutex.Lock()
+		if r.closed {
+			r.mutex.Unlock()
+			return nil, ErrPoolExhausted
+		}
+		r.last_key = &key
+		backend := r.popIdle(key, no_database)
+		if backend == nil && r.open >= r.max_open {
+			r.evictIdle()
+		}
+		if backend == nil && r.open < r.max_open {
+			r.open++
+			r.in_use++
+			user, password := r.user, r.password
+			r.mutex.Unlock()
+			backend, err := r.dial(key, user, password)
+			if err != nil {
+				r.mutex.Lock()
+				r.open--
+				r.in_use--
+				r.notifyLocked()
+				r.mutex.Unlock()
+				return nil, err
+			}
+			return backend, nil
+		}
+		if backend != nil {
+			r.in_use++
+		}
+		changed := r.changed
+		wait := r.wait
+		r.mutex.Unlock()
+
+		if backend != nil {
+			if time.Since(backend.idle_at) < pingIdle {
+				return backend, nil
+			}
+			err := backend.ping()
+			if err == nil {
+				return backend, nil
+			}
+			log.Printf("Discarding pooled connection to %s, thread %d: %s", r.address, backend.thread, err)
+			r.discard(backend)
+			continue
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w after %s", ErrPoolExhausted, wait)
+		}
+		select {
+		case <-changed:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// checkin takes back a connection. A connection left between commands is
+// kept, reset first unless the session only hands it back between
+// transactions; anything else is closed.
+func (r *backendPool) checkin(backend *backendConn, reusable, reset bool) {
+	r.mutex.Lock()
+	expired := r.max_lifetime > 0 && time.Since(backend.created) >= r.max_lifetime
+	closed := r.closed
+	r.mutex.Unlock()
+	if !reusable || expired || closed {
+		r.discard(backend)
+		return
+	}
+	var err error
+	if reset {
+		err = backend.reset()
+	}
+	if err != nil {
+		log.Printf("Discarding pooled connection to %s, thread %d: %s", r.address, backend.thread, err)
+		r.discard(backend)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.in_use--
+	if r.closed {
+		r.open--
+		backend.conn.Close()
+		return
+	}
+	backend.idle_at = time.Now()
+	r.idle[backend.key] = append(r.idle[backend.key], backend)
+	r.notifyLocked()
+}
+
+// kill runs KILL for a thread of the server on a connection of the pool.
+func (r *backendPool) kill(key poolKey, thread uint32, query bool) error {
+	backend, err := r.checkout(key, false)
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("KILL CONNECTION %d", thread)
+	if query {
+		sql = fmt.Sprintf("KILL QUERY %d", thread)
+	}
+	data, err := packets.NewCOMQueryPacket(sql, key.capabilities).EncodeData()
+	if err == nil {
+		err = backend.exec(data)
+	}
+	var err_pkt *packets.MySQLErrPacket
+	r.checkin(backend, err == nil || errors.As(err, &err_pkt), false)
+	return err
+}
+
+// discard closes a checked out connection.
+func (r *backendPool) discard(backend *backendConn) {
+	backend.conn.Close()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.open--
+	r.in_use--
+	r.notifyLocked()
+}
+
+// popIdle takes the most recently used idle connection for key, without a
+// database if no_database is set.
+func (r *backendPool) popIdle(key poolKey, no_database bool) *backendConn {
+	conns := r.idle[key]
+	for i := len(conns) - 1; i >= 0; i-- {
+		if no_database && conns[i].database != "" {
+			continue
+		}
+		backend := conns[i]
+		r.idle[key] = append(conns[:i], conns[i+1:]...)
+		return backend
+	}
+	return nil
+}
+
+// evictIdle closes the idle connection unused for the longest, whatever
+// its key, to make room for another.
+func (r *backendPool) evictIdle() {
+	var oldest *backendConn
+	for _, conns := range r.idle {
+		if len(conns) > 0 && (oldest == nil || conns[0].idle_at.Before(oldest.idle_at)) {
+			oldest = conns[0]
+		}
+	}
+	if oldest != nil {
+		r.idle[oldest.key] = r.idle[oldest.key][1:]
+		r.discardLocked(oldest)
+	}
+}
+
+// discardLocked closes an idle connection already taken out of r.idle.
+func (r *backendPool) discardLocked(backend *backendConn) {
+	backend.conn.Close()
+	r.open--
+	r.notifyLocked()
+}
+
+func (r *backendPool) notifyLocked() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// counts returns the number of idle and in use connections.
+func (r *backendPool) counts() (int, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.open - r.in_use, r.in_use
+}
+
+// maintain closes connections idle for too long or past their lifetime,
+// and keeps min_idle connections open for the key seen last.
+func (r *backendPool) maintain() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.mutex.Lock()
+		now := time.Now()
+		idle := r.open - r.in_use
+		for key, conns := range r.idle {
+			kept := conns[:0]
+			for _, backend := range conns {
+				too_old := r.max_lifetime > 0 && now.Sub(backend.created) >= r.max_lifetime
+				unused := now.Sub(backend.idle_at) >= r.idle_timeout && idle > r.min_idle
+				if too_old || unused {
+					r.discardLocked(backend)
+					idle--
+					continue
+				}
+				kept = append(kept, backend)
+			}
+			r.idle[key] = kept
+		}
+		missing := 0
+		var key poolKey
+		if r.last_key != nil {
+			key = *r.last_key
+			missing = r.min_idle - idle
+			if room := r.max_open - r.open; missing > room {
+				missing = room
+			}
+			if missing < 0 || r.closed {
+				missing = 0
+			}
+		}
+		r.open += missing
+		user, password := r.user, r.password
+		r.mutex.Unlock()
+
+		for i := 0; i < missing; i++ {
+			backend, err := r.dial(key, user, password)
+			r.mutex.Lock()
+			if err != nil {
+				r.open--
+			} else if r.closed {
+				r.open--
+				backend.conn.Close()
+			} else {
+				backend.idle_at = time.Now()
+				r.idle[key] = append(r.idle[key], backend)
+			}
+			r.notifyLocked()
+			r.mutex.Unlock()
+		}
+	}
+}
+
+// dial opens and authenticates a new connection.
+func (r *backendPool) dial(key poolKey, user, password string) (*backendConn, error) {
+	conn, err := net.DialTimeout("tcp", r.address, backendTimeout)
+	if err != nil {
+		r.metrics.dial_errors.Inc()
+		log.Printf("Failed to connect to MySQL for the pool: %s", err.Error())
+		return nil, err
+	}
+	counted := r.metrics.countBackend(conn)
+	backend := &backendConn{
+		pool:    r,
+		key:     key,
+		conn:    counted,
+		reader:  bufio.NewReader(counted),
+		created: time.Now(),
+	}
+	conn.SetDeadline(time.Now().Add(backendTimeout))
+	err = backend.login(user, password)
+	if err != nil {
+		conn.Close()
+		log.Printf("Failed to log in to MySQL for the pool: %s", err.Error())
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return backend, nil
+}
+
+func (r *backendConn) login(user, password string) error {
+	greeting := &packets.MySQLHandshakePacket{}
+	err := greeting.Decode(r.reader)
+	if err != nil {
+		r.pool.metrics.decode_errors.With("handshake").Inc()
+		return err
+	}
+	r.pool.mutex.Lock()
+	if r.pool.template == nil {
+		r.pool.template = greeting
+	}
+	r.pool.mutex.Unlock()
+	r.thread = greeting.ConnectionId
+	r.scramble = greeting.AuthPluginData
+
+	var attrs map[string]string
+	if greeting.SupportsConnectAttrs() {
+		attrs = map[string]string{"_client_name": "sqlproxy", "program_name": "sqlproxy-pool"}
+	}
+	auth := packets.NewAuthPacket(r.key.capabilities&greeting.CapabilitiesFlags, r.key.charset, user,
+		authn.HashNativePassword(password, r.scramble), attrs)
+	enc, err := auth.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.Write(enc)
+	if err != nil {
+		return err
+	}
+
+	for {
+		pkt, err := packets.ReadPacket(r.reader)
+		if err != nil {
+			return err
+		}
+		data := pkt.Data()
+		if len(data) == 0 {
+			return fmt.Errorf("empty auth response from MySQL")
+		}
+		switch packets.PacketMagic(data[0]) {
+		case packets.PacketOK:
+			return nil
+		case packets.PacketErr:
+			err_pkt := &packets.MySQLErrPacket{}
+			err_pkt.Decode(pkt)
+			return err_pkt
+		case packets.PacketAuthSwitch:
+			switch_pkt := &packets.MySQLAuthSwitchPacket{}
+			switch_pkt.Decode(pkt)
+			if switch_pkt.PluginName != "mysql_native_password" {
+				return fmt.Errorf("unsupported auth plugin requested by MySQL: %s", switch_pkt.PluginName)
+			}
+			r.scramble = switch_pkt.PluginData
+			if len(r.scramble) == 20 {
+				r.scramble = append(r.scramble, 0x00)
+			}
+			enc, err := packets.NewGenericPacket(pkt.SequenceId()+1, authn.HashNativePassword(password, r.scramble)).Encode()
+			if err != nil {
+				return err
+			}
+			_, err = r.conn.Write(enc)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected auth response from MySQL: 0x%02x", data[0])
+		}
+	}
+}
+
+// ping checks that the connection still works.
+func (r *backendConn) ping() error {
+	return r.simpleCommand(packets.PacketComPing)
+}
+
+// reset clears the session state left by a client with
+// COM_RESET_CONNECTION.
+func (r *backendConn) reset() error {
+	r.identity = ""
+	return r.simpleCommand(packets.PacketResetConnection)
+}
+
+// simpleCommand sends a command made of its code alone and expects OK.
+func (r *backendConn) simpleCommand(command packets.PacketMagic) error {
+	return r.exec([]byte{byte(command)})
+}
+
+// exec sends a command and expects OK.
+func (r *backendConn) exec(data []byte) error {
+	r.conn.SetDeadline(time.Now().Add(backendTimeout))
+	defer r.conn.SetDeadline(time.Time{})
+	command := packets.PacketMagic(data[0])
+	enc, err := packets.NewGenericPacket(0, data).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.Write(enc)
+	if err != nil {
+		return err
+	}
+	resp := packets.NewResponseReader(r.reader, command, r.key.capabilities)
+	for !resp.Done() {
+		_, err = resp.Next()
+		if err != nil {
+			return err
+		}
+	}
+	if resp.Err != nil {
+		return resp.Err
+	}
+	return nil
+}
+
+// query runs sql and returns its result set. The caller sets the deadline.
+func (r *backendConn) query(sql string) (*packets.ResultSet, error) {
+	data, err := packets.NewCOMQueryPacket(sql, r.key.capabilities).EncodeData()
+	if err != nil {
+		return nil, err
+	}
+	enc, err := packets.NewGenericPacket(0, data).Encode()
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.conn.Write(enc)
+	if err != nil {
+		return nil, err
+	}
+	return packets.ReadResultSet(r.reader, r.key.capabilities)
+}
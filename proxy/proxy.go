@@ -1,49 +1,310 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"o2buzzle/sqlproxy/audit"
+	"o2buzzle/sqlproxy/authn"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/metrics"
+	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/slowlog"
+	"sync"
+	"time"
 )
 
-func NewProxy(host, port, p_uname, p_pass string) *Proxy {
-	return &Proxy{
+func NewProxy(host, port string, cfg *config.Config) *Proxy {
+	proxy := &Proxy{
 		host:        host,
 		port:        port,
-		proxy_uname: p_uname,
-		proxy_pass:  p_pass,
+		proxy_uname: cfg.ProxyUser,
+		proxy_pass:  cfg.ProxyPass,
+		config:      cfg,
+		lockout:     NewLockout(cfg.Lockout),
+		totp_steps:  authn.NewTOTPSteps(),
+		digests:     NewDigests(),
+		sessions:    map[uint64]*Connection{},
+		pools:       map[string]*backendPool{},
 	}
+	proxy.health = newHealthChecker(proxy)
+	proxy.metrics = newProxyMetrics(proxy)
+	return proxy
 }
 
 type Proxy struct {
-	host         string
-	port         string
+	host string
+	port string
+	// guards the settings that a reload replaces, down to tagger
+	mutex        sync.RWMutex
+	config_file  string
 	proxy_uname  string
 	proxy_pass   string
+	config       *config.Config
+	tls_config   *tls.Config
+	jwt_verifier *authn.JWTVerifier
+	deny_hosts   []*net.IPNet
+	tagger       *identityTagger
+	// MySQL server sessions connect to
+	address string
+	// set while the standby stands in for the configured primary
+	promoted bool
+	// pools by "user@address", pool and replicas are the ones new sessions
+	// use
+	pools    map[string]*backendPool
+	pool     *backendPool
+	replicas []*backendPool
+
+	lockout      *Lockout
+	totp_steps   *authn.TOTPSteps
+	audit        *audit.Logger
+	slow_log     *slowlog.Logger
+	digests      *Digests
+	metrics      *proxyMetrics
+	health       *healthChecker
 	connectionId uint64
+
+	sessions_mutex sync.Mutex
+	sessions       map[uint64]*Connection
+	active         sync.WaitGroup
+	listener       net.Listener
+	draining       bool
+	drain_timeout  time.Duration
+}
+
+// SetConfigFile sets the file the configuration is read from again on
+// reload.
+func (r *Proxy) SetConfigFile(path string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.config_file = path
+}
+
+// apply builds the settings of cfg that can change while running: backend
+// servers and credentials, TLS, JWT, the accounts file, denied hosts,
+// tagging and pooling. They apply to connections made from then on.
+func (r *Proxy) apply(cfg *config.Config) error {
+	var tls_config *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		tls_config, err = LoadTLSConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+	}
+	var jwt_verifier *authn.JWTVerifier
+	if cfg.JWT != nil {
+		var err error
+		jwt_verifier, err = authn.NewJWTVerifier(cfg.JWT)
+		if err != nil {
+			return err
+		}
+	}
+	deny_hosts, err := authn.ParseHosts(cfg.DenyHosts)
+	if err != nil {
+		return err
+	}
+	tagger, err := newIdentityTagger(cfg.Tagging)
+	if err != nil {
+		return err
+	}
+	// Only a multiplexed session takes a connection per statement.
+	if cfg.Backends != nil && len(cfg.Backends.Replicas) > 0 && (cfg.Pool == nil || !cfg.Pool.Multiplex) {
+		return errors.New("backends.replicas need pool.multiplex")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.proxy_uname = cfg.ProxyUser
+	r.proxy_pass = cfg.ProxyPass
+	r.tls_config = tls_config
+	r.jwt_verifier = jwt_verifier
+	r.deny_hosts = deny_hosts
+	r.tagger = tagger
+	if !sameFailover(r.config.Backends, cfg.Backends) {
+		r.promoted = false
+	}
+	r.config = cfg
+	r.address = r.primaryAddress(cfg)
+	r.pool, r.replicas = r.poolsFor(cfg)
+	return nil
+}
+
+// primaryAddress returns the MySQL server sessions connect to: the
+// configured primary, or the one the proxy was created with, unless the
+// standby took over.
+func (r *Proxy) primaryAddress(cfg *config.Config) string {
+	primary := r.host + r.port
+	if cfg.Backends == nil {
+		return primary
+	}
+	if cfg.Backends.Primary != "" {
+		primary = cfg.Backends.Primary
+	}
+	if r.promoted && cfg.Backends.Standby != "" {
+		return cfg.Backends.Standby
+	}
+	return primary
+}
+
+// sameFailover reports whether two backends configs have the same primary
+// and standby, so that a failover still holds after a reload.
+func sameFailover(a, b *config.BackendsConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Primary == b.Primary && a.Standby == b.Standby
+}
+
+// Reload reads the configuration file again and applies the settings that
+// can change while running. The others, such as listeners and logs, keep
+// their values until a restart.
+func (r *Proxy) Reload() error {
+	r.mutex.RLock()
+	path := r.config_file
+	r.mutex.RUnlock()
+	if path == "" {
+		return errors.New("no configuration file to reload")
+	}
+	cfg, err := config.ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	err = r.apply(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("Configuration reloaded from %s", path)
+	return nil
 }
 
 func (r *Proxy) Start(port string) error {
+	err := r.apply(r.config)
+	if err != nil {
+		return err
+	}
+
+	if r.config.Audit != nil {
+		logger, err := audit.New(r.config.Audit)
+		if err != nil {
+			return err
+		}
+		r.audit = logger
+	}
+	if r.config.SlowLog != nil {
+		r.slow_log = slowlog.New(r.config.SlowLog)
+	}
+	go r.health.run()
+
+	if r.config.Metrics != nil {
+		metrics_ln, err := net.Listen("tcp", r.config.Metrics.Listen)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler(r.metrics.registry))
+		go func() {
+			log.Printf("Metrics server stopped: %s", http.Serve(metrics_ln, mux))
+		}()
+	}
+
+	if r.config.Admin != nil {
+		err = r.startAdmin(r.config.Admin)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.config.StatsD != nil {
+		err = r.startStatsD(r.config.StatsD)
+		if err != nil {
+			return err
+		}
+	}
+
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
 	if err != nil {
 		return err
 	}
+	r.sessions_mutex.Lock()
+	r.listener = ln
+	if r.draining {
+		ln.Close()
+	}
+	r.sessions_mutex.Unlock()
 
 	for {
 		conn, err := ln.Accept()
 		r.connectionId += 1
-		log.Printf("Connection accepted: [%d] %s", r.connectionId, conn.RemoteAddr())
 		if err != nil {
+			if r.isDraining() {
+				r.finishDrain()
+				return nil
+			}
 			log.Printf("Failed to accept new connection: [%d] %s", r.connectionId, err.Error())
 			continue
 		}
+		log.Printf("Connection accepted: [%d] %s", r.connectionId, conn.RemoteAddr())
+		r.metrics.connections.Inc()
+
+		r.mutex.RLock()
+		denied := authn.MatchHosts(r.deny_hosts, net.ParseIP(remoteIP(conn.RemoteAddr())))
+		r.mutex.RUnlock()
+		if denied {
+			go r.deny(conn, r.connectionId)
+			continue
+		}
 
+		r.active.Add(1)
 		go r.handle(conn, r.connectionId)
 	}
 }
 
+// Lockouts lists user names and client IPs with recent failed logins.
+func (r *Proxy) Lockouts() []LockoutEntry {
+	return r.lockout.Entries()
+}
+
+// ClearLockout resets the failure counter of a "user:<name>" or "ip:<addr>"
+// key, or of every key when it is empty.
+func (r *Proxy) ClearLockout(key string) bool {
+	return r.lockout.Clear(key)
+}
+
+// Digests returns the statistics kept by statement fingerprint.
+func (r *Proxy) Digests() []DigestSummary {
+	return r.digests.Summaries()
+}
+
+// ResetDigests clears the statement statistics.
+func (r *Proxy) ResetDigests() {
+	r.digests.Reset()
+}
+
+// deny turns away a client from a denied host the way MySQL does, with an
+// ERR packet in place of the handshake.
+func (r *Proxy) deny(conn net.Conn, connectionId uint64) {
+	defer conn.Close()
+	r.logDeniedConnection(conn.RemoteAddr(), connectionId)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	message := fmt.Sprintf("Host '%s' is not allowed to connect to this MySQL server", remoteIP(conn.RemoteAddr()))
+	enc, err := packets.NewErrPacket(0, 1130, "HY000", message).Encode()
+	if err != nil {
+		return
+	}
+	conn.Write(enc)
+}
+
 func (r *Proxy) handle(conn net.Conn, connectionId uint64) {
-	connection := NewConnection(r.host, r.port, conn, connectionId, r.proxy_uname, r.proxy_pass)
+	defer r.active.Done()
+	connection := NewConnection(r, conn, connectionId)
+	r.addSession(connection)
+	defer r.removeSession(connectionId)
+	defer connection.release()
+	defer connection.countLogout()
 	err := connection.Handle()
 	if err != nil {
 		log.Printf("Error handling proxy connection: %s", err.Error())
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes a client session for the admin interfaces.
+type SessionInfo struct {
+	Id          uint64 `json:"id"`
+	ProxyUser   string `json:"proxy_user"`
+	BackendUser string `json:"backend_user"`
+	// thread id of the backend connection; clients only see Id. 0 while a
+	// multiplexed session holds none.
+	BackendThread uint32 `json:"backend_thread_id"`
+	// MySQL server of the backend connection
+	Backend     string    `json:"backend,omitempty"`
+	Client      string    `json:"client"`
+	Database    string    `json:"db"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// "handshake", "password_change", "idle" or "query"
+	State   string `json:"state"`
+	Command string `json:"command,omitempty"`
+	Query   string `json:"query,omitempty"`
+	// how long the current command has been running
+	QueryUs  int64  `json:"query_us,omitempty"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	// why a multiplexed session keeps its backend connection
+	Pinned string `json:"pinned,omitempty"`
+
+	// only filled in for a single session
+	AuthMethod         string            `json:"auth_method,omitempty"`
+	TLS                bool              `json:"tls,omitempty"`
+	Groups             []string          `json:"groups,omitempty"`
+	ConnectAttrs       map[string]string `json:"connect_attrs,omitempty"`
+	PreparedStatements int               `json:"prepared_statements,omitempty"`
+}
+
+// sessionStatus is a copy of the session's state published by the
+// connection for other goroutines to read.
+type sessionStatus struct {
+	// updated atomically by countingConn
+	bytes_in  uint64
+	bytes_out uint64
+
+	mutex          sync.Mutex
+	client         string
+	connected_at   time.Time
+	state          string
+	proxy_user     string
+	backend_user   string
+	backend_thread uint32
+	backend        string
+	pinned         string
+	database       string
+	command        string
+	query          string
+	command_start  time.Time
+	auth_method    string
+	tls            bool
+	groups         []string
+	connect_attrs  map[string]string
+	statements     int
+}
+
+func newSessionStatus(conn net.Conn) *sessionStatus {
+	return &sessionStatus{
+		client:       conn.RemoteAddr().String(),
+		connected_at: time.Now(),
+		state:        "handshake",
+	}
+}
+
+// publishSession updates the published state of the session, between
+// commands.
+func (r *Connection) publishSession(state string) {
+	_, is_tls := r.conn.(*tls.Conn)
+	status := r.status
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.state = state
+	status.proxy_user = r.proxy_user
+	status.backend_user = r.proxy_uname
+	status.backend_thread = r.backend_thread
+	status.backend = r.backendAddress()
+	status.pinned = r.pinned
+	status.database = r.database
+	status.command = ""
+	status.query = ""
+	status.auth_method = r.auth_method
+	status.tls = is_tls
+	status.groups = r.groups
+	status.connect_attrs = r.connect_attrs
+	status.statements = len(r.statements)
+}
+
+// publishBackend updates the published thread id when a multiplexed
+// session takes or hands back a backend connection.
+func (r *Connection) publishBackend() {
+	status := r.status
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.backend_thread = r.backend_thread
+	status.backend = r.backendAddress()
+}
+
+// backendAddress returns the MySQL server the session is connected to, if
+// any.
+func (r *Connection) backendAddress() string {
+	if r.backend != nil {
+		return r.backend.pool.address
+	}
+	if r.pool == nil {
+		return r.address
+	}
+	return ""
+}
+
+// publishCommand marks the session as running a command.
+func (r *Connection) publishCommand(command, query string, start time.Time) {
+	status := r.status
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.state = "query"
+	status.command = command
+	status.query = query
+	status.command_start = start
+}
+
+func (r *sessionStatus) info(id uint64, detail bool) SessionInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	info := SessionInfo{
+		Id:            id,
+		ProxyUser:     r.proxy_user,
+		BackendUser:   r.backend_user,
+		BackendThread: r.backend_thread,
+		Backend:       r.backend,
+		Client:        r.client,
+		Database:      r.database,
+		ConnectedAt:   r.connected_at,
+		State:         r.state,
+		Command:       r.command,
+		Query:         r.query,
+		BytesIn:       atomic.LoadUint64(&r.bytes_in),
+		BytesOut:      atomic.LoadUint64(&r.bytes_out),
+		Pinned:        r.pinned,
+	}
+	if r.state == "query" {
+		info.QueryUs = time.Since(r.command_start).Microseconds()
+	}
+	if detail {
+		info.AuthMethod = r.auth_method
+		info.TLS = r.tls
+		info.Groups = r.groups
+		info.ConnectAttrs = r.connect_attrs
+		info.PreparedStatements = r.statements
+	}
+	return info
+}
+
+func (r *Proxy) addSession(connection *Connection) {
+	r.sessions_mutex.Lock()
+	defer r.sessions_mutex.Unlock()
+	r.sessions[connection.id] = connection
+}
+
+func (r *Proxy) removeSession(id uint64) {
+	r.sessions_mutex.Lock()
+	defer r.sessions_mutex.Unlock()
+	delete(r.sessions, id)
+}
+
+// Sessions lists the open client sessions by id.
+func (r *Proxy) Sessions() []SessionInfo {
+	r.sessions_mutex.Lock()
+	connections := make([]*Connection, 0, len(r.sessions))
+	for _, connection := range r.sessions {
+		connections = append(connections, connection)
+	}
+	r.sessions_mutex.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(connections))
+	for _, connection := range connections {
+		sessions = append(sessions, connection.status.info(connection.id, false))
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	return sessions
+}
+
+func (r *Proxy) session(id uint64) *Connection {
+	r.sessions_mutex.Lock()
+	defer r.sessions_mutex.Unlock()
+	return r.sessions[id]
+}
+
+// Session describes one session in detail.
+func (r *Proxy) Session(id uint64) (SessionInfo, bool) {
+	connection := r.session(id)
+	if connection == nil {
+		return SessionInfo{}, false
+	}
+	return connection.status.info(id, true), true
+}
+
+// KillSession ends a session, telling the client why. It reports whether
+// the session existed.
+func (r *Proxy) KillSession(id uint64, reason string) bool {
+	connection := r.session(id)
+	if connection == nil {
+		return false
+	}
+	connection.kill(reason)
+	return true
+}
+
+// Drain stops accepting connections and makes Start return once the open
+// sessions have ended. Sessions still open after timeout are killed; a zero
+// timeout waits for them as long as it takes.
+func (r *Proxy) Drain(timeout time.Duration) error {
+	r.sessions_mutex.Lock()
+	if r.draining {
+		r.sessions_mutex.Unlock()
+		return nil
+	}
+	r.draining = true
+	r.drain_timeout = timeout
+	ln := r.listener
+	r.sessions_mutex.Unlock()
+
+	log.Printf("Draining, no longer accepting connections")
+	if ln == nil {
+		return nil
+	}
+	return ln.Close()
+}
+
+func (r *Proxy) isDraining() bool {
+	r.sessions_mutex.Lock()
+	defer r.sessions_mutex.Unlock()
+	return r.draining
+}
+
+// finishDrain waits for the sessions to end once draining, then closes the
+// logs they wrote to.
+func (r *Proxy) finishDrain() {
+	done := make(chan struct{})
+	go func() {
+		r.active.Wait()
+		close(done)
+	}()
+	if r.drain_timeout > 0 {
+		select {
+		case <-done:
+		case <-time.After(r.drain_timeout):
+			for _, session := range r.Sessions() {
+				r.KillSession(session.Id, "proxy is shutting down")
+			}
+		}
+	}
+	<-done
+	log.Printf("Drained")
+	// Delivers the queued records and ends the audit chain with a
+	// checkpoint.
+	err := r.audit.Close()
+	if err != nil {
+		log.Printf("Failed to close the audit log: %s", err.Error())
+	}
+	err = r.slow_log.Close()
+	if err != nil {
+		log.Printf("Failed to close the slow log: %s", err.Error())
+	}
+}
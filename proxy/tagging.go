@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"o2buzzle/sqlproxy/config"
+	"o2buzzle/sqlproxy/packets"
+	"o2buzzle/sqlproxy/sqlparse"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsafeTag = errors.New("identity tag contains unsafe characters")
+
+var tagPlaceholder = regexp.MustCompile(`\{([a-z_]*)\}`)
+
+var tagFields = []string{"user", "conn_id", "client_ip", "trace_id", "app_name"}
+
+// Ways of telling the backend who is behind a query.
+const (
+	tagComment          = "comment"
+	tagQueryAttributes  = "query_attributes"
+	tagSessionVariables = "session_variables"
+)
+
+// identityTagger marks queries with the client behind them, in a comment or
+// in query attributes, or the session with user variables.
+type identityTagger struct {
+	mode     string
+	template string
+	trailing bool
+	reject   bool
+}
+
+func newIdentityTagger(cfg *config.TaggingConfig) (*identityTagger, error) {
+	if cfg == nil {
+		cfg = &config.TaggingConfig{}
+	}
+	tagger := &identityTagger{
+		mode:     cfg.Mode,
+		template: cfg.Template,
+	}
+	if tagger.template == "" {
+		tagger.template = "user: {user}"
+	}
+
+	switch cfg.Mode {
+	case "":
+		tagger.mode = tagComment
+	case tagComment, tagQueryAttributes, tagSessionVariables:
+	default:
+		return nil, fmt.Errorf("unknown tagging mode %q", cfg.Mode)
+	}
+	switch cfg.Position {
+	case "", "leading":
+	case "trailing":
+		tagger.trailing = true
+	default:
+		return nil, fmt.Errorf("unknown tagging position %q", cfg.Position)
+	}
+	switch cfg.Unsafe {
+	case "", "sanitize":
+	case "reject":
+		tagger.reject = true
+	default:
+		return nil, fmt.Errorf("unknown tagging unsafe policy %q", cfg.Unsafe)
+	}
+
+	for _, match := range tagPlaceholder.FindAllStringSubmatch(tagger.template, -1) {
+		if !isTagField(match[1]) {
+			return nil, fmt.Errorf("unknown tagging template field %q", match[0])
+		}
+	}
+	static := tagPlaceholder.ReplaceAllString(tagger.template, "")
+	if strings.Contains(static, "*/") || strings.Contains(static, "/*") {
+		return nil, fmt.Errorf("tagging template must not open or close comments: %q", tagger.template)
+	}
+	return tagger, nil
+}
+
+// tag adds the comment to sql, filling in the template from the session.
+func (t *identityTagger) tag(sql string, r *Connection) (string, error) {
+	var err error
+	text := tagPlaceholder.ReplaceAllStringFunc(t.template, func(placeholder string) string {
+		value, changed := sqlparse.SanitizeCommentText(r.tagValue(placeholder[1:len(placeholder)-1], sql))
+		if changed && t.reject {
+			err = ErrUnsafeTag
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return sqlparse.InjectComment(sql, text, t.trailing)
+}
+
+// attributes returns the query attributes carrying the identity, one per
+// field that has a value.
+func (t *identityTagger) attributes(sql string, r *Connection) []packets.QueryAttribute {
+	attrs := []packets.QueryAttribute{}
+	for _, field := range tagFields {
+		if value := r.tagValue(field, sql); value != "" {
+			attrs = append(attrs, packets.StringQueryAttribute("proxy_"+field, value))
+		}
+	}
+	return attrs
+}
+
+// sessionSQL returns the statement setting the identity user variables.
+// They are set once, and the client can change them with a SET of its own.
+func (t *identityTagger) sessionSQL(r *Connection) string {
+	return fmt.Sprintf("SET @proxy_user = %s, @proxy_client = %s",
+		sqlparse.StringLiteral(r.proxy_user), sqlparse.StringLiteral(r.conn.RemoteAddr().String()))
+}
+
+func isTagField(name string) bool {
+	for _, field := range tagFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValue returns the value of a tagging template field for a query.
+func (r *Connection) tagValue(field, sql string) string {
+	switch field {
+	case "user":
+		return r.proxy_user
+	case "conn_id":
+		return strconv.FormatUint(r.id, 10)
+	case "client_ip":
+		return remoteIP(r.conn.RemoteAddr())
+	case "trace_id":
+		if trace_id := sqlparse.CommentValue(sql, "trace_id"); trace_id != "" {
+			return trace_id
+		}
+		if traceparent := sqlparse.CommentValue(sql, "traceparent"); traceparent != "" {
+			return traceparent
+		}
+		return r.ConnectAttr("trace_id")
+	case "app_name":
+		return r.clientProgram()
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+	"o2buzzle/sqlproxy/packets"
+	"reflect"
+	"testing"
+)
+
+// CLIENT_QUERY_ATTRIBUTES
+const queryAttributesCapability = packets.CapabilityFlags(1 << 27)
+
+func TestTagQueryAttributes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	r := &Connection{
+		conn:         server,
+		id:           7,
+		proxy_user:   "alice",
+		capabilities: queryAttributesCapability,
+		tagger:       &identityTagger{mode: tagQueryAttributes},
+	}
+
+	query_pkt := packets.NewCOMQueryPacket("SELECT 1", queryAttributesCapability)
+	query_pkt.Attributes = []packets.QueryAttribute{
+		packets.StringQueryAttribute("proxy_user", "root"),
+		packets.StringQueryAttribute("app", "web"),
+		packets.StringQueryAttribute("proxy_user", "admin"),
+		packets.StringQueryAttribute("proxy_role", "dba"),
+	}
+	data, err := query_pkt.EncodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := r.tagQuery(packets.NewGenericPacket(0, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = query_pkt.Decode(*tagged, queryAttributesCapability)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []packets.QueryAttribute{
+		packets.StringQueryAttribute("app", "web"),
+		packets.StringQueryAttribute("proxy_user", "alice"),
+		packets.StringQueryAttribute("proxy_conn_id", "7"),
+		packets.StringQueryAttribute("proxy_client_ip", "pipe"),
+	}
+	if query_pkt.SQL() != "SELECT 1" || !reflect.DeepEqual(query_pkt.Attributes, want) {
+		t.Fatalf("tagged %q %+v", query_pkt.SQL(), query_pkt.Attributes)
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"o2buzzle/sqlproxy/config"
+	"os"
+)
+
+func LoadTLSConfig(cfg *config.TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tls_config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.ClientCAFile)
+		}
+		tls_config.ClientCAs = pool
+		tls_config.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tls_config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tls_config, nil
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// packetWriter buffers the packets of a response to the client so that they
+// go out together. It is safe for concurrent use, so that a session can be
+// killed while a response is being written.
+type packetWriter struct {
+	mu  sync.Mutex
+	buf *bufio.Writer
+}
+
+func newPacketWriter(w io.Writer) *packetWriter {
+	return &packetWriter{buf: bufio.NewWriter(w)}
+}
+
+func (r *packetWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *packetWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Flush()
+}
@@ -0,0 +1,111 @@
+// Package slowlog writes commands that took longer than a threshold to a
+// file in the MySQL slow query log format, so that tools such as
+// pt-query-digest can read it.
+package slowlog
+
+import (
+	"fmt"
+	"o2buzzle/sqlproxy/audit"
+	"o2buzzle/sqlproxy/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a command as it goes into the slow log.
+type Entry struct {
+	// when the command was received
+	Time        time.Time
+	Duration    time.Duration
+	ProxyUser   string
+	BackendUser string
+	ClientIP    string
+	ConnId      uint64
+	Database    string
+	// COM_QUERY, COM_STMT_EXECUTE, ...
+	Command string
+	// empty for commands that carry no SQL
+	SQL          string
+	RowsSent     uint64
+	RowsAffected uint64
+	ErrorCode    uint16
+}
+
+// Logger writes slow entries to a file. A nil *Logger discards them.
+type Logger struct {
+	mu        sync.Mutex
+	sink      *audit.FileSink
+	threshold time.Duration
+	users     map[string]time.Duration
+}
+
+func New(cfg *config.SlowLogConfig) *Logger {
+	threshold := time.Second
+	if cfg.ThresholdMs != nil {
+		threshold = time.Duration(*cfg.ThresholdMs) * time.Millisecond
+	}
+	logger := &Logger{
+		sink:      audit.NewFileSink(cfg.File, cfg.Rotation),
+		threshold: threshold,
+		users:     map[string]time.Duration{},
+	}
+	for user, ms := range cfg.UserThresholdMs {
+		logger.users[user] = time.Duration(ms) * time.Millisecond
+	}
+	return logger
+}
+
+// Threshold returns how long commands of user may take before they are
+// logged.
+func (r *Logger) Threshold(user string) time.Duration {
+	if threshold, ok := r.users[user]; ok {
+		return threshold
+	}
+	return r.threshold
+}
+
+// Log writes entry if it took longer than the threshold of its user.
+func (r *Logger) Log(entry *Entry) error {
+	if r == nil || entry.Duration < r.Threshold(entry.ProxyUser) {
+		return nil
+	}
+	text := format(entry)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sink.Write([]byte(text))
+}
+
+func (r *Logger) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sink.Close()
+}
+
+// format renders an entry the way mysqld writes it, with the proxy user in
+// place of the priv user and the backend user in place of the user.
+func format(entry *Entry) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# Time: %s\n", entry.Time.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	fmt.Fprintf(b, "# User@Host: %s[%s] @  [%s]  Id: %d\n", entry.ProxyUser, entry.BackendUser, entry.ClientIP, entry.ConnId)
+	fmt.Fprintf(b, "# Query_time: %.6f  Lock_time: 0.000000  Rows_sent: %d  Rows_examined: 0  Rows_affected: %d  Errno: %d\n",
+		entry.Duration.Seconds(), entry.RowsSent, entry.RowsAffected, entry.ErrorCode)
+	if entry.Database != "" {
+		fmt.Fprintf(b, "use %s;\n", quoteIdent(entry.Database))
+	}
+	fmt.Fprintf(b, "SET timestamp=%d;\n", entry.Time.Unix())
+	if entry.SQL == "" {
+		fmt.Fprintf(b, "# administrator command: %s;\n", entry.Command)
+		return b.String()
+	}
+	sql := strings.TrimRight(entry.SQL, "; \t\r\n")
+	b.WriteString(sql)
+	b.WriteString(";\n")
+	return b.String()
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
@@ -0,0 +1,72 @@
+package slowlog
+
+import (
+	"encoding/json"
+	"o2buzzle/sqlproxy/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThreshold(t *testing.T) {
+	tests := []struct {
+		config string
+		user   time.Duration
+		other  time.Duration
+	}{
+		{`{}`, time.Second, time.Second},
+		{`{"threshold_ms": 0}`, 0, 0},
+		{`{"threshold_ms": 250, "user_threshold_ms": {"batch": 0}}`, 0, 250 * time.Millisecond},
+		{`{"user_threshold_ms": {"batch": 5000}}`, 5 * time.Second, time.Second},
+	}
+	for _, test := range tests {
+		cfg := &config.SlowLogConfig{}
+		err := json.Unmarshal([]byte(test.config), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.File = filepath.Join(t.TempDir(), "slow.log")
+		logger := New(cfg)
+		if logger.Threshold("batch") != test.user || logger.Threshold("web") != test.other {
+			t.Errorf("%s: thresholds %v and %v", test.config, logger.Threshold("batch"), logger.Threshold("web"))
+		}
+		logger.Close()
+	}
+}
+
+func TestLogEverything(t *testing.T) {
+	threshold := 0
+	path := filepath.Join(t.TempDir(), "slow.log")
+	logger := New(&config.SlowLogConfig{File: path, ThresholdMs: &threshold})
+	err := logger.Log(&Entry{
+		Time:        time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC),
+		ProxyUser:   "alice",
+		BackendUser: "app",
+		ClientIP:    "10.0.0.1",
+		ConnId:      3,
+		Database:    "shop",
+		Command:     "COM_QUERY",
+		SQL:         "SELECT 1;",
+		RowsSent:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Close()
+
+	data, _ := os.ReadFile(path)
+	want := strings.Join([]string{
+		"# Time: 2026-10-19T08:00:00.000000Z",
+		"# User@Host: alice[app] @  [10.0.0.1]  Id: 3",
+		"# Query_time: 0.000000  Lock_time: 0.000000  Rows_sent: 1  Rows_examined: 0  Rows_affected: 0  Errno: 0",
+		"use `shop`;",
+		"SET timestamp=1792396800;",
+		"SELECT 1;",
+		"",
+	}, "\n")
+	if string(data) != want {
+		t.Fatalf("logged\n%s\nwant\n%s", data, want)
+	}
+}
@@ -0,0 +1,101 @@
+package sqlparse
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var ErrUnsafeComment = errors.New("comment text would end the comment")
+
+// InjectComment adds "/* text */" to sql. By default it goes before the
+// statement, where it cannot be swallowed by a trailing -- or # comment. When
+// trailing is set it goes right after the last token of the statement, ahead
+// of trailing comments and semicolons. Statements made of nothing but
+// comments and whitespace are returned as they are.
+func InjectComment(sql, text string, trailing bool) (string, error) {
+	if strings.Contains(text, "*/") || strings.Contains(text, "/*") {
+		return "", ErrUnsafeComment
+	}
+	comment := "/* " + text + " */"
+
+	tokens := Tokenize(sql)
+	first, last := -1, -1
+	for i, token := range tokens {
+		if !token.Significant() || token.Type == TokenPunct && token.Text == ";" {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		last = i
+	}
+	if first == -1 {
+		return sql, nil
+	}
+
+	if trailing {
+		end := tokens[last].Pos + len(tokens[last].Text)
+		tagged := sql[:end] + " " + comment + sql[end:]
+		// An unterminated string or comment at the end would take the
+		// comment in, in which case it goes in front after all.
+		for _, token := range Tokenize(tagged) {
+			if token.Type == TokenComment && token.Pos == end+1 && token.Text == comment {
+				return tagged, nil
+			}
+		}
+	}
+	return comment + " " + sql, nil
+}
+
+// SanitizeCommentText replaces everything but letters, digits, spaces and
+// _ . - @ : , = + from s with '_', so that it can go into a comment
+// whatever it came from. Without / it cannot open or close one next to the
+// text around it either. It reports whether s had to be changed.
+func SanitizeCommentText(s string) (string, bool) {
+	changed := false
+	ret := strings.Map(func(c rune) rune {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune(" _.-@:,=+", c) {
+			return c
+		}
+		changed = true
+		return '_'
+	}, s)
+	return ret, changed
+}
+
+// CommentValue looks for key=value or key='value' in the comments of sql, as
+// written by sqlcommenter and similar libraries, and returns the value.
+func CommentValue(sql, key string) string {
+	for _, token := range Tokenize(sql) {
+		if token.Type != TokenComment {
+			continue
+		}
+		text := token.Text
+		for {
+			index := strings.Index(text, key+"=")
+			if index == -1 {
+				break
+			}
+			// Only whole keys, not the end of a longer one.
+			if index > 0 && (isWordChar(text[index-1]) || text[index-1] == '-') {
+				text = text[index+len(key)+1:]
+				continue
+			}
+			value := text[index+len(key)+1:]
+			if strings.HasPrefix(value, "'") || strings.HasPrefix(value, "\"") {
+				end := strings.IndexByte(value[1:], value[0])
+				if end == -1 {
+					return ""
+				}
+				return value[1 : end+1]
+			}
+			end := strings.IndexAny(value, " \t\r\n,*")
+			if end == -1 {
+				end = len(value)
+			}
+			return value[:end]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package sqlparse
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInjectComment(t *testing.T) {
+	tests := []struct {
+		sql      string
+		trailing bool
+		want     string
+	}{
+		{"SELECT 1", false, "/* user: a */ SELECT 1"},
+		{"SELECT 1", true, "SELECT 1 /* user: a */"},
+		{"SELECT 1; -- done", true, "SELECT 1 /* user: a */; -- done"},
+		{"SELECT 1 # note", true, "SELECT 1 /* user: a */ # note"},
+		{"SELECT 1; SELECT 2;", true, "SELECT 1; SELECT 2 /* user: a */;"},
+		// The comment would end up inside the unterminated string.
+		{"SELECT 'open", true, "/* user: a */ SELECT 'open"},
+		{"-- nothing else", false, "-- nothing else"},
+	}
+	for _, test := range tests {
+		got, err := InjectComment(test.sql, "user: a", test.trailing)
+		if err != nil || got != test.want {
+			t.Errorf("%q: got %q, %v", test.sql, got, err)
+		}
+	}
+	if _, err := InjectComment("SELECT 1", "a */ DROP TABLE t; /*", false); err != ErrUnsafeComment {
+		t.Errorf("unsafe text: %v", err)
+	}
+}
+
+func TestSanitizeCommentText(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		changed bool
+	}{
+		{"alice@example.com", "alice@example.com", false},
+		{"app-1.2, build=7+x: ok", "app-1.2, build=7+x: ok", false},
+		{"*/ DROP TABLE t", "__ DROP TABLE t", true},
+		{"/usr/bin/mysql", "_usr_bin_mysql", true},
+		{"line\nbreak", "line_break", true},
+	}
+	for _, test := range tests {
+		got, changed := SanitizeCommentText(test.value)
+		if got != test.want || changed != test.changed {
+			t.Errorf("%q: got %q, %v", test.value, got, changed)
+		}
+	}
+
+	// A value cannot open or close a comment with the template around it.
+	for _, template := range []string{"*%s", "%s*", "x* %s *x"} {
+		for _, value := range []string{"/", "a/", "/a", "//"} {
+			sanitized, _ := SanitizeCommentText(value)
+			text := fmt.Sprintf(template, sanitized)
+			if _, err := InjectComment("SELECT 1", text, false); err != nil {
+				t.Errorf("template %q, value %q: %v", template, value, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package sqlparse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Fingerprint normalizes sql so that statements differing only in their
+// literals map to the same text: comments and hints are dropped, literals
+// become ?, IN lists and multi-row VALUES lists of literals collapse to
+// (...), keywords and names are lowercased and spacing is made uniform.
+// Quoted identifiers are kept as they are.
+func Fingerprint(sql string) string {
+	all := Tokenize(sql)
+	tokens := make([]Token, 0, len(all))
+	for _, token := range all {
+		if token.Significant() && token.Type != TokenHint {
+			tokens = append(tokens, token)
+		}
+	}
+	for len(tokens) > 0 && tokens[len(tokens)-1].Text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	var b strings.Builder
+	b.Grow(len(sql))
+	last := ""
+	emit := func(text string, space bool) {
+		if b.Len() > 0 && space {
+			b.WriteByte(' ')
+		}
+		b.WriteString(text)
+		last = text
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		space := needsSpace(last, token, i > 0 && tokens[i-1].Pos+len(tokens[i-1].Text) < token.Pos)
+
+		switch {
+		case token.Is("in") && i+1 < len(tokens) && tokens[i+1].Text == "(":
+			if end, ok := literalList(tokens, i+1); ok {
+				emit("in", space)
+				emit("(...)", true)
+				i = end - 1
+				continue
+			}
+		case token.Is("values") || token.Is("value"):
+			end, ok := literalList(tokens, i+1)
+			if ok {
+				for end+1 < len(tokens) && tokens[end].Text == "," {
+					next, ok := literalList(tokens, end+1)
+					if !ok {
+						break
+					}
+					end = next
+				}
+				emit(strings.ToLower(token.Text), space)
+				emit("(...)", true)
+				i = end - 1
+				continue
+			}
+		case token.Text == "-" || token.Text == "+":
+			// A sign belongs to the literal it precedes.
+			if i+1 < len(tokens) && tokens[i+1].Type == TokenNumber && !isOperand(last) {
+				continue
+			}
+		}
+
+		switch token.Type {
+		case TokenString, TokenNumber, TokenPlaceholder:
+			emit("?", space)
+		case TokenWord:
+			emit(strings.ToLower(token.Text), space)
+		case TokenExecComment:
+			emit(strings.Join(strings.Fields(token.Text), " "), space)
+		default:
+			emit(token.Text, space)
+		}
+	}
+	return b.String()
+}
+
+// Digest returns a short, stable hash of a fingerprint.
+func Digest(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(sum[:8])
+}
+
+// needsSpace decides whether a space goes between the text emitted last and
+// token. spaced tells whether the statement had one there.
+func needsSpace(last string, token Token, spaced bool) bool {
+	switch {
+	case last == "" || last == "(" || last == ".":
+		return false
+	case token.Text == "," || token.Text == ")" || token.Text == ".":
+		return false
+	case token.Text == "(":
+		// f(x) and f (x) may be different things to MySQL, see
+		// IGNORE_SPACE.
+		return spaced || !isName(last)
+	}
+	return true
+}
+
+// literalList checks whether tokens[i] opens a parenthesized list of
+// literals, returning the index after its closing parenthesis.
+func literalList(tokens []Token, i int) (int, bool) {
+	if i >= len(tokens) || tokens[i].Text != "(" {
+		return 0, false
+	}
+	for j := i + 1; j < len(tokens); j++ {
+		token := tokens[j]
+		switch {
+		case token.Text == ")":
+			return j + 1, j > i+1
+		case token.Type == TokenString, token.Type == TokenNumber, token.Type == TokenPlaceholder:
+		case token.Text == "," || token.Text == "-" || token.Text == "+":
+		case token.Is("null"), token.Is("default"), token.Is("true"), token.Is("false"):
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// isOperand reports whether the text emitted last ends an operand, after
+// which + and - are operators rather than signs.
+func isOperand(last string) bool {
+	switch {
+	case last == "?" || last == ")":
+		return true
+	case !isName(last):
+		return false
+	}
+	switch last {
+	case "select", "where", "and", "or", "not", "when", "then", "else", "by",
+		"limit", "offset", "between", "like", "return", "set", "having", "on", "interval":
+		return false
+	}
+	return true
+}
+
+func isName(text string) bool {
+	return text != "" && (isWordChar(text[0]) || text[0] == '`' || text[0] == '@')
+}
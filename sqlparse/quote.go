@@ -0,0 +1,48 @@
+package sqlparse
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// StringLiteral returns s as a SQL string literal. It is written in hex with a
+// utf8mb4 introducer, which reads the same whatever the sql_mode, e.g. with
+// NO_BACKSLASH_ESCAPES.
+func StringLiteral(s string) string {
+	return "_utf8mb4 X'" + hex.EncodeToString([]byte(s)) + "'"
+}
+
+var stringEscapes = map[byte]string{'0': "\x00", 'b': "\b", 'n': "\n", 'r': "\r", 't': "\t", 'Z': "\x1a", '%': `\%`, '_': `\_`}
+
+// StringValue returns the text of a string literal token, with its escapes
+// and doubled quotes resolved.
+func StringValue(token Token) string {
+	text := token.Text
+	if len(text) > 0 && text[0] != '\'' && text[0] != '"' {
+		// N'..', and X'..' or B'..' whose value is not text anyway
+		text = text[1:]
+	}
+	if len(text) < 2 {
+		return ""
+	}
+	quote := text[0]
+	text = text[1 : len(text)-1]
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && i+1 < len(text):
+			i++
+			if escape, ok := stringEscapes[text[i]]; ok {
+				b.WriteString(escape)
+			} else {
+				b.WriteByte(text[i])
+			}
+		case text[i] == quote && i+1 < len(text) && text[i+1] == quote:
+			i++
+			b.WriteByte(quote)
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String()
+}
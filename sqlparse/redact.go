@@ -0,0 +1,19 @@
+package sqlparse
+
+import "strings"
+
+// Redact replaces the string and number literals of sql with ?, leaving
+// everything else, comments included, as it is.
+func Redact(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+	for _, token := range Tokenize(sql) {
+		switch token.Type {
+		case TokenString, TokenNumber:
+			b.WriteByte('?')
+		default:
+			b.WriteString(token.Text)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,234 @@
+package sqlparse
+
+import "strings"
+
+// UseDatabase returns the database a USE statement switches to.
+func UseDatabase(sql string) (string, bool) {
+	tokens := Significant(Tokenize(sql))
+	if len(tokens) < 2 || !tokens[0].Is("USE") {
+		return "", false
+	}
+	for _, token := range tokens[2:] {
+		if token.Type != TokenPunct || token.Text != ";" {
+			return "", false
+		}
+	}
+	return Unquote(tokens[1]), true
+}
+
+// Unquote returns the identifier a word or quoted identifier token stands
+// for.
+func Unquote(token Token) string {
+	if token.Type != TokenQuotedIdent || len(token.Text) < 2 {
+		return token.Text
+	}
+	return strings.ReplaceAll(token.Text[1:len(token.Text)-1], "``", "`")
+}
+
+// MultiStatement reports whether sql holds more than one statement.
+func MultiStatement(sql string) bool {
+	tokens := Significant(Tokenize(sql))
+	for i, token := range tokens {
+		if token.Type == TokenPunct && token.Text == ";" && i+1 < len(tokens) && tokens[i+1].Text != ";" {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionPin returns why the statements in sql leave state behind in the
+// MySQL session beyond the current transaction, which a later statement on
+// another connection would not find, or "" when they do not. Only
+// autocommit may be set freely: it shows in the status flags.
+func SessionPin(sql string) string {
+	tokens := Significant(Tokenize(sql))
+	for len(tokens) > 0 {
+		end := 0
+		for end < len(tokens) && !(tokens[end].Type == TokenPunct && tokens[end].Text == ";") {
+			end++
+		}
+		if reason := statementPin(tokens[:end]); reason != "" {
+			return reason
+		}
+		if end == len(tokens) {
+			break
+		}
+		tokens = tokens[end+1:]
+	}
+	return ""
+}
+
+func statementPin(tokens []Token) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	switch {
+	case tokens[0].Is("SET") && !setsAutocommit(tokens[1:]):
+		return "session variable"
+	case len(tokens) > 1 && tokens[0].Is("CREATE") && tokens[1].Is("TEMPORARY"):
+		return "temporary table"
+	case tokens[0].Is("LOCK"):
+		return "table lock"
+	case tokens[0].Is("FLUSH") && len(tokens) > 2 && tokens[len(tokens)-1].Is("LOCK"):
+		return "table lock"
+	case tokens[0].Is("PREPARE"):
+		return "prepared statement"
+	case tokens[0].Is("HANDLER"):
+		return "handler"
+	}
+	for i, token := range tokens {
+		switch {
+		case token.Type == TokenVariable && !strings.HasPrefix(token.Text, "@@"):
+			return "user variable"
+		case token.Is("GET_LOCK") && i+1 < len(tokens) && tokens[i+1].Text == "(":
+			return "named lock"
+		case token.Is("SQL_CALC_FOUND_ROWS"):
+			return "found rows"
+		case token.Is("LAST_INSERT_ID") && i+2 < len(tokens) && tokens[i+1].Text == "(" && tokens[i+2].Text != ")":
+			return "last insert id"
+		}
+	}
+	return ""
+}
+
+// setsAutocommit recognizes the assignment of a "SET autocommit = 0" and its
+// SESSION and @@ spellings.
+func setsAutocommit(tokens []Token) bool {
+	if len(tokens) > 0 && (tokens[0].Is("SESSION") || tokens[0].Is("LOCAL")) {
+		tokens = tokens[1:]
+	}
+	if len(tokens) != 3 || (tokens[1].Text != "=" && tokens[1].Text != ":=") {
+		return false
+	}
+	name := strings.ToLower(tokens[0].Text)
+	switch name {
+	case "autocommit", "@@autocommit", "@@session.autocommit", "@@local.autocommit":
+		return tokens[2].Type == TokenNumber || tokens[2].Type == TokenWord
+	}
+	return false
+}
+
+// ReadOnly reports whether sql only reads, without locking rows, so that a
+// replica can answer it: SELECT statements, or WITH ... SELECT, without
+// FOR UPDATE, FOR SHARE, LOCK IN SHARE MODE or INTO.
+func ReadOnly(sql string) bool {
+	tokens := Significant(Tokenize(sql))
+	statements := 0
+	for len(tokens) > 0 {
+		end := 0
+		for end < len(tokens) && !(tokens[end].Type == TokenPunct && tokens[end].Text == ";") {
+			end++
+		}
+		if end > 0 {
+			if !readOnlyStatement(tokens[:end]) {
+				return false
+			}
+			statements++
+		}
+		if end == len(tokens) {
+			break
+		}
+		tokens = tokens[end+1:]
+	}
+	return statements > 0
+}
+
+func readOnlyStatement(tokens []Token) bool {
+	first := 0
+	for first < len(tokens) && tokens[first].Text == "(" {
+		first++
+	}
+	if first == len(tokens) || !(tokens[first].Is("SELECT") || tokens[first].Is("WITH")) {
+		return false
+	}
+	with := tokens[first].Is("WITH")
+	for i, token := range tokens {
+		switch {
+		case token.Is("INTO"), token.Is("LOCK"):
+			return false
+		case token.Is("FOR") && i+1 < len(tokens) && (tokens[i+1].Is("UPDATE") || tokens[i+1].Is("SHARE")):
+			return false
+		// Common table expressions can also feed an UPDATE or a DELETE.
+		case with && (token.Is("UPDATE") || token.Is("DELETE")):
+			return false
+		}
+	}
+	return true
+}
+
+// HasKill reports whether sql holds a KILL statement anywhere MySQL would
+// run it: on its own or among several statements, in an executable comment,
+// in the text of a PREPARE or in the body of a stored program.
+func HasKill(sql string) bool {
+	tokens := expandExecComments(Significant(Tokenize(sql)))
+	for len(tokens) > 0 {
+		end := 0
+		for end < len(tokens) && !(tokens[end].Type == TokenPunct && tokens[end].Text == ";") {
+			end++
+		}
+		statement := tokens[:end]
+		// The body of a stored program runs to the end, across semicolons.
+		if DefinesStoredObject(statement) {
+			for _, token := range tokens {
+				if token.Is("KILL") {
+					return true
+				}
+			}
+			return false
+		}
+		if len(statement) > 0 && statement[0].Is("KILL") {
+			return true
+		}
+		if len(statement) > 0 && statement[0].Is("PREPARE") {
+			for i := 1; i+1 < len(statement); i++ {
+				if statement[i].Is("FROM") && statement[i+1].Type == TokenString && HasKill(StringValue(statement[i+1])) {
+					return true
+				}
+			}
+		}
+		if end == len(tokens) {
+			break
+		}
+		tokens = tokens[end+1:]
+	}
+	return false
+}
+
+// DefinesStoredObject reports whether a statement, given by its significant
+// tokens, creates or alters a trigger, procedure, function, view or event,
+// whose body is kept to run later.
+func DefinesStoredObject(tokens []Token) bool {
+	if len(tokens) == 0 || !(tokens[0].Is("CREATE") || tokens[0].Is("ALTER")) {
+		return false
+	}
+	// OR REPLACE, DEFINER, ALGORITHM and SQL SECURITY come before the kind
+	// of object.
+	for _, token := range tokens[1:] {
+		switch {
+		case token.Is("TRIGGER"), token.Is("PROCEDURE"), token.Is("FUNCTION"), token.Is("VIEW"), token.Is("EVENT"):
+			return true
+		case token.Is("TABLE"), token.Is("INDEX"), token.Is("DATABASE"), token.Is("SCHEMA"), token.Is("USER"), token.Is("ROLE"):
+			return false
+		}
+	}
+	return false
+}
+
+// expandExecComments puts the tokens inside /*! executable comments */ in
+// place of the comments.
+func expandExecComments(tokens []Token) []Token {
+	ret := make([]Token, 0, len(tokens))
+	for _, token := range tokens {
+		if token.Type != TokenExecComment {
+			ret = append(ret, token)
+			continue
+		}
+		text := strings.TrimSuffix(token.Text[3:], "*/")
+		// the optional version, e.g. /*!50110 KEY_BLOCK_SIZE=1024 */
+		for len(text) > 0 && isDigit(text[0]) {
+			text = text[1:]
+		}
+		ret = append(ret, expandExecComments(Significant(Tokenize(text)))...)
+	}
+	return ret
+}
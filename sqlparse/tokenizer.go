@@ -0,0 +1,221 @@
+// Package sqlparse splits MySQL statements into tokens, enough to place
+// comments safely, normalize statements and recognize the few statements the
+// proxy acts on. It does not build a syntax tree.
+package sqlparse
+
+import (
+	"strings"
+)
+
+type TokenType int
+
+const (
+	TokenWhitespace TokenType = iota
+	// -- comment, # comment or /* comment */
+	TokenComment
+	// /*+ optimizer hint */
+	TokenHint
+	// /*! executable comment */, which MySQL runs as part of the statement
+	TokenExecComment
+	// 'string' or "string", including X'..', B'..' and N'..' literals
+	TokenString
+	// `quoted identifier`
+	TokenQuotedIdent
+	TokenNumber
+	// keyword or identifier
+	TokenWord
+	// @user_variable or @@system_variable
+	TokenVariable
+	// ? placeholder
+	TokenPlaceholder
+	TokenPunct
+)
+
+type Token struct {
+	Type TokenType
+	Text string
+	// byte offset of the token in the statement
+	Pos int
+}
+
+// Significant reports whether the token is part of the statement itself, as
+// opposed to whitespace and plain comments.
+func (r Token) Significant() bool {
+	return r.Type != TokenWhitespace && r.Type != TokenComment
+}
+
+// Is reports whether the token is the given keyword, ignoring case.
+func (r Token) Is(keyword string) bool {
+	return r.Type == TokenWord && strings.EqualFold(r.Text, keyword)
+}
+
+// Tokenize splits sql into tokens. Unterminated strings and comments run to
+// the end of the statement, so every byte belongs to exactly one token.
+func Tokenize(sql string) []Token {
+	tokens := []Token{}
+	for pos := 0; pos < len(sql); {
+		typ, end := scanToken(sql, pos)
+		tokens = append(tokens, Token{Type: typ, Text: sql[pos:end], Pos: pos})
+		pos = end
+	}
+	return tokens
+}
+
+// Significant returns the tokens of sql that are not whitespace or plain
+// comments.
+func Significant(tokens []Token) []Token {
+	ret := make([]Token, 0, len(tokens))
+	for _, token := range tokens {
+		if token.Significant() {
+			ret = append(ret, token)
+		}
+	}
+	return ret
+}
+
+func scanToken(sql string, pos int) (TokenType, int) {
+	c := sql[pos]
+	switch {
+	case isSpace(c):
+		end := pos + 1
+		for end < len(sql) && isSpace(sql[end]) {
+			end++
+		}
+		return TokenWhitespace, end
+	case c == '#':
+		return TokenComment, lineEnd(sql, pos)
+	case c == '-' && strings.HasPrefix(sql[pos:], "--") && (pos+2 == len(sql) || isSpace(sql[pos+2]) || sql[pos+2] < ' '):
+		return TokenComment, lineEnd(sql, pos)
+	case c == '/' && strings.HasPrefix(sql[pos:], "/*"):
+		end := strings.Index(sql[pos+2:], "*/")
+		if end == -1 {
+			end = len(sql)
+		} else {
+			end = pos + 2 + end + 2
+		}
+		switch {
+		case strings.HasPrefix(sql[pos:], "/*+"):
+			return TokenHint, end
+		case strings.HasPrefix(sql[pos:], "/*!"):
+			return TokenExecComment, end
+		}
+		return TokenComment, end
+	case c == '\'' || c == '"':
+		return TokenString, quotedEnd(sql, pos, c, true)
+	case c == '`':
+		return TokenQuotedIdent, quotedEnd(sql, pos, c, false)
+	case (c == 'x' || c == 'X' || c == 'b' || c == 'B' || c == 'n' || c == 'N') && pos+1 < len(sql) && sql[pos+1] == '\'':
+		return TokenString, quotedEnd(sql, pos+1, '\'', true)
+	case isDigit(c) || c == '.' && pos+1 < len(sql) && isDigit(sql[pos+1]):
+		return scanNumber(sql, pos)
+	case c == '@':
+		end := pos + 1
+		if end < len(sql) && sql[end] == '@' {
+			end++
+		}
+		if end < len(sql) && (sql[end] == '\'' || sql[end] == '"' || sql[end] == '`') {
+			return TokenVariable, quotedEnd(sql, end, sql[end], sql[end] != '`')
+		}
+		for end < len(sql) && (isWordChar(sql[end]) || sql[end] == '.') {
+			end++
+		}
+		return TokenVariable, end
+	case c == '?':
+		return TokenPlaceholder, pos + 1
+	case isWordChar(c):
+		end := pos + 1
+		for end < len(sql) && isWordChar(sql[end]) {
+			end++
+		}
+		return TokenWord, end
+	}
+	return TokenPunct, scanPunct(sql, pos)
+}
+
+// quotedEnd returns the end of the quoted string starting at pos. A doubled
+// quote stands for the quote itself, and so does a backslash escape in
+// strings.
+func quotedEnd(sql string, pos int, quote byte, backslash bool) int {
+	for i := pos + 1; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+func scanNumber(sql string, pos int) (TokenType, int) {
+	end := pos
+	if strings.HasPrefix(sql[pos:], "0x") || strings.HasPrefix(sql[pos:], "0b") {
+		end = pos + 2
+		for end < len(sql) && isWordChar(sql[end]) {
+			end++
+		}
+		return TokenNumber, end
+	}
+	for end < len(sql) && (isDigit(sql[end]) || sql[end] == '.') {
+		end++
+	}
+	if end < len(sql) && (sql[end] == 'e' || sql[end] == 'E') {
+		exp := end + 1
+		if exp < len(sql) && (sql[exp] == '+' || sql[exp] == '-') {
+			exp++
+		}
+		if exp < len(sql) && isDigit(sql[exp]) {
+			end = exp
+			for end < len(sql) && isDigit(sql[end]) {
+				end++
+			}
+		}
+	}
+	// Identifiers may start with digits, e.g. 1st_table.
+	if end < len(sql) && isWordChar(sql[end]) {
+		for end < len(sql) && isWordChar(sql[end]) {
+			end++
+		}
+		return TokenWord, end
+	}
+	return TokenNumber, end
+}
+
+var operators = []string{"<=>", "<<", ">>", "<=", ">=", "<>", "!=", ":=", "&&", "||", "->>", "->"}
+
+func scanPunct(sql string, pos int) int {
+	for _, op := range operators {
+		if strings.HasPrefix(sql[pos:], op) {
+			return pos + len(op)
+		}
+	}
+	return pos + 1
+}
+
+func lineEnd(sql string, pos int) int {
+	end := strings.IndexByte(sql[pos:], '\n')
+	if end == -1 {
+		return len(sql)
+	}
+	return pos + end
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isWordChar reports whether c can be part of an unquoted identifier. Bytes
+// of multibyte characters are all accepted, as MySQL does.
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
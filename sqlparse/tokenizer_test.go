@@ -0,0 +1,138 @@
+package sqlparse
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var tokenTypeNames = map[TokenType]string{
+	TokenWhitespace:  "space",
+	TokenComment:     "comment",
+	TokenHint:        "hint",
+	TokenExecComment: "exec",
+	TokenString:      "string",
+	TokenQuotedIdent: "ident",
+	TokenNumber:      "number",
+	TokenWord:        "word",
+	TokenVariable:    "var",
+	TokenPlaceholder: "placeholder",
+	TokenPunct:       "punct",
+}
+
+// describeTokens lists the tokens of sql as type(text), leaving out
+// whitespace.
+func describeTokens(t *testing.T, sql string) string {
+	tokens := Tokenize(sql)
+	parts := []string{}
+	end := 0
+	for _, token := range tokens {
+		if token.Pos != end || sql[token.Pos:token.Pos+len(token.Text)] != token.Text {
+			t.Fatalf("%q: token %q at %d does not follow on at %d", sql, token.Text, token.Pos, end)
+		}
+		end = token.Pos + len(token.Text)
+		if token.Type != TokenWhitespace {
+			parts = append(parts, fmt.Sprintf("%s(%s)", tokenTypeNames[token.Type], token.Text))
+		}
+	}
+	if end != len(sql) {
+		t.Fatalf("%q: tokens end at %d", sql, end)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{
+			name: "words and numbers",
+			sql:  "SELECT a, 1.5e3, 0x1F, 1st_col FROM t",
+			want: "word(SELECT) word(a) punct(,) number(1.5e3) punct(,) number(0x1F) punct(,) word(1st_col) word(FROM) word(t)",
+		},
+		{
+			name: "quotes",
+			sql:  `SELECT 'a', "b", ` + "`c d`" + `, X'0F', N'n'`,
+			want: "word(SELECT) string('a') punct(,) string(\"b\") punct(,) ident(`c d`) punct(,) string(X'0F') punct(,) string(N'n')",
+		},
+		{
+			name: "escaped and doubled quotes",
+			sql:  `SELECT 'it''s', 'a\'b', "x\"y", ` + "`a``b`",
+			want: `word(SELECT) string('it''s') punct(,) string('a\'b') punct(,) string("x\"y") punct(,) ident(` + "`a``b`" + `)`,
+		},
+		{
+			name: "backslash does not escape in identifiers",
+			sql:  "SELECT `a\\` FROM t",
+			want: "word(SELECT) ident(`a\\`) word(FROM) word(t)",
+		},
+		{
+			name: "comment markers inside strings",
+			sql:  "SELECT '-- x', '/* y */', '#z'",
+			want: "word(SELECT) string('-- x') punct(,) string('/* y */') punct(,) string('#z')",
+		},
+		{
+			name: "dash dash comment",
+			sql:  "SELECT 1 -- note\nFROM t",
+			want: "word(SELECT) number(1) comment(-- note) word(FROM) word(t)",
+		},
+		{
+			name: "dash dash without a space is arithmetic",
+			sql:  "SELECT 1--1",
+			want: "word(SELECT) number(1) punct(-) punct(-) number(1)",
+		},
+		{
+			name: "dash dash at the end",
+			sql:  "SELECT 1 --",
+			want: "word(SELECT) number(1) comment(--)",
+		},
+		{
+			name: "dash dash before a tab",
+			sql:  "SELECT 1 --\tnote",
+			want: "word(SELECT) number(1) comment(--\tnote)",
+		},
+		{
+			name: "hash comment",
+			sql:  "SELECT 1 # note\n, 2",
+			want: "word(SELECT) number(1) comment(# note) punct(,) number(2)",
+		},
+		{
+			name: "block comment, hint and executable comment",
+			sql:  "SELECT /*+ MAX_EXECUTION_TIME(1) */ /*!50000 SQL_NO_CACHE */ /* plain */ 1",
+			want: "word(SELECT) hint(/*+ MAX_EXECUTION_TIME(1) */) exec(/*!50000 SQL_NO_CACHE */) comment(/* plain */) number(1)",
+		},
+		{
+			name: "unterminated comment",
+			sql:  "SELECT 1 /* open",
+			want: "word(SELECT) number(1) comment(/* open)",
+		},
+		{
+			name: "unterminated string",
+			sql:  "SELECT 'open",
+			want: "word(SELECT) string('open)",
+		},
+		{
+			name: "variables and placeholders",
+			sql:  "SET @a = @@session.sql_mode, @`b c` := ?",
+			want: "word(SET) var(@a) punct(=) var(@@session.sql_mode) punct(,) var(@`b c`) punct(:=) placeholder(?)",
+		},
+		{
+			name: "operators",
+			sql:  "a<=>b AND c->>'$.d' != e",
+			want: "word(a) punct(<=>) word(b) word(AND) word(c) punct(->>) string('$.d') punct(!=) word(e)",
+		},
+		{
+			name: "multiple statements",
+			sql:  "SELECT 1; SELECT ';'; -- done",
+			want: "word(SELECT) number(1) punct(;) word(SELECT) string(';') punct(;) comment(-- done)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := describeTokens(t, test.sql); got != test.want {
+				t.Fatalf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}